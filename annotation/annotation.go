@@ -0,0 +1,245 @@
+// Package annotation annotates results with the network and location of the
+// client, looked up in local databases supplied by the operator: a prefix to
+// origin AS table in the routeviews pfx2as format, and a geo database in CSV
+// format. The lookups use the client IP before it is anonymized, so that the
+// archived results can be analyzed without joining them with annotation data
+// later. The databases are reloaded when their files change.
+package annotation
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	annotationReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_annotation_reloads_total",
+			Help: "Number of attempts to load the annotation databases.",
+		},
+		[]string{"result"},
+	)
+	annotationLookups = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_annotation_lookups_total",
+			Help: "Number of client IP lookups in each annotation database, by outcome.",
+		},
+		[]string{"database", "result"},
+	)
+	annotatedTests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_annotated_results_total",
+			Help: "Number of results by protocol and client country and AS, when enabled.",
+		},
+		[]string{"protocol", "country", "asn"},
+	)
+
+	mu               sync.RWMutex
+	defaultAnnotator *Annotator
+)
+
+// Config names the databases of an Annotator. Either file may be empty.
+type Config struct {
+	// ASNFile is a prefix to origin AS table in the routeviews pfx2as format.
+	ASNFile string
+	// GeoFile is a geo database in CSV format, with the columns network,
+	// country code and region.
+	GeoFile string
+	// Metrics enables counting the results by country and AS. At most
+	// MetricASNs distinct ASes are used as label values, and the results of
+	// other ASes are counted as "other".
+	Metrics    bool
+	MetricASNs int
+}
+
+// Annotator looks up client IPs in the databases.
+type Annotator struct {
+	config Config
+
+	mu        sync.RWMutex
+	asns      *table
+	asnValues []uint32
+	geo       *table
+	locations []location
+	modTimes  map[string]time.Time
+
+	labelsMu sync.Mutex
+	labels   map[string]bool
+}
+
+// New creates an Annotator and loads its databases.
+func New(config Config) (*Annotator, error) {
+	a := &Annotator{config: config, labels: make(map[string]bool)}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload loads the databases again. When either fails to load, the previously
+// loaded databases remain in use and the error is returned.
+func (a *Annotator) Reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, name := range []string{a.config.ASNFile, a.config.GeoFile} {
+		if name == "" {
+			continue
+		}
+		// Record modification times before reading the files, so that a change
+		// during the load is detected by the next call to Watch.
+		fi, err := os.Stat(name)
+		if err != nil {
+			annotationReloads.WithLabelValues("error").Inc()
+			return err
+		}
+		modTimes[name] = fi.ModTime()
+	}
+	var (
+		asns, geo *table
+		asnValues []uint32
+		locations []location
+		err       error
+	)
+	if a.config.ASNFile != "" {
+		if asns, asnValues, err = loadASNs(a.config.ASNFile); err != nil {
+			annotationReloads.WithLabelValues("error").Inc()
+			return err
+		}
+	}
+	if a.config.GeoFile != "" {
+		if geo, locations, err = loadLocations(a.config.GeoFile); err != nil {
+			annotationReloads.WithLabelValues("error").Inc()
+			return err
+		}
+	}
+
+	a.mu.Lock()
+	a.asns, a.asnValues = asns, asnValues
+	a.geo, a.locations = geo, locations
+	a.modTimes = modTimes
+	a.mu.Unlock()
+	annotationReloads.WithLabelValues("ok").Inc()
+	return nil
+}
+
+// changed reports whether any database file was modified since the last
+// successful load.
+func (a *Annotator) changed() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for name, modTime := range a.modTimes {
+		fi, err := os.Stat(name)
+		if err != nil {
+			// The file may be in the middle of being replaced. Try again later.
+			continue
+		}
+		if !fi.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch checks the database files for changes every interval and reloads them
+// when they change. Watch returns when ctx is canceled.
+func (a *Annotator) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if !a.changed() {
+				continue
+			}
+			if err := a.Reload(); err != nil {
+				logging.Logger.WithError(err).Warn("annotation: could not reload databases")
+				continue
+			}
+			logging.Logger.Info("annotation: reloaded databases")
+		}
+	}
+}
+
+// Annotate returns the annotation of the client ip for a result of the given
+// protocol, or nil when the client is in neither database. It is safe to call
+// Annotate on a nil Annotator, which returns nil.
+func (a *Annotator) Annotate(protocol string, ip net.IP) *data.ClientAnnotation {
+	if a == nil || ip == nil {
+		return nil
+	}
+	var ann data.ClientAnnotation
+	a.mu.RLock()
+	if i, found := a.asns.lookup(ip); found {
+		ann.ASN = a.asnValues[i]
+	}
+	if i, found := a.geo.lookup(ip); found {
+		ann.CountryCode = a.locations[i].country
+		ann.Region = a.locations[i].region
+	}
+	a.mu.RUnlock()
+
+	if a.config.ASNFile != "" {
+		annotationLookups.WithLabelValues("asn", result(ann.ASN != 0)).Inc()
+	}
+	if a.config.GeoFile != "" {
+		annotationLookups.WithLabelValues("geo", result(ann.CountryCode != "")).Inc()
+	}
+	if a.config.Metrics {
+		annotatedTests.WithLabelValues(protocol, ann.CountryCode, a.asnLabel(ann.ASN)).Inc()
+	}
+	if ann == (data.ClientAnnotation{}) {
+		return nil
+	}
+	return &ann
+}
+
+func result(found bool) string {
+	if found {
+		return "found"
+	}
+	return "missing"
+}
+
+// asnLabel returns the label value for asn, which is "other" once the label
+// values of MetricASNs distinct ASes are in use.
+func (a *Annotator) asnLabel(asn uint32) string {
+	if asn == 0 {
+		return ""
+	}
+	label := strconv.FormatUint(uint64(asn), 10)
+	a.labelsMu.Lock()
+	defer a.labelsMu.Unlock()
+	if !a.labels[label] {
+		if len(a.labels) >= a.config.MetricASNs {
+			return "other"
+		}
+		a.labels[label] = true
+	}
+	return label
+}
+
+// SetDefault sets the Annotator used by the package-level Annotate function.
+// A nil Annotator disables the annotation.
+func SetDefault(a *Annotator) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultAnnotator = a
+}
+
+// Annotate returns the annotation of the client ip from the default
+// Annotator.
+func Annotate(protocol string, ip net.IP) *data.ClientAnnotation {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultAnnotator.Annotate(protocol, ip)
+}
@@ -0,0 +1,140 @@
+package annotation
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/data"
+)
+
+const (
+	pfx2as = `1.0.0.0	24	13335
+1.0.0.0	16	64496
+2001:db8::	32	64497_64498
+2001:db8:1::	48	64499,64500
+`
+	geoCSV = `network,country_code,region
+1.0.0.0/8,au,
+2001:db8::/32,US,NY
+# A comment.
+2001:db8:1::/48,DE,BE
+`
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	rtx.Must(ioutil.WriteFile(path, []byte(content), 0644), "Could not write %s", name)
+	return path
+}
+
+func TestAnnotator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestAnnotator")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	a, err := New(Config{
+		ASNFile:    writeFile(t, dir, "pfx2as", pfx2as),
+		GeoFile:    writeFile(t, dir, "geo.csv", geoCSV),
+		Metrics:    true,
+		MetricASNs: 1,
+	})
+	rtx.Must(err, "Could not load databases")
+
+	tests := []struct {
+		ip   string
+		want *data.ClientAnnotation
+	}{
+		{"1.0.0.1", &data.ClientAnnotation{ASN: 13335, CountryCode: "AU"}},
+		{"1.0.1.1", &data.ClientAnnotation{ASN: 64496, CountryCode: "AU"}},
+		{"1.1.0.1", &data.ClientAnnotation{CountryCode: "AU"}},
+		{"::ffff:1.0.0.1", &data.ClientAnnotation{ASN: 13335, CountryCode: "AU"}},
+		{"2001:db8::1", &data.ClientAnnotation{ASN: 64497, CountryCode: "US", Region: "NY"}},
+		{"2001:db8:1::1", &data.ClientAnnotation{ASN: 64499, CountryCode: "DE", Region: "BE"}},
+		{"192.0.2.1", nil},
+	}
+	for _, tt := range tests {
+		if got := a.Annotate("ndt7", net.ParseIP(tt.ip)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Annotate(%s) = %+v, want %+v", tt.ip, got, tt.want)
+		}
+	}
+	if label := a.asnLabel(64497); label != "other" {
+		t.Errorf("asnLabel() = %q, want other once MetricASNs are in use", label)
+	}
+
+	var nilAnnotator *Annotator
+	if got := nilAnnotator.Annotate("ndt5", net.ParseIP("1.0.0.1")); got != nil {
+		t.Errorf("Annotate() on a nil Annotator = %+v, want nil", got)
+	}
+}
+
+func TestAnnotator_reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestAnnotator_reload")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	geo := writeFile(t, dir, "geo.csv", "1.0.0.0/8,AU\n")
+	a, err := New(Config{GeoFile: geo})
+	rtx.Must(err, "Could not load databases")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Watch(ctx, 10*time.Millisecond)
+
+	// A broken database keeps the previous one in use.
+	writeFile(t, dir, "geo.csv", "not a prefix,AU\n")
+	if err := a.Reload(); err == nil {
+		t.Error("Reload() of a broken database should fail")
+	}
+	if got := a.Annotate("ndt7", net.ParseIP("1.0.0.1")); got == nil || got.CountryCode != "AU" {
+		t.Errorf("Annotate() = %+v, want the previous database", got)
+	}
+
+	writeFile(t, dir, "geo.csv", "1.0.0.0/8,NZ\n")
+	// Make sure the modification time changes on filesystems with a coarse
+	// timestamp resolution.
+	later := time.Now().Add(time.Hour)
+	rtx.Must(os.Chtimes(geo, later, later), "Could not change mtime")
+	for i := 0; i < 200; i++ {
+		if got := a.Annotate("ndt7", net.ParseIP("1.0.0.1")); got != nil && got.CountryCode == "NZ" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Watch() did not reload the changed database")
+}
+
+func TestNew_errors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNew_errors")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	for name, config := range map[string]Config{
+		"missing":    {ASNFile: filepath.Join(dir, "missing")},
+		"bad-asn":    {ASNFile: writeFile(t, dir, "bad-asn", "1.0.0.0\t24\tAS13335\n")},
+		"bad-prefix": {ASNFile: writeFile(t, dir, "bad-prefix", "1.0.0.0\t33\t13335\n")},
+		"bad-geo":    {GeoFile: writeFile(t, dir, "bad-geo", "1.0.0.0/8\n")},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("New() with %s database should fail", name)
+		}
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	if got := Annotate("ndt7", net.ParseIP("1.0.0.1")); got != nil {
+		t.Errorf("Annotate() without a default Annotator = %+v, want nil", got)
+	}
+	dir, err := ioutil.TempDir("", "TestSetDefault")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	a, err := New(Config{GeoFile: writeFile(t, dir, "geo.csv", geoCSV)})
+	rtx.Must(err, "Could not load databases")
+	SetDefault(a)
+	defer SetDefault(nil)
+	if got := Annotate("ndt7", net.ParseIP("1.0.0.1")); got == nil || got.CountryCode != "AU" {
+		t.Errorf("Annotate() = %+v, want AU", got)
+	}
+}
@@ -0,0 +1,169 @@
+package annotation
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// table maps IP prefixes to the index of their value, and finds the longest
+// prefix that contains an IP.
+type table struct {
+	// lengths are the prefix lengths in the table, longest first, for IPv4
+	// and IPv6 addresses.
+	v4, v6 []int
+	nets   map[string]int
+}
+
+func newTable() *table {
+	return &table{nets: make(map[string]int)}
+}
+
+// add adds the prefix n with the value index i. A prefix that is already in
+// the table keeps its first value.
+func (t *table) add(n *net.IPNet, i int) {
+	key := n.String()
+	if _, found := t.nets[key]; found {
+		return
+	}
+	t.nets[key] = i
+	ones, bits := n.Mask.Size()
+	lengths := &t.v6
+	if bits == 32 {
+		lengths = &t.v4
+	}
+	for _, l := range *lengths {
+		if l == ones {
+			return
+		}
+	}
+	*lengths = append(*lengths, ones)
+	sort.Sort(sort.Reverse(sort.IntSlice(*lengths)))
+}
+
+// lookup returns the value index of the longest prefix that contains ip.
+func (t *table) lookup(ip net.IP) (int, bool) {
+	if t == nil {
+		return 0, false
+	}
+	lengths, bits := t.v6, 128
+	if v4 := ip.To4(); v4 != nil {
+		ip, lengths, bits = v4, t.v4, 32
+	}
+	for _, l := range lengths {
+		mask := net.CIDRMask(l, bits)
+		n := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		if i, found := t.nets[n.String()]; found {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// loadASNs reads a prefix to origin AS table in the routeviews pfx2as format:
+// one prefix per line, with the address, the prefix length and the origin AS
+// separated by whitespace. For prefixes with several origins, e.g. "64496_64497"
+// or an AS set "64496,64497", the first origin is used.
+func loadASNs(name string) (*table, []uint32, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	t := newTable()
+	var asns []uint32
+	r := csv.NewReader(f)
+	r.Comma = '\t'
+	r.Comment = '#'
+	r.FieldsPerRecord = 3
+	r.ReuseRecord = true
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return t, asns, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		n, err := parsePrefix(rec[0] + "/" + rec[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		origin := strings.FieldsFunc(rec[2], func(r rune) bool { return r == '_' || r == ',' })
+		if len(origin) == 0 {
+			return nil, nil, fmt.Errorf("%s: missing origin AS for %s", name, n)
+		}
+		asn, err := strconv.ParseUint(origin[0], 10, 32)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: invalid origin AS %q for %s", name, rec[2], n)
+		}
+		t.add(n, len(asns))
+		asns = append(asns, uint32(asn))
+	}
+}
+
+// location is the value of a geo database entry.
+type location struct {
+	country string
+	region  string
+}
+
+// loadLocations reads a geo database in CSV format: one prefix per line, with
+// the prefix in CIDR notation, the ISO 3166-1 country code and, optionally, the
+// region. A first line starting with "network" is a header.
+func loadLocations(name string) (*table, []location, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	t := newTable()
+	var locations []location
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	for line := 1; ; line++ {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return t, locations, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if line == 1 && rec[0] == "network" {
+			continue
+		}
+		if len(rec) < 2 {
+			return nil, nil, fmt.Errorf("%s: line %d: want a prefix and a country code", name, line)
+		}
+		n, err := parsePrefix(rec[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: line %d: %v", name, line, err)
+		}
+		loc := location{country: strings.ToUpper(rec[1])}
+		if len(rec) > 2 {
+			loc.region = rec[2]
+		}
+		t.add(n, len(locations))
+		locations = append(locations, loc)
+	}
+}
+
+// parsePrefix parses a prefix in CIDR notation, with IPv4 prefixes in their
+// 4 byte form.
+func parsePrefix(s string) (*net.IPNet, error) {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if v4 := n.IP.To4(); v4 != nil {
+		n.IP = v4
+	}
+	return n, nil
+}
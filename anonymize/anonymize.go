@@ -0,0 +1,123 @@
+// Package anonymize removes identifying information from the client addresses
+// that the server archives, logs and reports. Addresses are first anonymized
+// with the method selected by the -anonymize.ip flag of
+// github.com/m-lab/go/anonymize, i.e. none or netblock. When a key is
+// configured, the result is then replaced with a keyed hash, so that tests
+// from the same client or netblock can be correlated without storing the
+// address itself.
+//
+// The anonymizer is process-wide, like the -anonymize.ip flag, because client
+// addresses must be anonymized consistently everywhere they are recorded.
+package anonymize
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"sync"
+
+	goanonymize "github.com/m-lab/go/anonymize"
+)
+
+// Anonymizer anonymizes client addresses.
+type Anonymizer struct {
+	ipa goanonymize.IPAnonymizer
+	key []byte
+}
+
+var (
+	mu                sync.RWMutex
+	defaultAnonymizer = New(goanonymize.None, nil)
+)
+
+// New creates an Anonymizer for the given method. When key is not empty, the
+// anonymized addresses are replaced with a keyed hash.
+func New(method goanonymize.Method, key []byte) *Anonymizer {
+	return &Anonymizer{
+		ipa: goanonymize.New(method),
+		key: key,
+	}
+}
+
+// IP returns the anonymized form of ip. The ip argument is not modified.
+func (a *Anonymizer) IP(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	c := make(net.IP, len(ip))
+	copy(c, ip)
+	a.ipa.IP(c)
+	if len(a.key) == 0 {
+		return c.String()
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(c.To16())
+	// 16 bytes are as many as an IPv6 address, and plenty to avoid collisions.
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// IPString returns the anonymized form of the IP address in s. When s is not
+// an IP address, it is returned unchanged.
+func (a *Anonymizer) IPString(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+	return a.IP(ip)
+}
+
+// Addr returns addr, a "host:port" address, with the host anonymized.
+func (a *Anonymizer) Addr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return a.IPString(addr)
+	}
+	return net.JoinHostPort(a.IPString(host), port)
+}
+
+// Prefix returns prefix, a network in CIDR notation, with the network address
+// anonymized. When prefix is not in CIDR notation, it is returned unchanged.
+func (a *Anonymizer) Prefix(prefix string) string {
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return prefix
+	}
+	ones, _ := ipnet.Mask.Size()
+	return a.IP(ip.Mask(ipnet.Mask)) + "/" + strconv.Itoa(ones)
+}
+
+// SetDefault sets the Anonymizer used by the package-level functions. It
+// should be called once at startup, before any tests run.
+func SetDefault(a *Anonymizer) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultAnonymizer = a
+}
+
+func getDefault() *Anonymizer {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultAnonymizer
+}
+
+// IP anonymizes ip with the default Anonymizer.
+func IP(ip net.IP) string {
+	return getDefault().IP(ip)
+}
+
+// IPString anonymizes the IP address in s with the default Anonymizer.
+func IPString(s string) string {
+	return getDefault().IPString(s)
+}
+
+// Addr anonymizes the host of addr with the default Anonymizer.
+func Addr(addr string) string {
+	return getDefault().Addr(addr)
+}
+
+// Prefix anonymizes the network address of prefix with the default Anonymizer.
+func Prefix(prefix string) string {
+	return getDefault().Prefix(prefix)
+}
@@ -0,0 +1,65 @@
+package anonymize
+
+import (
+	"net"
+	"testing"
+
+	goanonymize "github.com/m-lab/go/anonymize"
+)
+
+func TestAnonymizer(t *testing.T) {
+	none := New(goanonymize.None, nil)
+	netblock := New(goanonymize.Netblock, nil)
+	hashed := New(goanonymize.None, []byte("secret"))
+	hashedNetblock := New(goanonymize.Netblock, []byte("secret"))
+
+	tests := []struct {
+		name string
+		a    *Anonymizer
+		in   string
+		want string
+	}{
+		{name: "none-v4", a: none, in: "192.0.2.55", want: "192.0.2.55"},
+		{name: "netblock-v4", a: netblock, in: "192.0.2.55", want: "192.0.2.0"},
+		{name: "netblock-v6", a: netblock, in: "2001:db8:1:2:3:4:5:6", want: "2001:db8:1:2::"},
+		{name: "not-an-ip", a: netblock, in: "localhost", want: "localhost"},
+		{name: "hash", a: hashed, in: "192.0.2.55", want: hashed.IPString("::ffff:192.0.2.55")},
+		{name: "hash-netblock", a: hashedNetblock, in: "192.0.2.55", want: hashed.IPString("192.0.2.0")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.IPString(tt.in); got != tt.want {
+				t.Errorf("IPString(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	ip := net.ParseIP("192.0.2.55")
+	got := hashed.IP(ip)
+	if len(got) != 32 || got == hashed.IPString("192.0.2.56") {
+		t.Errorf("IP() = %q, want a distinct 32 character hash", got)
+	}
+	if ip.String() != "192.0.2.55" {
+		t.Errorf("IP() modified its argument to %s", ip)
+	}
+	if got := New(goanonymize.None, []byte("other")).IP(ip); got == hashed.IP(ip) {
+		t.Error("IP() with different keys returned the same hash")
+	}
+	if got := netblock.Addr("[2001:db8::1]:443"); got != "[2001:db8::]:443" {
+		t.Errorf("Addr() = %q, want [2001:db8::]:443", got)
+	}
+	if got := netblock.Prefix("192.0.2.64/26"); got != "192.0.2.0/26" {
+		t.Errorf("Prefix() = %q, want 192.0.2.0/26", got)
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	defer SetDefault(New(goanonymize.None, nil))
+	if got := IPString("192.0.2.55"); got != "192.0.2.55" {
+		t.Errorf("IPString() with default = %q", got)
+	}
+	SetDefault(New(goanonymize.Netblock, nil))
+	if got := Addr("192.0.2.55:1234"); got != "192.0.2.0:1234" {
+		t.Errorf("Addr() = %q, want 192.0.2.0:1234", got)
+	}
+}
@@ -1,11 +1,20 @@
 // Package bbr contains code required to read BBR variables of a net.Conn
 // on which we're serving a WebSocket client. This code currently only
 // works on Linux systems, as BBR is only available there.
+//
+// Besides BBR, the package reads the TCP_CC_INFO of the other congestion
+// control algorithms that export it, i.e. Vegas (and Illinois, which uses
+// the same structure) and DCTCP.
 package bbr
 
 import (
+	"encoding/binary"
 	"errors"
+	"math"
 	"os"
+	"strings"
+	"syscall"
+	"unsafe"
 
 	"github.com/m-lab/tcp-info/inetdiag"
 )
@@ -13,12 +22,174 @@ import (
 // ErrNoSupport indicates that this system does not support BBR.
 var ErrNoSupport = errors.New("TCP_CC_INFO not supported")
 
+// ErrNotBBR indicates that the congestion control in use is not BBR.
+var ErrNotBBR = errors.New("congestion control is not BBR")
+
+// CCInfo is the TCP_CC_INFO of a socket. Algorithm is always set, while at
+// most one of the other fields is set, depending on the algorithm. All the
+// variables have the same measurement unit that is used by the Linux kernel.
+type CCInfo struct {
+	// Algorithm is the name of the congestion control, e.g. "cubic".
+	Algorithm string
+	BBR       *BBRInfo   `json:",omitempty"`
+	Vegas     *VegasInfo `json:",omitempty"`
+	DCTCP     *DCTCPInfo `json:",omitempty"`
+}
+
+// BBRInfo is the tcp_bbr_info of BBR. The variables after the embedded
+// inetdiag.BBRInfo are only exported by BBRv2 and BBRv3, and are zero for the
+// original BBR.
+type BBRInfo struct {
+	inetdiag.BBRInfo
+	// Version is the version of BBR, i.e. 1, 2 or 3.
+	Version uint8
+	// Mode and Phase are the state of the BBR state machine.
+	Mode  uint8
+	Phase uint8
+	// BWHi and BWLo are the long and short term bandwidth bounds in
+	// bytes/second.
+	BWHi int64
+	BWLo int64
+	// InflightHi and InflightLo are the long and short term bounds of the
+	// data in flight in packets.
+	InflightHi uint32
+	InflightLo uint32
+	// ExtraAcked is the max excess of packets ACKed in an epoch.
+	ExtraAcked uint32
+}
+
+// VegasInfo is the tcpvegas_info of Vegas and Illinois.
+type VegasInfo struct {
+	Enabled uint32
+	RTTCnt  uint32
+	RTT     uint32
+	MinRTT  uint32
+}
+
+// DCTCPInfo is the tcp_dctcp_info of DCTCP.
+type DCTCPInfo struct {
+	Enabled uint16
+	CEState uint16
+	Alpha   uint32
+	ABECN   uint32
+	ABTot   uint32
+}
+
+// The sizes of the structs in the tcp_cc_info union. The tcp_bbr_info of
+// BBRv2 and BBRv3 extends the one of the original BBR.
+//
+// See include/uapi/linux/inet_diag.h in torvalds/linux and google/bbr.
+const (
+	sizeofBBRv1Info = 20
+	sizeofBBRv3Info = 52
+	sizeofVegasInfo = 16
+	sizeofDCTCPInfo = 16
+)
+
+// nativeEndian is the byte order of the kernel structs.
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
 // Enable enables BBR on |fp|.
 func Enable(fp *os.File) error {
 	return enableBBR(fp)
 }
 
-// GetBBRInfo obtains BBR info from |fp|.
+// GetBBRInfo obtains BBR info from |fp|. It returns ErrNotBBR when |fp|
+// does not use BBR.
 func GetBBRInfo(fp *os.File) (inetdiag.BBRInfo, error) {
-	return getMaxBandwidthAndMinRTT(fp)
+	cci, err := GetCCInfo(fp)
+	if err != nil {
+		return inetdiag.BBRInfo{}, err
+	}
+	if cci.BBR == nil {
+		return inetdiag.BBRInfo{}, ErrNotBBR
+	}
+	return cci.BBR.BBRInfo, nil
+}
+
+// GetCCInfo obtains the congestion control info from |fp|, whatever the
+// congestion control in use.
+func GetCCInfo(fp *os.File) (CCInfo, error) {
+	algorithm, data, err := getCCInfo(fp)
+	if err != nil {
+		return CCInfo{}, err
+	}
+	return parseCCInfo(algorithm, data)
+}
+
+// parseCCInfo decodes the TCP_CC_INFO |data| of |algorithm|. Algorithms that
+// do not export TCP_CC_INFO, e.g. cubic, have empty data.
+func parseCCInfo(algorithm string, data []byte) (CCInfo, error) {
+	cci := CCInfo{Algorithm: algorithm}
+	if len(data) == 0 {
+		return cci, nil
+	}
+	// Vegas and DCTCP have the same size, so we need the algorithm name to
+	// tell the structs apart.
+	switch {
+	case strings.HasPrefix(algorithm, "bbr"):
+		if len(data) < sizeofBBRv1Info {
+			return cci, syscall.EINVAL
+		}
+		bbr := &BBRInfo{Version: 1}
+		bw, ok := u64(data[0:], data[4:])
+		if !ok {
+			return cci, syscall.EOVERFLOW
+		}
+		bbr.BW = bw
+		bbr.MinRTT = nativeEndian.Uint32(data[8:])
+		bbr.PacingGain = nativeEndian.Uint32(data[12:])
+		bbr.CwndGain = nativeEndian.Uint32(data[16:])
+		if len(data) >= sizeofBBRv3Info {
+			// Unset bounds are ~0, so let us saturate them rather than fail.
+			bbr.BWHi, _ = u64(data[20:], data[24:])
+			bbr.BWLo, _ = u64(data[28:], data[32:])
+			bbr.Mode = data[36]
+			bbr.Phase = data[37]
+			bbr.Version = data[39]
+			bbr.InflightLo = nativeEndian.Uint32(data[40:])
+			bbr.InflightHi = nativeEndian.Uint32(data[44:])
+			bbr.ExtraAcked = nativeEndian.Uint32(data[48:])
+		}
+		cci.BBR = bbr
+	case algorithm == "vegas" || algorithm == "illinois":
+		if len(data) < sizeofVegasInfo {
+			return cci, syscall.EINVAL
+		}
+		cci.Vegas = &VegasInfo{
+			Enabled: nativeEndian.Uint32(data[0:]),
+			RTTCnt:  nativeEndian.Uint32(data[4:]),
+			RTT:     nativeEndian.Uint32(data[8:]),
+			MinRTT:  nativeEndian.Uint32(data[12:]),
+		}
+	case algorithm == "dctcp":
+		if len(data) < sizeofDCTCPInfo {
+			return cci, syscall.EINVAL
+		}
+		cci.DCTCP = &DCTCPInfo{
+			Enabled: nativeEndian.Uint16(data[0:]),
+			CEState: nativeEndian.Uint16(data[2:]),
+			Alpha:   nativeEndian.Uint32(data[4:]),
+			ABECN:   nativeEndian.Uint32(data[8:]),
+			ABTot:   nativeEndian.Uint32(data[12:]),
+		}
+	}
+	return cci, nil
+}
+
+// u64 joins the low and high 32 bit words of a 64 bit value. It returns false,
+// and math.MaxInt64, when the value does not fit an int64 (Java has no uint64).
+func u64(lo, hi []byte) (int64, bool) {
+	v := uint64(nativeEndian.Uint32(hi))<<32 | uint64(nativeEndian.Uint32(lo))
+	if v > math.MaxInt64 {
+		return math.MaxInt64, false
+	}
+	return int64(v), true
 }
@@ -6,62 +6,69 @@ package bbr
 import "C"
 
 import (
-	"math"
+	"bytes"
 	"os"
 	"syscall"
 	"unsafe"
-
-	"github.com/m-lab/tcp-info/inetdiag"
 )
 
+// The maximum length of the name of a congestion control, including the
+// terminating NUL. See TCP_CA_NAME_MAX in include/net/tcp.h.
+const caNameMax = 16
+
+// The size of the buffer for TCP_CC_INFO, which fits all the known structs.
+const ccInfoMax = 64
+
 func enableBBR(fp *os.File) error {
 	// Note: Fd() returns uintptr but on Unix we can safely use int for sockets.
 	return syscall.SetsockoptString(int(fp.Fd()), syscall.IPPROTO_TCP,
 		syscall.TCP_CONGESTION, "bbr")
 }
 
-func getMaxBandwidthAndMinRTT(fp *os.File) (inetdiag.BBRInfo, error) {
-	cci := C.union_tcp_cc_info{}
-	size := uint32(C.sizeof_union_tcp_cc_info)
+// getsockopt reads the TCP option |opt| of |fp| into |buf| and returns the
+// length of the value.
+func getsockopt(fp *os.File, opt int, buf []byte) (int, error) {
+	size := uint32(len(buf))
 	// Note: Fd() returns uintptr but on Unix we can safely use int for sockets.
 	_, _, err := syscall.Syscall6(
 		uintptr(syscall.SYS_GETSOCKOPT),
 		uintptr(int(fp.Fd())),
 		uintptr(C.IPPROTO_TCP),
-		uintptr(C.TCP_CC_INFO),
-		uintptr(unsafe.Pointer(&cci)),
+		uintptr(opt),
+		uintptr(unsafe.Pointer(&buf[0])),
 		uintptr(unsafe.Pointer(&size)),
 		uintptr(0))
-	metrics := inetdiag.BBRInfo{}
 	if err != 0 {
-		// C.get_bbr_info returns ENOSYS when the system does not support BBR. In
-		// such case let us map the error to ErrNoSupport, such that this Linux
-		// system looks like any other system where BBR is not available. This way
-		// the code for dealing with this error is not platform dependent.
+		// The kernel returns ENOSYS when the system does not support
+		// TCP_CC_INFO. In such case let us map the error to ErrNoSupport, such
+		// that this Linux system looks like any other system where BBR is not
+		// available. This way the code for dealing with this error is not
+		// platform dependent.
 		if err == syscall.ENOSYS {
-			return metrics, ErrNoSupport
+			return 0, ErrNoSupport
 		}
-		return metrics, err
+		return 0, err
+	}
+	return int(size), nil
+}
+
+func getCCInfo(fp *os.File) (string, []byte, error) {
+	name := make([]byte, caNameMax)
+	n, err := getsockopt(fp, syscall.TCP_CONGESTION, name)
+	if err != nil {
+		return "", nil, err
 	}
-	// Apparently, tcp_bbr_info is the only congestion control data structure
-	// to occupy five 32 bit words. Currently, in September 2018, the other two
-	// data structures (i.e. Vegas and DCTCP) both occupy four 32 bit words.
-	//
-	// See include/uapi/linux/inet_diag.h in torvalds/linux@bbb6189d.
-	if size != C.sizeof_struct_tcp_bbr_info {
-		return metrics, syscall.EINVAL
+	if i := bytes.IndexByte(name[:n], 0); i >= 0 {
+		n = i
 	}
-	bbrip := (*C.struct_tcp_bbr_info)(unsafe.Pointer(&cci[0]))
-	// Convert the values from the kernel provided units to the units that
-	// we're going to use in ndt7. The units we use are the most common ones
-	// in which people typically expects these variables.
-	maxbw := uint64(bbrip.bbr_bw_hi)<<32 | uint64(bbrip.bbr_bw_lo)
-	if maxbw > math.MaxInt64 {
-		return metrics, syscall.EOVERFLOW
+	// The union in the headers of most systems does not include the larger
+	// struct of BBRv2 and BBRv3, so the buffer must be larger than the union.
+	// The kernel returns the size of the struct of the congestion control in
+	// use.
+	data := make([]byte, ccInfoMax)
+	size, err := getsockopt(fp, C.TCP_CC_INFO, data)
+	if err != nil {
+		return "", nil, err
 	}
-	metrics.BW = int64(maxbw) // Java has no uint64
-	metrics.MinRTT = uint32(bbrip.bbr_min_rtt)
-	metrics.PacingGain = uint32(bbrip.bbr_pacing_gain)
-	metrics.CwndGain = uint32(bbrip.bbr_cwnd_gain)
-	return metrics, nil
+	return string(name[:n]), data[:size], nil
 }
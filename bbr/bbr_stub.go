@@ -4,14 +4,12 @@ package bbr
 
 import (
 	"os"
-
-	"github.com/m-lab/tcp-info/inetdiag"
 )
 
 func enableBBR(*os.File) error {
 	return ErrNoSupport
 }
 
-func getMaxBandwidthAndMinRTT(*os.File) (inetdiag.BBRInfo, error) {
-	return inetdiag.BBRInfo{}, ErrNoSupport
+func getCCInfo(*os.File) (string, []byte, error) {
+	return "", nil, ErrNoSupport
 }
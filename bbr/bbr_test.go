@@ -0,0 +1,116 @@
+package bbr
+
+import (
+	"math"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+// words encodes 32 bit words in the byte order of the kernel.
+func words(w ...uint32) []byte {
+	b := make([]byte, 4*len(w))
+	for i, v := range w {
+		nativeEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
+
+func Test_parseCCInfo(t *testing.T) {
+	v3 := words(1250000, 0, 412, 256, 512, 1312500, 0, math.MaxUint32, math.MaxUint32, 0, math.MaxUint32, 10, 4)
+	// Mode, Phase, unused and Version.
+	copy(v3[36:], []byte{2, 1, 0, 3})
+	dctcp := words(0, 512, 3, 7)
+	nativeEndian.PutUint16(dctcp[0:], 1)
+	nativeEndian.PutUint16(dctcp[2:], 2)
+
+	tests := []struct {
+		name      string
+		algorithm string
+		data      []byte
+		want      CCInfo
+		wantErr   error
+	}{
+		{
+			name:      "cubic",
+			algorithm: "cubic",
+			want:      CCInfo{Algorithm: "cubic"},
+		},
+		{
+			name:      "bbr",
+			algorithm: "bbr",
+			data:      words(1250000, 0, 412, 256, 512),
+			want: CCInfo{Algorithm: "bbr", BBR: &BBRInfo{
+				BBRInfo: inetdiag.BBRInfo{BW: 1250000, MinRTT: 412, PacingGain: 256, CwndGain: 512},
+				Version: 1,
+			}},
+		},
+		{
+			name:      "bbr3",
+			algorithm: "bbr",
+			data:      v3,
+			want: CCInfo{Algorithm: "bbr", BBR: &BBRInfo{
+				BBRInfo:    inetdiag.BBRInfo{BW: 1250000, MinRTT: 412, PacingGain: 256, CwndGain: 512},
+				Version:    3,
+				Mode:       2,
+				Phase:      1,
+				BWHi:       1312500,
+				BWLo:       math.MaxInt64,
+				InflightLo: math.MaxUint32,
+				InflightHi: 10,
+				ExtraAcked: 4,
+			}},
+		},
+		{
+			name:      "bbr-overflow",
+			algorithm: "bbr",
+			data:      words(0, math.MaxUint32, 412, 256, 512),
+			want:      CCInfo{Algorithm: "bbr"},
+			wantErr:   syscall.EOVERFLOW,
+		},
+		{
+			name:      "bbr-short",
+			algorithm: "bbr2",
+			data:      words(1, 2, 3, 4),
+			want:      CCInfo{Algorithm: "bbr2"},
+			wantErr:   syscall.EINVAL,
+		},
+		{
+			name:      "vegas",
+			algorithm: "vegas",
+			data:      words(1, 5, 1500, 412),
+			want:      CCInfo{Algorithm: "vegas", Vegas: &VegasInfo{Enabled: 1, RTTCnt: 5, RTT: 1500, MinRTT: 412}},
+		},
+		{
+			name:      "illinois",
+			algorithm: "illinois",
+			data:      words(1, 5, 1500, 412),
+			want:      CCInfo{Algorithm: "illinois", Vegas: &VegasInfo{Enabled: 1, RTTCnt: 5, RTT: 1500, MinRTT: 412}},
+		},
+		{
+			name:      "dctcp",
+			algorithm: "dctcp",
+			data:      dctcp,
+			want:      CCInfo{Algorithm: "dctcp", DCTCP: &DCTCPInfo{Enabled: 1, CEState: 2, Alpha: 512, ABECN: 3, ABTot: 7}},
+		},
+		{
+			name:      "unknown",
+			algorithm: "future",
+			data:      words(1, 2, 3, 4),
+			want:      CCInfo{Algorithm: "future"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCCInfo(tt.algorithm, tt.data)
+			if err != tt.wantErr {
+				t.Errorf("parseCCInfo() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCCInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
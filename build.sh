@@ -16,4 +16,4 @@ versionflags="${versionflags} -X github.com/m-lab/go/prometheusx.GitShortCommit=
 go get -v -t                                                           \
     -tags netgo                                                        \
     -ldflags "$versionflags -extldflags \"-static\""                   \
-    .
+    . ./cmd/ndt-results
@@ -0,0 +1,171 @@
+// Package certs manages the TLS certificates used by all TLS listeners. The
+// Manager loads one or more certificate/key pairs, selects a certificate for
+// each connection using the SNI server name sent by the client, and reloads
+// the certificates when their files change so that certificates can be
+// rotated without restarting the server and interrupting running tests.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrNoCertificates is returned when a Manager is created without any
+	// certificate/key pairs.
+	ErrNoCertificates = errors.New("no certificate/key pairs configured")
+
+	certExpiry = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ndt_tls_certificate_expiry_timestamp_seconds",
+			Help: "The time when the loaded TLS certificate expires, in seconds since the epoch.",
+		},
+		[]string{"cert"},
+	)
+	certReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_tls_certificate_reloads_total",
+			Help: "Number of attempts to reload the TLS certificates.",
+		},
+		[]string{"result"},
+	)
+)
+
+// Pair names the files containing a PEM encoded certificate chain and the
+// matching private key.
+type Pair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// Manager holds the certificates currently in use. Its GetCertificate method
+// is suitable for use as tls.Config.GetCertificate.
+type Manager struct {
+	pairs []Pair
+
+	mu       sync.RWMutex
+	certs    []*tls.Certificate
+	modTimes map[string]time.Time
+}
+
+// NewManager creates a Manager and loads the given certificate/key pairs. The
+// first pair is used for clients whose server name matches no certificate.
+func NewManager(pairs []Pair) (*Manager, error) {
+	if len(pairs) == 0 {
+		return nil, ErrNoCertificates
+	}
+	m := &Manager{pairs: pairs}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload loads all certificate/key pairs again. When any pair fails to load,
+// the previously loaded certificates remain in use and the error is returned.
+func (m *Manager) Reload() error {
+	certs := make([]*tls.Certificate, 0, len(m.pairs))
+	modTimes := make(map[string]time.Time)
+	for _, p := range m.pairs {
+		// Record modification times before reading the files, so that a change
+		// during the load is detected by the next call to Watch.
+		for _, name := range []string{p.CertFile, p.KeyFile} {
+			fi, err := os.Stat(name)
+			if err != nil {
+				certReloads.WithLabelValues("error").Inc()
+				return err
+			}
+			modTimes[name] = fi.ModTime()
+		}
+		cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+		if err != nil {
+			certReloads.WithLabelValues("error").Inc()
+			return fmt.Errorf("could not load %s: %v", p.CertFile, err)
+		}
+		// Parse the leaf once, rather than on every handshake.
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			certReloads.WithLabelValues("error").Inc()
+			return fmt.Errorf("could not parse %s: %v", p.CertFile, err)
+		}
+		certs = append(certs, &cert)
+	}
+
+	m.mu.Lock()
+	m.certs = certs
+	m.modTimes = modTimes
+	m.mu.Unlock()
+
+	for i, cert := range certs {
+		certExpiry.WithLabelValues(m.pairs[i].CertFile).Set(float64(cert.Leaf.NotAfter.Unix()))
+	}
+	certReloads.WithLabelValues("ok").Inc()
+	return nil
+}
+
+// GetCertificate returns the first certificate that is valid for the server
+// name requested by the client and that the client supports. When there is
+// no such certificate, the first certificate is returned.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, cert := range m.certs {
+		if hello.ServerName != "" && cert.Leaf.VerifyHostname(hello.ServerName) != nil {
+			continue
+		}
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return m.certs[0], nil
+}
+
+// changed reports whether any certificate or key file was modified since the
+// last successful load.
+func (m *Manager) changed() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for name, modTime := range m.modTimes {
+		fi, err := os.Stat(name)
+		if err != nil {
+			// The file may be in the middle of being replaced. Try again later.
+			continue
+		}
+		if !fi.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch checks the certificate and key files for changes every interval and
+// reloads them when they change. Watch returns when ctx is canceled.
+func (m *Manager) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if !m.changed() {
+				continue
+			}
+			if err := m.Reload(); err != nil {
+				logging.Logger.WithError(err).Warn("certs: could not reload certificates")
+				continue
+			}
+			logging.Logger.Info("certs: reloaded certificates")
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+)
+
+// writePair creates a self-signed certificate for the given name, which
+// expires after lifetime, and writes it to dir.
+func writePair(t *testing.T, dir, name string, lifetime time.Duration) Pair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rtx.Must(err, "Could not generate key")
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	rtx.Must(err, "Could not create certificate")
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	rtx.Must(err, "Could not marshal key")
+	p := Pair{
+		CertFile: filepath.Join(dir, name+".pem"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	rtx.Must(ioutil.WriteFile(p.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644),
+		"Could not write cert")
+	rtx.Must(ioutil.WriteFile(p.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600),
+		"Could not write key")
+	return p
+}
+
+// handshake connects to a TLS server using m and returns the common name of
+// the certificate presented for serverName.
+func handshake(t *testing.T, m *Manager, serverName string) string {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: m.GetCertificate})
+	rtx.Must(err, "Could not listen")
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.(*tls.Conn).Handshake()
+		c.Close()
+	}()
+	c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("Dial(%q) failed: %v", serverName, err)
+	}
+	defer c.Close()
+	return c.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestNewManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNewManager")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	if _, err := NewManager(nil); err != ErrNoCertificates {
+		t.Errorf("NewManager(nil) error = %v, want %v", err, ErrNoCertificates)
+	}
+	if _, err := NewManager([]Pair{{CertFile: dir + "/missing.pem", KeyFile: dir + "/missing.key"}}); err == nil {
+		t.Error("NewManager() with missing files should fail")
+	}
+	good := writePair(t, dir, "a.example.com", time.Hour)
+	if _, err := NewManager([]Pair{{CertFile: good.CertFile, KeyFile: good.CertFile}}); err == nil {
+		t.Error("NewManager() with mismatched files should fail")
+	}
+}
+
+func TestManager_GetCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestManager_GetCertificate")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	m, err := NewManager([]Pair{
+		writePair(t, dir, "a.example.com", time.Hour),
+		writePair(t, dir, "b.example.com", time.Hour),
+	})
+	rtx.Must(err, "Could not create manager")
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{serverName: "a.example.com", want: "a.example.com"},
+		{serverName: "b.example.com", want: "b.example.com"},
+		{serverName: "unknown.example.com", want: "a.example.com"},
+		{serverName: "", want: "a.example.com"},
+	}
+	for _, tt := range tests {
+		if got := handshake(t, m, tt.serverName); got != tt.want {
+			t.Errorf("certificate for %q = %q, want %q", tt.serverName, got, tt.want)
+		}
+	}
+}
+
+func TestManager_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestManager_Watch")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	p := writePair(t, dir, "a.example.com", time.Hour)
+	m, err := NewManager([]Pair{p})
+	rtx.Must(err, "Could not create manager")
+	before := m.certs[0].Leaf.NotAfter
+
+	// Unchanged files are not reloaded.
+	if m.changed() {
+		t.Error("changed() = true before files were modified")
+	}
+
+	// Replace the certificate with one that expires later, and make sure the
+	// modification time differs even on filesystems with coarse timestamps.
+	writePair(t, dir, "a.example.com", 2*time.Hour)
+	future := time.Now().Add(time.Minute)
+	rtx.Must(os.Chtimes(p.CertFile, future, future), "Could not change mtime")
+	rtx.Must(os.Chtimes(p.KeyFile, future, future), "Could not change mtime")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	m.Watch(ctx, time.Millisecond)
+
+	m.mu.RLock()
+	after := m.certs[0].Leaf.NotAfter
+	m.mu.RUnlock()
+	if !after.After(before) {
+		t.Errorf("certificate not reloaded: NotAfter %v, want after %v", after, before)
+	}
+
+	// A broken key keeps the previous certificate in use.
+	rtx.Must(ioutil.WriteFile(p.KeyFile, []byte("garbage"), 0600), "Could not write key")
+	if err := m.Reload(); err == nil {
+		t.Error("Reload() with bad key should fail")
+	}
+	if got := handshake(t, m, "a.example.com"); got != "a.example.com" {
+		t.Errorf("certificate after failed reload = %q", got)
+	}
+}
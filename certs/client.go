@@ -0,0 +1,102 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrNoCACertificates is returned by LoadClientCAs when the file contains
+	// no PEM encoded certificates.
+	ErrNoCACertificates = errors.New("no CA certificates found")
+
+	clientCertRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_tls_client_cert_requests_total",
+			Help: "Number of requests checked for a verified client certificate.",
+		},
+		[]string{"result"},
+	)
+)
+
+type subjectContextKeyType struct{}
+
+var subjectContextKey = subjectContextKeyType{}
+
+// LoadClientCAs reads the PEM encoded CA certificates used to verify client
+// certificates from file.
+func LoadClientCAs(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, ErrNoCACertificates
+	}
+	return pool, nil
+}
+
+// VerifyClientCerts configures config to verify client certificates against
+// the CAs in pool. Clients without a certificate still complete the handshake,
+// so that some paths may be served without one, and ClientCertController
+// rejects their requests on the other paths.
+func VerifyClientCerts(config *tls.Config, pool *x509.CertPool) {
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	config.ClientCAs = pool
+}
+
+// ClientSubject returns the subject of the verified client certificate of the
+// given connection, or the empty string when the client did not present a
+// verified certificate.
+func ClientSubject(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.String()
+}
+
+// SetSubject returns a derived context with the given client certificate
+// subject.
+func SetSubject(ctx context.Context, subject string) context.Context {
+	return context.WithValue(ctx, subjectContextKey, subject)
+}
+
+// GetSubject returns the verified client certificate subject stored in ctx by
+// ClientCertController, or the empty string.
+func GetSubject(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	subject, _ := ctx.Value(subjectContextKey).(string)
+	return subject
+}
+
+// ClientCertController is an access controller that accepts only requests
+// made with a verified client certificate. It is an alternative to access
+// tokens for deployments that already have a PKI for their clients.
+type ClientCertController struct{}
+
+// Limit rejects requests without a verified client certificate and adds the
+// certificate subject to the request context of accepted requests, where
+// subsequent handlers can read it with GetSubject. Limit implements the
+// access controller.Controller interface.
+func (ClientCertController) Limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			clientCertRequests.WithLabelValues("rejected").Inc()
+			// 401 - https://tools.ietf.org/html/rfc7235#section-3.1
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		clientCertRequests.WithLabelValues("accepted").Inc()
+		next.ServeHTTP(rw, req.Clone(SetSubject(req.Context(), ClientSubject(req.TLS))))
+	})
+}
@@ -0,0 +1,82 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+)
+
+func TestLoadClientCAs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestLoadClientCAs")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	p := writePair(t, dir, "ca.example.com", time.Hour)
+	if _, err := LoadClientCAs(p.CertFile); err != nil {
+		t.Errorf("LoadClientCAs() unexpected error = %v", err)
+	}
+	// The key file contains no certificates.
+	if _, err := LoadClientCAs(p.KeyFile); err != ErrNoCACertificates {
+		t.Errorf("LoadClientCAs() error = %v, want %v", err, ErrNoCACertificates)
+	}
+	if _, err := LoadClientCAs(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("LoadClientCAs() with missing file should fail")
+	}
+}
+
+func TestClientCertController(t *testing.T) {
+	client := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "probe-1", Organization: []string{"Example"}},
+	}
+	tests := []struct {
+		name        string
+		state       *tls.ConnectionState
+		wantCode    int
+		wantSubject string
+	}{
+		{
+			name:     "cleartext",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "unverified",
+			state:    &tls.ConnectionState{},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name: "verified",
+			state: &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{client}},
+			},
+			wantCode:    http.StatusOK,
+			wantSubject: "CN=probe-1,O=Example",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var subject string
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				subject = GetSubject(req.Context())
+			})
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.TLS = tt.state
+			ClientCertController{}.Limit(next).ServeHTTP(rw, req)
+			if rw.Code != tt.wantCode {
+				t.Errorf("Limit() code = %d, want %d", rw.Code, tt.wantCode)
+			}
+			if subject != tt.wantSubject {
+				t.Errorf("GetSubject() = %q, want %q", subject, tt.wantSubject)
+			}
+		})
+	}
+}
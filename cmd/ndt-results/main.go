@@ -0,0 +1,88 @@
+// ndt-results summarizes the ndt5 and ndt7 results in data directories or in
+// tar archives of data directories.
+//
+// By default, it writes one summary per test direction. With -aggregate, it
+// writes the distribution of the summaries by day, protocol, direction and,
+// with -by, the value of a client metadata key. For example:
+//
+//	ndt-results -format=csv -aggregate -by=client_library_name /var/spool/ndt
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/summary"
+)
+
+var (
+	aggregate = flag.Bool("aggregate", false, "Write the distributions of the test summaries instead of the summaries")
+	by        = flag.String("by", "", "Client metadata key to group the aggregates by, and to include as a column of the CSV summaries")
+	metadata  = flagx.StringArray{}
+	format    = flagx.Enum{
+		Options: []string{"csv", "ndjson"},
+		Value:   "csv",
+	}
+)
+
+func init() {
+	flag.Var(&format, "format", "Output format: csv or ndjson")
+	flag.Var(&metadata, "metadata", "Client metadata key to include as a column of the CSV summaries. May be repeated.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <datadir or tarball>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	keys := []string(metadata)
+	if *by != "" {
+		keys = append(keys, *by)
+	}
+	w := summary.NewWriter(out, format.Value, keys)
+	agg := summary.NewAggregator(*by)
+	failed := 0
+	for _, path := range flag.Args() {
+		err := summary.Walk(path, func(name string, b []byte) error {
+			tests, err := summary.Decode(b)
+			if err != nil {
+				log.Printf("Skipping %s: %v", name, err)
+				failed++
+				return nil
+			}
+			for i := range tests {
+				if *aggregate {
+					agg.Add(&tests[i])
+					continue
+				}
+				if err := w.WriteTest(&tests[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		rtx.Must(err, "Could not summarize %s", path)
+	}
+	if *aggregate {
+		for _, a := range agg.Aggregates() {
+			rtx.Must(w.WriteAggregate(&a), "Could not write aggregate")
+		}
+	}
+	rtx.Must(w.Flush(), "Could not write output")
+	rtx.Must(out.Flush(), "Could not write output")
+	if failed > 0 {
+		log.Printf("Skipped %d files that are not valid results", failed)
+	}
+}
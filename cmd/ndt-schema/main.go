@@ -0,0 +1,79 @@
+// ndt-schema prints the schemas of the ndt5 and ndt7 archival records, and
+// checks them against committed baselines.
+//
+// To print the BigQuery schema of ndt7 records:
+//
+//	ndt-schema -type=ndt7 -format=bigquery
+//
+// To check that the ndt7 records are compatible with a baseline BigQuery
+// schema, e.g. the schema of an existing table:
+//
+//	ndt-schema -type=ndt7 -check=data/schema/baseline/ndt7.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/data/schema"
+)
+
+var (
+	check   = flag.String("check", "", "BigQuery schema file to check the records against, instead of printing their schema")
+	recType = flagx.Enum{
+		Options: []string{"ndt5", "ndt7"},
+		Value:   "ndt7",
+	}
+	format = flagx.Enum{
+		Options: []string{"jsonschema", "bigquery"},
+		Value:   "jsonschema",
+	}
+
+	types = map[string]reflect.Type{
+		"ndt5": reflect.TypeOf(data.NDT5Result{}),
+		"ndt7": reflect.TypeOf(data.NDT7Result{}),
+	}
+)
+
+func init() {
+	flag.Var(&recType, "type", "Record type: ndt5 or ndt7")
+	flag.Var(&format, "format", "Schema format: jsonschema or bigquery")
+}
+
+func main() {
+	flag.Parse()
+	t := types[recType.Value]
+	bq, err := schema.BigQuery(t)
+	rtx.Must(err, "Could not derive the BigQuery schema")
+
+	if *check != "" {
+		b, err := ioutil.ReadFile(*check)
+		rtx.Must(err, "Could not read baseline")
+		baseline, err := schema.ParseBigQuery(b)
+		rtx.Must(err, "Could not parse baseline")
+		problems := schema.Check(baseline, bq)
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if len(problems) > 0 {
+			log.Fatalf("%s records are not compatible with %s", recType.Value, *check)
+		}
+		return
+	}
+
+	var s interface{} = bq
+	if format.Value == "jsonschema" {
+		s = schema.JSONSchema(t, fmt.Sprintf("%s result, schema version %d", recType.Value, data.SchemaVersion))
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	rtx.Must(enc.Encode(s), "Could not write schema")
+}
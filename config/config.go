@@ -0,0 +1,377 @@
+// Package config reads the ndt-server configuration from a JSON file. Every
+// setting in the file corresponds to a command line flag, and values from the
+// file are only used for flags that were given neither on the command line nor
+// through the environment.
+//
+// Errors in the file are reported with the file position of the offending
+// value, so that a configuration can be validated before it is deployed.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/ndt-server/metadata"
+)
+
+// Config is the structure of the configuration file. Unset fields leave the
+// corresponding flags unchanged.
+type Config struct {
+	Listeners  Listeners         `json:"listeners"`
+	TLS        TLS               `json:"tls"`
+	Tokens     Tokens            `json:"tokens"`
+	Labels     map[string]string `json:"labels"`
+	DataDir    *string           `json:"datadir"`
+	HTMLDir    *string           `json:"htmldir"`
+	Limits     Limits            `json:"limits"`
+	Sampling   Sampling          `json:"sampling"`
+	Anonymize  Anonymize         `json:"anonymize"`
+	Annotation Annotation        `json:"annotation"`
+	Results    Results           `json:"results"`
+	Retention  Retention         `json:"retention"`
+	Hooks      Hooks             `json:"hooks"`
+	// EventSocket is the unix socket on which connection events are
+	// published. Disabled when empty.
+	EventSocket *string `json:"event_socket"`
+	// ShutdownDeadline is how long running tests may take to complete on
+	// shutdown, e.g. "1m".
+	ShutdownDeadline *string `json:"shutdown_deadline"`
+	// LogLevel is one of "debug", "info", "warn", "error" or "fatal".
+	LogLevel *string `json:"log_level"`
+	// LogWarningSampling is the maximum number of warnings with the same
+	// message logged every second, or zero for no limit.
+	LogWarningSampling *int `json:"log_warning_sampling"`
+	// LogAccessJSON is where the JSON access log is written: "-" for stdout
+	// or a file. Disabled when empty.
+	LogAccessJSON *string `json:"log_access_json"`
+}
+
+// Listeners contains the addresses the servers listen on.
+type Listeners struct {
+	NDT7          *string `json:"ndt7"`
+	NDT7Cleartext *string `json:"ndt7_cleartext"`
+	NDT5          *string `json:"ndt5"`
+	NDT5WS        *string `json:"ndt5_ws"`
+	NDT5WSS       *string `json:"ndt5_wss"`
+	Admin         *string `json:"admin"`
+}
+
+// TLS contains the certificates and TLS settings of the TLS listeners.
+type TLS struct {
+	Certificates   []Certificate `json:"certificates"`
+	MinVersion     *string       `json:"min_version"`
+	ClientCA       *string       `json:"client_ca"`
+	ReloadInterval *string       `json:"reload_interval"`
+}
+
+// Certificate names a certificate file and the matching key file.
+type Certificate struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// Tokens contains the access token settings.
+type Tokens struct {
+	VerifyKeys   []string `json:"verify_keys"`
+	NDT5Required *bool    `json:"ndt5_required"`
+	NDT7Required *bool    `json:"ndt7_required"`
+	Machine      *string  `json:"machine"`
+}
+
+// Limits contains the per-client test limits.
+type Limits struct {
+	Window        *string `json:"window"`
+	MaxTests      *int    `json:"max_tests"`
+	MaxConcurrent *int    `json:"max_concurrent"`
+	IPv4Prefix    *int    `json:"ipv4_prefix"`
+	IPv6Prefix    *int    `json:"ipv6_prefix"`
+}
+
+// Sampling contains the intervals between ndt7 measurements, and the
+// settings of the high resolution sampler.
+type Sampling struct {
+	Min      *string `json:"min"`
+	Expected *string `json:"expected"`
+	Max      *string `json:"max"`
+	// HighResolutionInterval enables the high resolution sampler, e.g. "10ms".
+	HighResolutionInterval *string `json:"high_resolution_interval"`
+	// HighResolutionFields are the TCPInfo and BBRInfo fields it keeps, e.g.
+	// "TCPInfo.RTT".
+	HighResolutionFields []string `json:"high_resolution_fields"`
+}
+
+// Anonymize contains the client IP anonymization settings.
+type Anonymize struct {
+	// Method is "none" or "netblock".
+	Method *string `json:"method"`
+	// HashKey is a file containing the key used to hash client IPs.
+	HashKey *string `json:"hash_key"`
+}
+
+// Annotation contains the databases used to annotate results with the
+// network and location of the client.
+type Annotation struct {
+	// ASNFile is a prefix to origin AS table in the routeviews pfx2as format.
+	ASNFile *string `json:"asn_file"`
+	// GeoFile is a CSV file with network, country code and region columns.
+	GeoFile        *string `json:"geo_file"`
+	ReloadInterval *string `json:"reload_interval"`
+	// Metrics enables counting results by client country and AS, with at
+	// most MetricASNs distinct ASes.
+	Metrics    *bool `json:"metrics"`
+	MetricASNs *int  `json:"metric_asns"`
+}
+
+// Results contains the destinations of test results.
+type Results struct {
+	// File enables writing results to files in the data directory.
+	File *bool `json:"file"`
+	// NDJSON is "-" for stdout or the path of a unix socket.
+	NDJSON         *string `json:"ndjson"`
+	Webhook        *string `json:"webhook"`
+	WebhookSpool   *string `json:"webhook_spool"`
+	WebhookTimeout *string `json:"webhook_timeout"`
+	// NDT5Layout is "legacy" or "unified".
+	NDT5Layout *string `json:"ndt5_layout"`
+	// Index enables the index of all results for the admin search API.
+	Index *bool `json:"index"`
+	// RetrievalSize is the number of recent ndt7 results that clients may
+	// retrieve, and RetrievalTTL how long each one is kept.
+	RetrievalSize *int    `json:"retrieval_size"`
+	RetrievalTTL  *string `json:"retrieval_ttl"`
+}
+
+// Hooks contains the hooks run for every completed test direction.
+type Hooks struct {
+	// Exec is a command with its arguments separated by spaces.
+	Exec          *string `json:"exec"`
+	Socket        *string `json:"socket"`
+	Timeout       *string `json:"timeout"`
+	MaxConcurrent *int    `json:"max_concurrent"`
+}
+
+// Retention contains the limits on the results kept in the data directory.
+type Retention struct {
+	MaxAge       *string `json:"max_age"`
+	MaxBytes     *int64  `json:"max_bytes"`
+	MinFreeBytes *int64  `json:"min_free_bytes"`
+	ArchiveDir   *string `json:"archive_dir"`
+	Interval     *string `json:"interval"`
+}
+
+// Error describes a problem with the value at a position in a config file.
+type Error struct {
+	File   string
+	Line   int
+	Column int
+	// Field is the path of the offending value, e.g. "limits.max_tests".
+	Field string
+	Msg   string
+}
+
+func (e *Error) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", e.File, e.Line, e.Column, e.Field, e.Msg)
+}
+
+// Errors is the list of problems found in a config file.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	s := make([]string, len(e))
+	for i := range e {
+		s[i] = e[i].Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// Load reads and validates the config file. When the file is invalid, the
+// returned error is of type Errors.
+func Load(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parse(file, data)
+}
+
+func parse(file string, data []byte) (*Config, error) {
+	f := &source{name: file, data: data}
+	c := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, Errors{f.decodeError(err)}
+	}
+	if dec.More() {
+		return nil, Errors{f.errorAt(dec.InputOffset(), "", "unexpected data after the configuration")}
+	}
+	// Decoding succeeded, so the file is valid JSON and can be indexed.
+	f.index()
+	v := &validator{source: f}
+	c.validate(v)
+	if len(v.errs) > 0 {
+		sort.SliceStable(v.errs, func(i, j int) bool {
+			a, b := v.errs[i], v.errs[j]
+			return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+		})
+		return nil, v.errs
+	}
+	return c, nil
+}
+
+// Apply sets the flags in fs to the values from the config file. Flags given
+// on the command line or through the environment keep their values.
+func (c *Config) Apply(fs *flag.FlagSet) error {
+	assigned := flagx.AssignedFlags(fs)
+	for _, fv := range c.flagValues() {
+		if _, ok := assigned[fv.name]; ok {
+			continue
+		}
+		if _, ok := os.LookupEnv(flagx.MakeShellVariableName(fv.name)); ok {
+			continue
+		}
+		if err := fs.Set(fv.name, fv.value); err != nil {
+			return fmt.Errorf("could not set -%s from config: %v", fv.name, err)
+		}
+	}
+	return nil
+}
+
+// Reapply sets the flags in fs to the values from a config file reloaded
+// while the server is running. fs only defines the flags of the settings that
+// can change at runtime, and the other settings are ignored. The flags in
+// fixed, which were given on the command line or through the environment at
+// startup, keep their values, so that they take precedence over the file as
+// they do at startup.
+func (c *Config) Reapply(fs *flag.FlagSet, fixed map[string]struct{}) error {
+	for _, fv := range c.flagValues() {
+		if _, ok := fixed[fv.name]; ok || fs.Lookup(fv.name) == nil {
+			continue
+		}
+		if err := fs.Set(fv.name, fv.value); err != nil {
+			return fmt.Errorf("could not set -%s from config: %v", fv.name, err)
+		}
+	}
+	return nil
+}
+
+type flagValue struct {
+	name, value string
+}
+
+// flagValues returns the flag names and values for all fields that are set,
+// in a deterministic order.
+func (c *Config) flagValues() []flagValue {
+	var fvs []flagValue
+	str := func(name string, v *string) {
+		if v != nil {
+			fvs = append(fvs, flagValue{name, *v})
+		}
+	}
+	num := func(name string, v *int) {
+		if v != nil {
+			fvs = append(fvs, flagValue{name, strconv.Itoa(*v)})
+		}
+	}
+	num64 := func(name string, v *int64) {
+		if v != nil {
+			fvs = append(fvs, flagValue{name, strconv.FormatInt(*v, 10)})
+		}
+	}
+	boolean := func(name string, v *bool) {
+		if v != nil {
+			fvs = append(fvs, flagValue{name, strconv.FormatBool(*v)})
+		}
+	}
+	str("ndt7_addr", c.Listeners.NDT7)
+	str("ndt7_addr_cleartext", c.Listeners.NDT7Cleartext)
+	str("ndt5_addr", c.Listeners.NDT5)
+	str("ndt5_ws_addr", c.Listeners.NDT5WS)
+	str("ndt5_wss_addr", c.Listeners.NDT5WSS)
+	str("admin_addr", c.Listeners.Admin)
+	for _, cert := range c.TLS.Certificates {
+		fvs = append(fvs, flagValue{"cert", cert.Cert}, flagValue{"key", cert.Key})
+	}
+	str("tls.version", c.TLS.MinVersion)
+	str("tls.client-ca", c.TLS.ClientCA)
+	str("cert.reload-interval", c.TLS.ReloadInterval)
+	for _, key := range c.Tokens.VerifyKeys {
+		fvs = append(fvs, flagValue{"token.verify-key", key})
+	}
+	boolean("ndt5.token.required", c.Tokens.NDT5Required)
+	boolean("ndt7.token.required", c.Tokens.NDT7Required)
+	str("token.machine", c.Tokens.Machine)
+	for _, nv := range c.ServerMetadata() {
+		fvs = append(fvs, flagValue{"label", nv.Name + "=" + nv.Value})
+	}
+	str("datadir", c.DataDir)
+	str("htmldir", c.HTMLDir)
+	str("limiter.window", c.Limits.Window)
+	num("limiter.max-tests", c.Limits.MaxTests)
+	num("limiter.max-concurrent", c.Limits.MaxConcurrent)
+	num("limiter.ipv4-prefix", c.Limits.IPv4Prefix)
+	num("limiter.ipv6-prefix", c.Limits.IPv6Prefix)
+	str("ndt7.sampling.min", c.Sampling.Min)
+	str("ndt7.sampling.expected", c.Sampling.Expected)
+	str("ndt7.sampling.max", c.Sampling.Max)
+	str("ndt7.samples.interval", c.Sampling.HighResolutionInterval)
+	if len(c.Sampling.HighResolutionFields) > 0 {
+		fvs = append(fvs, flagValue{"ndt7.samples.fields", strings.Join(c.Sampling.HighResolutionFields, ",")})
+	}
+	str("anonymize.ip", c.Anonymize.Method)
+	str("anonymize.ip-key", c.Anonymize.HashKey)
+	str("annotation.asn-file", c.Annotation.ASNFile)
+	str("annotation.geo-file", c.Annotation.GeoFile)
+	str("annotation.reload-interval", c.Annotation.ReloadInterval)
+	boolean("annotation.metrics", c.Annotation.Metrics)
+	num("annotation.metric-asns", c.Annotation.MetricASNs)
+	boolean("results.file", c.Results.File)
+	str("results.ndjson", c.Results.NDJSON)
+	str("results.webhook", c.Results.Webhook)
+	str("results.webhook-spool", c.Results.WebhookSpool)
+	str("results.webhook-timeout", c.Results.WebhookTimeout)
+	str("results.ndt5-layout", c.Results.NDT5Layout)
+	boolean("results.index", c.Results.Index)
+	num("results.retrieval-size", c.Results.RetrievalSize)
+	str("results.retrieval-ttl", c.Results.RetrievalTTL)
+	str("janitor.max-age", c.Retention.MaxAge)
+	num64("janitor.max-bytes", c.Retention.MaxBytes)
+	num64("janitor.min-free-bytes", c.Retention.MinFreeBytes)
+	str("janitor.archive-dir", c.Retention.ArchiveDir)
+	str("janitor.interval", c.Retention.Interval)
+	str("hooks.exec", c.Hooks.Exec)
+	str("hooks.socket", c.Hooks.Socket)
+	str("hooks.timeout", c.Hooks.Timeout)
+	num("hooks.max-concurrent", c.Hooks.MaxConcurrent)
+	str("events.socket", c.EventSocket)
+	str("shutdown.deadline", c.ShutdownDeadline)
+	str("log.level", c.LogLevel)
+	num("log.warning-sampling", c.LogWarningSampling)
+	str("log.access-json", c.LogAccessJSON)
+	return fvs
+}
+
+// ServerMetadata returns the deployment labels sorted by name.
+func (c *Config) ServerMetadata() []metadata.NameValue {
+	names := make([]string, 0, len(c.Labels))
+	for name := range c.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	md := make([]metadata.NameValue, len(names))
+	for i, name := range names {
+		md[i] = metadata.NameValue{Name: name, Value: c.Labels[name]}
+	}
+	return md
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/rtx"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr []string
+	}{
+		{
+			name: "valid",
+			data: `{
+  "listeners": {"ndt7": ":443", "admin": ""},
+  "labels": {"deployment": "canary"},
+  "limits": {"window": "1m", "max_tests": 5},
+  "sampling": {"min": "10ms", "high_resolution_interval": "10ms", "high_resolution_fields": ["TCPInfo.RTT", "BBRInfo.BW"]},
+  "results": {"file": true, "ndjson": "-", "webhook": "https://example.com/results", "ndt5_layout": "unified", "retrieval_size": 100, "retrieval_ttl": "5m"},
+  "retention": {"max_age": "720h", "max_bytes": 1000000000, "interval": "5m"},
+  "annotation": {"reload_interval": "5m", "metrics": true, "metric_asns": 50},
+  "hooks": {"exec": "/bin/true --uuid", "timeout": "30s", "max_concurrent": 4},
+  "event_socket": "/var/run/ndt/events.sock",
+  "log_level": "info",
+  "log_warning_sampling": 10,
+  "log_access_json": "/var/log/ndt/access.json"
+}`,
+		},
+		{
+			name:    "empty",
+			data:    "",
+			wantErr: []string{"test.json:1:1: unexpected end of file"},
+		},
+		{
+			name:    "syntax",
+			data:    "{\n  \"datadir\": \"/var/spool/ndt\",\n}",
+			wantErr: []string{"test.json:3:1: invalid character '}'"},
+		},
+		{
+			name:    "wrong-type",
+			data:    "{\n  \"limits\": {\n    \"max_tests\": \"five\"\n  }\n}",
+			wantErr: []string{"test.json:3:5: limits.max_tests: cannot use a JSON string as int"},
+		},
+		{
+			name:    "unknown-field",
+			data:    "{\n  \"limits\": {\n    \"max_test\": 5\n  }\n}",
+			wantErr: []string{"test.json:3:5: limits.max_test: unknown field"},
+		},
+		{
+			name: "invalid-values",
+			data: `{
+  "listeners": {"ndt7": "443"},
+  "limits": {
+    "window": "soon",
+    "ipv4_prefix": 33
+  },
+  "sampling": {"min": "1s", "max": "100ms"},
+  "log_level": "loud"
+}`,
+			wantErr: []string{
+				`test.json:2:17: listeners.ndt7: invalid address "443"`,
+				`test.json:4:5: limits.window: invalid duration "soon"`,
+				`test.json:5:5: limits.ipv4_prefix: must be between 0 and 32`,
+				`test.json:7:3: sampling: intervals must satisfy`,
+				`test.json:8:3: log_level:`,
+			},
+		},
+		{
+			name: "invalid-samples",
+			data: `{"sampling": {"high_resolution_interval": "100us", "high_resolution_fields": ["TCPInfo.Nope"]}}`,
+			wantErr: []string{
+				"test.json:1:15: sampling.high_resolution_interval: must be at least 1ms",
+				`test.json:1:52: sampling.high_resolution_fields: unknown field "TCPInfo.Nope"`,
+			},
+		},
+		{
+			name:    "invalid-webhook",
+			data:    `{"results": {"webhook": "ftp://example.com/"}}`,
+			wantErr: []string{"test.json:1:14: results.webhook: must be an http or https URL"},
+		},
+		{
+			name:    "missing-hook",
+			data:    `{"hooks": {"exec": "/does/not/exist --uuid"}}`,
+			wantErr: []string{"test.json:1:12: hooks.exec: exec: \"/does/not/exist\""},
+		},
+		{
+			name: "missing-files",
+			data: "{\"tls\": {\"certificates\": [{\"cert\": \"/does/not/exist\"}]}}",
+			wantErr: []string{
+				"test.json:1:27: tls.certificates[0].key: missing file name",
+				"test.json:1:28: tls.certificates[0].cert: stat /does/not/exist",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parse("test.json", []byte(tt.data))
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("parse() unexpected error = %v", err)
+				}
+				return
+			}
+			errs, ok := err.(Errors)
+			if !ok {
+				t.Fatalf("parse() error = %v, want Errors", err)
+			}
+			if len(errs) != len(tt.wantErr) {
+				t.Fatalf("parse() errors = %v, want %d errors", errs, len(tt.wantErr))
+			}
+			for i, want := range tt.wantErr {
+				if !strings.Contains(errs[i].Error(), want) {
+					t.Errorf("parse() error %d = %q, want it to contain %q", i, errs[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestConfig_Apply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestConfig_Apply")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ndt-server.json")
+	rtx.Must(ioutil.WriteFile(file, []byte(`{
+  "datadir": "/from/config",
+  "htmldir": "/from/config",
+  "labels": {"b": "2", "a": "1"},
+  "limits": {"max_tests": 5, "window": "2m"}
+}`), 0644), "Could not write config")
+
+	c, err := Load(file)
+	rtx.Must(err, "Could not load config")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	datadir := fs.String("datadir", "/default", "")
+	htmldir := fs.String("htmldir", "/default", "")
+	maxTests := fs.Int("limiter.max-tests", 0, "")
+	window := fs.Duration("limiter.window", time.Minute, "")
+	labels := flagx.KeyValue{}
+	fs.Var(&labels, "label", "")
+	rtx.Must(fs.Parse([]string{"-datadir=/from/flag"}), "Could not parse flags")
+
+	rtx.Must(c.Apply(fs), "Could not apply config")
+	if *datadir != "/from/flag" {
+		t.Errorf("datadir = %q, command line flag should take precedence", *datadir)
+	}
+	if *htmldir != "/from/config" || *maxTests != 5 || *window != 2*time.Minute {
+		t.Errorf("htmldir, max-tests, window = %q, %d, %s, want values from config", *htmldir, *maxTests, *window)
+	}
+	if got := labels.Get(); got["a"] != "1" || got["b"] != "2" {
+		t.Errorf("labels = %v, want a=1 and b=2", got)
+	}
+
+	// Settings that have no corresponding flag are reported.
+	if err := c.Apply(flag.NewFlagSet("empty", flag.ContinueOnError)); err == nil {
+		t.Error("Apply() to a FlagSet without flags should fail")
+	}
+
+	// On reload, flags given at startup keep their values and the settings
+	// that cannot change at runtime are ignored.
+	fs = flag.NewFlagSet("reload", flag.ContinueOnError)
+	maxTests = fs.Int("limiter.max-tests", 3, "")
+	window = fs.Duration("limiter.window", time.Minute, "")
+	fixed := map[string]struct{}{"limiter.max-tests": {}}
+	rtx.Must(c.Reapply(fs, fixed), "Could not reapply config")
+	if *maxTests != 3 || *window != 2*time.Minute {
+		t.Errorf("max-tests, window = %d, %s, want 3 from startup and 2m from config", *maxTests, *window)
+	}
+	md := c.ServerMetadata()
+	if len(md) != 2 || md[0].Name != "a" || md[1].Name != "b" {
+		t.Errorf("ServerMetadata() = %v, want sorted labels", md)
+	}
+}
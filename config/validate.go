@@ -0,0 +1,360 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	goanonymize "github.com/m-lab/go/anonymize"
+	"github.com/m-lab/go/memoryless"
+	"github.com/m-lab/ndt-server/ndt7/samplefields"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+)
+
+// source is the content of a config file and an index from the path of every
+// value in the file to its offset.
+type source struct {
+	name    string
+	data    []byte
+	offsets map[string]int64
+}
+
+// index records the offset of every object key and array element.
+func (s *source) index() {
+	s.offsets = make(map[string]int64)
+	s.walk(json.NewDecoder(bytes.NewReader(s.data)), "")
+}
+
+func (s *source) walk(dec *json.Decoder, path string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			start := s.skip(dec.InputOffset())
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			p := key.(string)
+			if path != "" {
+				p = path + "." + p
+			}
+			s.offsets[p] = start
+			if err := s.walk(dec, p); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			s.offsets[p] = s.skip(dec.InputOffset())
+			if err := s.walk(dec, p); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+	return err
+}
+
+// skip returns the offset of the first byte at or after off that is not
+// whitespace or a separator.
+func (s *source) skip(off int64) int64 {
+	for off < int64(len(s.data)) && strings.IndexByte(" \t\r\n,:", s.data[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+// lookup returns the offset of the value at path. When path is not in the
+// file, lookup returns the offset of the closest enclosing value.
+func (s *source) lookup(path string) int64 {
+	for path != "" {
+		if off, ok := s.offsets[path]; ok {
+			return off
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return 0
+}
+
+func (s *source) errorAt(off int64, field, msg string) *Error {
+	if off > int64(len(s.data)) {
+		off = int64(len(s.data))
+	}
+	if off < 0 {
+		off = 0
+	}
+	line := 1 + bytes.Count(s.data[:off], []byte("\n"))
+	column := int(off) - bytes.LastIndexByte(s.data[:off], '\n')
+	return &Error{
+		File:   s.name,
+		Line:   line,
+		Column: column,
+		Field:  field,
+		Msg:    msg,
+	}
+}
+
+// decodeError converts an error from the JSON decoder into an Error with the
+// position of the problem.
+func (s *source) decodeError(err error) *Error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		// The offset is just after the offending byte.
+		return s.errorAt(e.Offset-1, "", e.Error())
+	case *json.UnmarshalTypeError:
+		// The file is valid JSON, so the field can be found in the index.
+		s.index()
+		return s.errorAt(s.lookup(e.Field), e.Field, fmt.Sprintf("cannot use a JSON %s as %s", e.Value, e.Type))
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return s.errorAt(int64(len(s.data)), "", "unexpected end of file")
+	}
+	// The decoder reports unknown fields without their position, but the file
+	// is valid JSON up to that point, so the field can be found in the index.
+	const unknownField = "json: unknown field "
+	if strings.HasPrefix(err.Error(), unknownField) {
+		name, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), unknownField))
+		s.index()
+		field, off := name, int64(0)
+		found := false
+		for path, o := range s.offsets {
+			if (path == name || strings.HasSuffix(path, "."+name)) && (!found || o < off) {
+				field, off, found = path, o, true
+			}
+		}
+		return s.errorAt(off, field, "unknown field")
+	}
+	return s.errorAt(0, "", err.Error())
+}
+
+// validator collects the semantic errors in a decoded config file.
+type validator struct {
+	*source
+	errs Errors
+}
+
+func (v *validator) errorf(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, v.errorAt(v.lookup(field), field, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) duration(field string, value *string, min time.Duration) (time.Duration, bool) {
+	if value == nil {
+		return 0, false
+	}
+	d, err := time.ParseDuration(*value)
+	if err != nil {
+		v.errorf(field, "invalid duration %q", *value)
+		return 0, false
+	}
+	if d < min {
+		v.errorf(field, "must be at least %s", min)
+		return 0, false
+	}
+	return d, true
+}
+
+func (v *validator) address(field string, value *string, allowEmpty bool) {
+	if value == nil || (allowEmpty && *value == "") {
+		return
+	}
+	if _, _, err := net.SplitHostPort(*value); err != nil {
+		v.errorf(field, "invalid address %q: %v", *value, err)
+	}
+}
+
+func (v *validator) file(field, name string) {
+	if name == "" {
+		v.errorf(field, "missing file name")
+		return
+	}
+	if _, err := os.Stat(name); err != nil {
+		v.errorf(field, "%v", err)
+	}
+}
+
+func (v *validator) intRange(field string, value *int, min, max int) {
+	if value != nil && (*value < min || *value > max) {
+		v.errorf(field, "must be between %d and %d", min, max)
+	}
+}
+
+func (v *validator) nonNegative(field string, value *int) {
+	if value != nil && *value < 0 {
+		v.errorf(field, "must not be negative")
+	}
+}
+
+func (c *Config) validate(v *validator) {
+	v.address("listeners.ndt7", c.Listeners.NDT7, false)
+	v.address("listeners.ndt7_cleartext", c.Listeners.NDT7Cleartext, false)
+	v.address("listeners.ndt5", c.Listeners.NDT5, false)
+	v.address("listeners.ndt5_ws", c.Listeners.NDT5WS, false)
+	v.address("listeners.ndt5_wss", c.Listeners.NDT5WSS, false)
+	v.address("listeners.admin", c.Listeners.Admin, true)
+
+	for i, cert := range c.TLS.Certificates {
+		field := fmt.Sprintf("tls.certificates[%d]", i)
+		v.file(field+".cert", cert.Cert)
+		v.file(field+".key", cert.Key)
+	}
+	if c.TLS.MinVersion != nil {
+		switch *c.TLS.MinVersion {
+		case "", "1.2", "1.3":
+		default:
+			v.errorf("tls.min_version", "must be 1.2 or 1.3")
+		}
+	}
+	if c.TLS.ClientCA != nil && *c.TLS.ClientCA != "" {
+		v.file("tls.client_ca", *c.TLS.ClientCA)
+	}
+	v.duration("tls.reload_interval", c.TLS.ReloadInterval, time.Second)
+
+	for i, key := range c.Tokens.VerifyKeys {
+		v.file(fmt.Sprintf("tokens.verify_keys[%d]", i), key)
+	}
+
+	for name, value := range c.Labels {
+		field := "labels." + name
+		switch {
+		case name == "" || strings.ContainsAny(name, ",="):
+			v.errorf(field, "label names must be non-empty and must not contain ',' or '='")
+		case strings.Contains(value, ","):
+			v.errorf(field, "label values must not contain ','")
+		case strings.HasPrefix(value, "@"):
+			v.errorf(field, "label values must not start with '@'")
+		}
+	}
+
+	if c.DataDir != nil && *c.DataDir == "" {
+		v.errorf("datadir", "must not be empty")
+	}
+	if c.HTMLDir != nil && *c.HTMLDir == "" {
+		v.errorf("htmldir", "must not be empty")
+	}
+
+	v.duration("limits.window", c.Limits.Window, time.Second)
+	v.nonNegative("limits.max_tests", c.Limits.MaxTests)
+	v.nonNegative("limits.max_concurrent", c.Limits.MaxConcurrent)
+	v.intRange("limits.ipv4_prefix", c.Limits.IPv4Prefix, 0, 32)
+	v.intRange("limits.ipv6_prefix", c.Limits.IPv6Prefix, 0, 128)
+
+	// Unset sampling intervals keep the defaults from the ndt7 specification.
+	sampling := memoryless.Config{
+		Min:      spec.MinPoissonSamplingInterval,
+		Expected: spec.AveragePoissonSamplingInterval,
+		Max:      spec.MaxPoissonSamplingInterval,
+	}
+	valid := true
+	for _, s := range []struct {
+		field string
+		value *string
+		dst   *time.Duration
+	}{
+		{"sampling.min", c.Sampling.Min, &sampling.Min},
+		{"sampling.expected", c.Sampling.Expected, &sampling.Expected},
+		{"sampling.max", c.Sampling.Max, &sampling.Max},
+	} {
+		if s.value == nil {
+			continue
+		}
+		d, ok := v.duration(s.field, s.value, time.Millisecond)
+		valid = valid && ok
+		*s.dst = d
+	}
+	if valid && sampling.Check() != nil {
+		v.errorf("sampling", "intervals must satisfy min <= expected <= max, got %s, %s and %s",
+			sampling.Min, sampling.Expected, sampling.Max)
+	}
+	v.duration("sampling.high_resolution_interval", c.Sampling.HighResolutionInterval, time.Millisecond)
+	if len(c.Sampling.HighResolutionFields) > 0 {
+		if err := samplefields.Check(c.Sampling.HighResolutionFields); err != nil {
+			v.errorf("sampling.high_resolution_fields", "%v", err)
+		}
+	}
+
+	if c.Anonymize.Method != nil {
+		m := goanonymize.None
+		if err := m.Set(*c.Anonymize.Method); err != nil {
+			v.errorf("anonymize.method", "must be none or netblock")
+		}
+	}
+	if c.Anonymize.HashKey != nil {
+		v.file("anonymize.hash_key", *c.Anonymize.HashKey)
+	}
+
+	for field, name := range map[string]*string{
+		"annotation.asn_file": c.Annotation.ASNFile,
+		"annotation.geo_file": c.Annotation.GeoFile,
+	} {
+		if name != nil && *name != "" {
+			v.file(field, *name)
+		}
+	}
+	v.duration("annotation.reload_interval", c.Annotation.ReloadInterval, time.Second)
+	v.nonNegative("annotation.metric_asns", c.Annotation.MetricASNs)
+
+	if c.Results.Webhook != nil && *c.Results.Webhook != "" {
+		u, err := url.Parse(*c.Results.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.errorf("results.webhook", "must be an http or https URL")
+		}
+	}
+	v.duration("results.webhook_timeout", c.Results.WebhookTimeout, time.Second)
+	if c.Results.NDT5Layout != nil {
+		switch *c.Results.NDT5Layout {
+		case "legacy", "unified":
+		default:
+			v.errorf("results.ndt5_layout", "must be legacy or unified")
+		}
+	}
+	v.nonNegative("results.retrieval_size", c.Results.RetrievalSize)
+	v.duration("results.retrieval_ttl", c.Results.RetrievalTTL, time.Second)
+
+	v.duration("retention.max_age", c.Retention.MaxAge, 0)
+	for field, value := range map[string]*int64{
+		"retention.max_bytes":      c.Retention.MaxBytes,
+		"retention.min_free_bytes": c.Retention.MinFreeBytes,
+	} {
+		if value != nil && *value < 0 {
+			v.errorf(field, "must not be negative")
+		}
+	}
+	v.duration("retention.interval", c.Retention.Interval, time.Second)
+
+	if c.Hooks.Exec != nil {
+		if fields := strings.Fields(*c.Hooks.Exec); len(fields) > 0 {
+			if _, err := exec.LookPath(fields[0]); err != nil {
+				v.errorf("hooks.exec", "%v", err)
+			}
+		}
+	}
+	v.duration("hooks.timeout", c.Hooks.Timeout, time.Second)
+	v.nonNegative("hooks.max_concurrent", c.Hooks.MaxConcurrent)
+
+	v.duration("shutdown_deadline", c.ShutdownDeadline, 0)
+	if c.LogLevel != nil {
+		if _, err := log.ParseLevel(*c.LogLevel); err != nil {
+			v.errorf("log_level", "%v", err)
+		}
+	}
+	v.nonNegative("log_warning_sampling", c.LogWarningSampling)
+}
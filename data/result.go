@@ -8,6 +8,7 @@ import (
 	"github.com/m-lab/ndt-server/ndt5/s2c"
 
 	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/timeline"
 )
 
 // NDTResult is preserved for legacy compatibility with an older unified version
@@ -15,6 +16,11 @@ import (
 // TODO(github.com/m-lab/ndt-server/issues/260) remove this alias once no one uses it.
 type NDTResult = NDT5Result
 
+// SchemaVersion is the version of the schema of NDT5Result and NDT7Result. It
+// must be incremented whenever fields are added to either of them. Fields must
+// never be removed or retyped, which the data/schema package verifies.
+const SchemaVersion = 6
+
 // NDT5Result is the struct that is serialized as JSON to disk as the archival
 // record of an NDT test.
 //
@@ -26,11 +32,15 @@ type NDTResult = NDT5Result
 // WARNING: The BigQuery schema is inferred directly from this structure. To
 // preserve compatibility with historical data, never remove fields.
 // For more information see: https://github.com/m-lab/etl/issues/719
+// The tests of the data/schema package fail when a field is removed or retyped.
 type NDT5Result struct {
 	// GitShortCommit is the Git commit (short form) of the running server code.
 	GitShortCommit string
 	// Version is the symbolic version (if any) of the running server code.
 	Version string
+	// SchemaVersion is the SchemaVersion of the server that wrote the record.
+	// It is missing from records written before versioning was introduced.
+	SchemaVersion int
 
 	// All data members should all be self-describing. In the event of confusion,
 	// rename them to add clarity rather than adding a comment.
@@ -38,9 +48,14 @@ type NDT5Result struct {
 	ServerPort int
 	ClientIP   string
 	ClientPort int
+	// ClientAnnotation is looked up in the operator's local databases
+	// before the client IP is anonymized.
+	ClientAnnotation *ClientAnnotation `json:",omitempty"`
 
 	StartTime time.Time
 	EndTime   time.Time
+	// Timeline records when the steps of the test happened.
+	Timeline *timeline.Timeline `json:",omitempty"`
 
 	// ndt5
 	Control *control.ArchivalData `json:",omitempty"`
@@ -48,6 +63,15 @@ type NDT5Result struct {
 	S2C     *s2c.ArchivalData     `json:",omitempty"`
 }
 
+// ClientAnnotation describes the network and location of a client.
+type ClientAnnotation struct {
+	// ASN is the origin AS of the longest prefix that contains the client IP.
+	ASN uint32 `json:",omitempty"`
+	// CountryCode is an ISO 3166-1 alpha-2 code.
+	CountryCode string `json:",omitempty"`
+	Region      string `json:",omitempty"`
+}
+
 // NDT7Result is the struct that is serialized as JSON to disk as the archival
 // record of an NDT7 test. This is similar to, but independent from, the NDT5Result.
 type NDT7Result struct {
@@ -55,6 +79,9 @@ type NDT7Result struct {
 	GitShortCommit string
 	// Version is the symbolic version (if any) of the running server code.
 	Version string
+	// SchemaVersion is the SchemaVersion of the server that wrote the record.
+	// It is missing from records written before versioning was introduced.
+	SchemaVersion int
 
 	// All data members should all be self-describing. In the event of confusion,
 	// rename them to add clarity rather than adding a comment.
@@ -62,9 +89,14 @@ type NDT7Result struct {
 	ServerPort int
 	ClientIP   string
 	ClientPort int
+	// ClientAnnotation is looked up in the operator's local databases
+	// before the client IP is anonymized.
+	ClientAnnotation *ClientAnnotation `json:",omitempty"`
 
 	StartTime time.Time
 	EndTime   time.Time
+	// Timeline records when the steps of the test happened.
+	Timeline *timeline.Timeline `json:",omitempty"`
 
 	// ndt7
 	Upload   *model.ArchivalData `json:",omitempty"`
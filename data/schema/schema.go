@@ -0,0 +1,257 @@
+// Package schema derives the schemas of the archival records from their Go
+// types, following the rules of encoding/json. It produces JSON Schema
+// documents and BigQuery table schemas, and checks that a schema is
+// compatible with a baseline: BigQuery tables hold years of historical data,
+// so fields may be added to the archival records but never removed or
+// retyped.
+//
+// The baselines of the current records are committed in the baseline
+// directory, and regenerated with
+//
+//	go run ./cmd/ndt-schema -format=bigquery -type=ndt5 > data/schema/baseline/ndt5.json
+//	go run ./cmd/ndt-schema -format=bigquery -type=ndt7 > data/schema/baseline/ndt7.json
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// Field is a field of a BigQuery table schema, in the JSON representation
+// used by the bq tool.
+type Field struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Mode   string   `json:"mode"`
+	Fields []*Field `json:"fields,omitempty"`
+}
+
+// field is a field of a struct as encoding/json sees it.
+type field struct {
+	name      string
+	typ       reflect.Type
+	omitempty bool
+	// bigquery is false for fields tagged with `bigquery:"-"`.
+	bigquery bool
+}
+
+// fields returns the fields of the struct type t in the order encoding/json
+// writes them, with the fields of embedded structs promoted. Fields of the
+// outer struct hide the promoted fields with the same name.
+func fields(t reflect.Type) []field {
+	var all []field
+	promoted := make(map[int]bool)
+	direct := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+		ft := sf.Type
+		if sf.Anonymous && name == "" {
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for _, f := range fields(ft) {
+					promoted[len(all)] = true
+					all = append(all, f)
+				}
+				continue
+			}
+		}
+		if sf.PkgPath != "" {
+			continue // Unexported.
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		direct[name] = true
+		all = append(all, field{
+			name:      name,
+			typ:       ft,
+			omitempty: strings.Contains(","+opts+",", ",omitempty,"),
+			bigquery:  sf.Tag.Get("bigquery") != "-",
+		})
+	}
+	var visible []field
+	for i, f := range all {
+		if !promoted[i] || !direct[f.name] {
+			visible = append(visible, f)
+		}
+	}
+	return visible
+}
+
+// BigQuery returns the BigQuery table schema of the records of type t. Fields
+// tagged with `bigquery:"-"` are omitted.
+func BigQuery(t reflect.Type) ([]*Field, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%s is not a struct", t)
+	}
+	var schema []*Field
+	for _, f := range fields(t) {
+		if !f.bigquery {
+			continue
+		}
+		bf, err := bigQueryField(f.name, f.typ)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", t.Name(), f.name, err)
+		}
+		schema = append(schema, bf)
+	}
+	return schema, nil
+}
+
+func bigQueryField(name string, t reflect.Type) (*Field, error) {
+	mode := "NULLABLE"
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8 {
+		mode = "REPEATED"
+		t = t.Elem()
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+	}
+	f := &Field{Name: name, Mode: mode}
+	switch {
+	case t == timeType:
+		f.Type = "TIMESTAMP"
+	case t.Kind() == reflect.Struct:
+		f.Type = "RECORD"
+		var err error
+		if f.Fields, err = BigQuery(t); err != nil {
+			return nil, err
+		}
+	case t.Kind() == reflect.Slice:
+		f.Type = "BYTES"
+	case t.Kind() == reflect.String:
+		f.Type = "STRING"
+	case t.Kind() == reflect.Bool:
+		f.Type = "BOOLEAN"
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		f.Type = "INTEGER"
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		f.Type = "FLOAT"
+	default:
+		return nil, fmt.Errorf("unsupported type %s", t)
+	}
+	return f, nil
+}
+
+// JSONSchema returns a JSON Schema (draft-07) document for the records of type
+// t, with the given title.
+func JSONSchema(t reflect.Type, title string) map[string]interface{} {
+	s := jsonSchema(t)
+	s["$schema"] = "http://json-schema.org/draft-07/schema#"
+	s["title"] = title
+	return s
+}
+
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	nullable := false
+	if t.Kind() == reflect.Ptr {
+		nullable = true
+		t = t.Elem()
+	}
+	var s map[string]interface{}
+	switch {
+	case t == timeType:
+		s = map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == durationType:
+		s = map[string]interface{}{"type": "integer", "description": "nanoseconds"}
+	case t.Kind() == reflect.Struct:
+		props := make(map[string]interface{})
+		var required []string
+		for _, f := range fields(t) {
+			props[f.name] = jsonSchema(f.typ)
+			if !f.omitempty {
+				required = append(required, f.name)
+			}
+		}
+		s = map[string]interface{}{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		s = map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		// A nil slice is encoded as null.
+		nullable = t.Kind() == reflect.Slice
+		s = map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		s = map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case t.Kind() == reflect.String:
+		s = map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		s = map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		s = map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		s = map[string]interface{}{"type": "number"}
+	default:
+		s = map[string]interface{}{}
+	}
+	if nullable {
+		if typ, ok := s["type"].(string); ok {
+			s["type"] = []string{typ, "null"}
+		}
+	}
+	return s
+}
+
+// Check returns a description of every field of the baseline schema that the
+// schema removes or retypes. Fields that are only in the schema are new, and
+// are compatible.
+func Check(baseline, schema []*Field) []string {
+	return check("", baseline, schema)
+}
+
+func check(prefix string, baseline, schema []*Field) []string {
+	byName := make(map[string]*Field, len(schema))
+	for _, f := range schema {
+		byName[f.Name] = f
+	}
+	var problems []string
+	for _, old := range baseline {
+		name := prefix + old.Name
+		f, found := byName[old.Name]
+		switch {
+		case !found:
+			problems = append(problems, fmt.Sprintf("%s: removed", name))
+		case f.Type != old.Type:
+			problems = append(problems, fmt.Sprintf("%s: type changed from %s to %s", name, old.Type, f.Type))
+		case (f.Mode == "REPEATED") != (old.Mode == "REPEATED"):
+			problems = append(problems, fmt.Sprintf("%s: mode changed from %s to %s", name, old.Mode, f.Mode))
+		case f.Type == "RECORD":
+			problems = append(problems, check(name+".", old.Fields, f.Fields)...)
+		}
+	}
+	return problems
+}
+
+// ParseBigQuery parses a BigQuery table schema in the JSON representation
+// used by the bq tool.
+func ParseBigQuery(b []byte) ([]*Field, error) {
+	var schema []*Field
+	err := json.Unmarshal(b, &schema)
+	return schema, err
+}
@@ -0,0 +1,115 @@
+package schema
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/data"
+)
+
+func TestBaselines(t *testing.T) {
+	for name, typ := range map[string]reflect.Type{
+		"ndt5": reflect.TypeOf(data.NDT5Result{}),
+		"ndt7": reflect.TypeOf(data.NDT7Result{}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			b, err := ioutil.ReadFile("baseline/" + name + ".json")
+			rtx.Must(err, "could not read baseline")
+			baseline, err := ParseBigQuery(b)
+			rtx.Must(err, "could not parse baseline")
+			current, err := BigQuery(typ)
+			rtx.Must(err, "could not derive schema")
+			if problems := Check(baseline, current); len(problems) > 0 {
+				t.Fatalf("%s records are not compatible with the baseline:\n%s", name, strings.Join(problems, "\n"))
+			}
+			if !reflect.DeepEqual(baseline, current) {
+				t.Errorf("fields were added to %s records: increment data.SchemaVersion and regenerate the baseline", name)
+			}
+		})
+	}
+}
+
+type inner struct {
+	A      int
+	Hidden string
+}
+
+type record struct {
+	inner
+	Hidden    float64
+	Renamed   string    `json:"name"`
+	Skipped   string    `json:"-"`
+	Optional  *inner    `json:",omitempty"`
+	List      []string  `json:",omitempty"`
+	Time      time.Time `bigquery:"-"`
+	Raw       []byte
+	unexposed int
+}
+
+func TestBigQuery(t *testing.T) {
+	got, err := BigQuery(reflect.TypeOf(&record{}))
+	rtx.Must(err, "BigQuery failed")
+	b, err := json.Marshal(got)
+	rtx.Must(err, "could not marshal schema")
+	want := `[{"name":"A","type":"INTEGER","mode":"NULLABLE"},` +
+		`{"name":"Hidden","type":"FLOAT","mode":"NULLABLE"},` +
+		`{"name":"name","type":"STRING","mode":"NULLABLE"},` +
+		`{"name":"Optional","type":"RECORD","mode":"NULLABLE","fields":[` +
+		`{"name":"A","type":"INTEGER","mode":"NULLABLE"},{"name":"Hidden","type":"STRING","mode":"NULLABLE"}]},` +
+		`{"name":"List","type":"STRING","mode":"REPEATED"},` +
+		`{"name":"Raw","type":"BYTES","mode":"NULLABLE"}]`
+	if string(b) != want {
+		t.Errorf("BigQuery() = %s, want %s", b, want)
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	s := JSONSchema(reflect.TypeOf(record{}), "record")
+	props := s["properties"].(map[string]interface{})
+	if _, found := props["Skipped"]; found {
+		t.Errorf("JSONSchema() includes a field tagged with json:\"-\"")
+	}
+	if typ := props["Time"].(map[string]interface{})["format"]; typ != "date-time" {
+		t.Errorf("JSONSchema() Time format = %v, want date-time", typ)
+	}
+	if typ := props["Optional"].(map[string]interface{})["type"]; !reflect.DeepEqual(typ, []string{"object", "null"}) {
+		t.Errorf("JSONSchema() Optional type = %v, want nullable object", typ)
+	}
+	want := []string{"A", "Hidden", "name", "Time", "Raw"}
+	if !reflect.DeepEqual(s["required"], want) {
+		t.Errorf("JSONSchema() required = %v, want %v", s["required"], want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	baseline := []*Field{
+		{Name: "A", Type: "INTEGER", Mode: "NULLABLE"},
+		{Name: "B", Type: "STRING", Mode: "NULLABLE"},
+		{Name: "C", Type: "STRING", Mode: "REPEATED"},
+		{Name: "D", Type: "RECORD", Mode: "NULLABLE", Fields: []*Field{
+			{Name: "E", Type: "FLOAT", Mode: "NULLABLE"},
+		}},
+	}
+	current := []*Field{
+		{Name: "A", Type: "INTEGER", Mode: "NULLABLE"},
+		{Name: "B", Type: "INTEGER", Mode: "NULLABLE"},
+		{Name: "C", Type: "STRING", Mode: "NULLABLE"},
+		{Name: "D", Type: "RECORD", Mode: "NULLABLE", Fields: []*Field{
+			{Name: "F", Type: "FLOAT", Mode: "NULLABLE"},
+		}},
+		{Name: "G", Type: "STRING", Mode: "NULLABLE"},
+	}
+	got := strings.Join(Check(baseline, current), "\n")
+	want := "B: type changed from STRING to INTEGER\nC: mode changed from REPEATED to NULLABLE\nD.E: removed"
+	if got != want {
+		t.Errorf("Check() = %q, want %q", got, want)
+	}
+	if problems := Check(baseline, baseline); len(problems) != 0 {
+		t.Errorf("Check() of the baseline itself = %v", problems)
+	}
+}
@@ -0,0 +1,163 @@
+// Package events publishes the opening and closing of measurement connections
+// on a unix socket, using the eventsocket protocol of tcp-info. Sidecars such
+// as packet capture and traceroute can connect to the socket and key their
+// data off the UUIDs of the connections, which are the same UUIDs as in the
+// archival data.
+//
+// Events are delivered on a best-effort basis: a slow client never delays a
+// test, and events are dropped when too many are waiting for delivery.
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// queueSize is the number of events that may wait for delivery.
+const queueSize = 1000
+
+var (
+	flowEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_flow_events_total",
+			Help: "Number of connection events published on the event socket, by event and outcome.",
+		},
+		[]string{"event", "result"},
+	)
+
+	mu            sync.RWMutex
+	defaultServer *Server
+)
+
+// Server publishes connection events to the clients of a unix socket.
+type Server struct {
+	srv    eventsocket.Server
+	queue  chan *eventsocket.FlowEvent
+	stop   chan struct{}
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+// New creates a Server for the unix socket at path.
+func New(path string) *Server {
+	return &Server{
+		srv:   eventsocket.New(path),
+		queue: make(chan *eventsocket.FlowEvent, queueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Listen creates the unix socket and starts serving events to its clients
+// until Close is called.
+func (s *Server) Listen() error {
+	if err := s.srv.Listen(); err != nil {
+		return err
+	}
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	go s.srv.Serve(ctx)
+	go s.forward()
+	return nil
+}
+
+// forward hands the queued events to the eventsocket server, which may block
+// while it writes to its clients.
+func (s *Server) forward() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case e := <-s.queue:
+			if e.Event == eventsocket.Open {
+				s.srv.FlowCreated(e.Timestamp, e.UUID, *e.ID)
+			} else {
+				s.srv.FlowDeleted(e.Timestamp, e.UUID)
+			}
+		}
+	}
+}
+
+// Close stops serving events and removes the unix socket. Events that are
+// still queued are dropped.
+func (s *Server) Close() error {
+	close(s.stop)
+	<-s.done
+	// The eventsocket server must only stop once no more events are handed
+	// to it.
+	s.cancel()
+	return nil
+}
+
+func (s *Server) publish(e *eventsocket.FlowEvent) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.queue <- e:
+		flowEvents.WithLabelValues(e.Event.String(), "ok").Inc()
+	default:
+		flowEvents.WithLabelValues(e.Event.String(), "dropped").Inc()
+	}
+}
+
+// Open publishes the opening of the connection with the given UUID. It is safe
+// to call Open on a nil Server, which does nothing.
+func (s *Server) Open(uuid string, id inetdiag.SockID) {
+	s.publish(&eventsocket.FlowEvent{
+		Event:     eventsocket.Open,
+		Timestamp: time.Now(),
+		UUID:      uuid,
+		ID:        &id,
+	})
+}
+
+// Closed publishes the closing of the connection with the given UUID. It is
+// safe to call Closed on a nil Server, which does nothing.
+func (s *Server) Closed(uuid string) {
+	s.publish(&eventsocket.FlowEvent{
+		Event:     eventsocket.Close,
+		Timestamp: time.Now(),
+		UUID:      uuid,
+	})
+}
+
+// SockID returns the socket ID of a connection from the server address to the
+// client address, given as strings and ports.
+func SockID(serverIP string, serverPort int, clientIP string, clientPort int) inetdiag.SockID {
+	return inetdiag.SockID{
+		SrcIP: serverIP,
+		SPort: uint16(serverPort),
+		DstIP: clientIP,
+		DPort: uint16(clientPort),
+	}
+}
+
+// SetDefault sets the Server used by the package-level Open and Closed
+// functions. A nil Server disables the events.
+func SetDefault(s *Server) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultServer = s
+}
+
+// Open publishes the opening of a connection on the default Server.
+func Open(uuid string, id inetdiag.SockID) {
+	mu.RLock()
+	defer mu.RUnlock()
+	defaultServer.Open(uuid, id)
+}
+
+// Closed publishes the closing of a connection on the default Server.
+func Closed(uuid string) {
+	mu.RLock()
+	defer mu.RUnlock()
+	defaultServer.Closed(uuid)
+}
@@ -0,0 +1,47 @@
+package events_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/events"
+	"github.com/m-lab/ndt-server/events/eventstest"
+)
+
+func TestServer(t *testing.T) {
+	srv, client, cleanup := eventstest.NewEventServer(t)
+	defer cleanup()
+
+	srv.Open("uuid-1", events.SockID("192.168.0.1", 443, "10.0.0.0", 5678))
+	srv.Closed("uuid-1")
+	uuid, id := client.Expect(t, 5*time.Second)
+	if uuid != "uuid-1" {
+		t.Errorf("UUID = %q, want uuid-1", uuid)
+	}
+	if id.SrcIP != "192.168.0.1" || id.SPort != 443 || id.DstIP != "10.0.0.0" || id.DPort != 5678 {
+		t.Errorf("SockID = %+v, want the server and client addresses", id)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	// Without a default server, events are discarded.
+	events.Open("uuid-0", events.SockID("", 0, "", 0))
+	events.Closed("uuid-0")
+
+	srv, client, cleanup := eventstest.NewEventServer(t)
+	defer cleanup()
+	events.SetDefault(srv)
+	defer events.SetDefault(nil)
+
+	events.Open("uuid-2", events.SockID("::1", 80, "::1", 1234))
+	events.Closed("uuid-2")
+	if uuid, _ := client.Expect(t, 5*time.Second); uuid != "uuid-2" {
+		t.Errorf("UUID = %q, want uuid-2", uuid)
+	}
+}
+
+func TestNilServer(t *testing.T) {
+	var srv *events.Server
+	srv.Open("uuid", events.SockID("", 0, "", 0))
+	srv.Closed("uuid")
+}
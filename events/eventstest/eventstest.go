@@ -0,0 +1,110 @@
+// Package eventstest runs an in-process event socket server with a connected
+// client, to verify the connection events in unittests.
+package eventstest
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/testingx"
+	"github.com/m-lab/ndt-server/events"
+	"github.com/m-lab/tcp-info/eventsocket"
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+// probeUUID is the UUID of the events used to find out when the client is
+// connected.
+const probeUUID = "eventstest-probe"
+
+// Client receives the events of a Server.
+type Client struct {
+	conn   net.Conn
+	events chan eventsocket.FlowEvent
+}
+
+// NewEventServer creates and starts a Server on a temporary unix socket, and
+// connects a Client to it. Every event published after NewEventServer returns
+// is received by the Client. The returned function stops both and removes the
+// socket.
+func NewEventServer(t *testing.T) (*events.Server, *Client, func()) {
+	dir, err := ioutil.TempDir("", "eventstest-*")
+	testingx.Must(t, err, "failed to create temp dir")
+	socket := filepath.Join(dir, "events.sock")
+	srv := events.New(socket)
+	testingx.Must(t, srv.Listen(), "failed to listen on %s", socket)
+	conn, err := net.Dial("unix", socket)
+	testingx.Must(t, err, "failed to connect to %s", socket)
+	c := &Client{conn: conn, events: make(chan eventsocket.FlowEvent, 100)}
+	go c.read()
+
+	// The server registers new clients asynchronously, and only sends them
+	// the events published afterwards.
+	timeout := time.After(10 * time.Second)
+	for connected := false; !connected; {
+		srv.Closed(probeUUID)
+		select {
+		case e := <-c.events:
+			connected = e.UUID == probeUUID
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("event socket client did not connect")
+		}
+	}
+	// Drain the probes still on their way.
+	time.Sleep(50 * time.Millisecond)
+	for len(c.events) > 0 {
+		<-c.events
+	}
+	return srv, c, func() {
+		srv.Close()
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func (c *Client) read() {
+	s := bufio.NewScanner(c.conn)
+	for s.Scan() {
+		var e eventsocket.FlowEvent
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			continue
+		}
+		c.events <- e
+	}
+	close(c.events)
+}
+
+// Next returns the next event received by the Client. It fails the test when
+// no event is received within the timeout.
+func (c *Client) Next(t *testing.T, timeout time.Duration) eventsocket.FlowEvent {
+	select {
+	case e, ok := <-c.events:
+		if !ok {
+			t.Fatal("event socket closed")
+		}
+		return e
+	case <-time.After(timeout):
+		t.Fatal("no event received")
+	}
+	return eventsocket.FlowEvent{}
+}
+
+// Expect returns the next events received by the Client, and fails the test
+// unless they are the opening and closing of a connection with the same UUID.
+func (c *Client) Expect(t *testing.T, timeout time.Duration) (string, *inetdiag.SockID) {
+	open := c.Next(t, timeout)
+	if open.Event != eventsocket.Open || open.ID == nil {
+		t.Fatalf("event = %+v, want an Open event with a socket ID", open)
+	}
+	closed := c.Next(t, timeout)
+	if closed.Event != eventsocket.Close || closed.UUID != open.UUID {
+		t.Fatalf("event = %+v, want the Close event of %s", closed, open.UUID)
+	}
+	return open.UUID, open.ID
+}
@@ -8,7 +8,7 @@ require (
 	github.com/google/uuid v1.2.0
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/websocket v1.4.2
-	github.com/justinas/alice v1.2.0 // indirect
+	github.com/justinas/alice v1.2.0
 	github.com/m-lab/access v0.0.9
 	github.com/m-lab/go v0.1.47
 	github.com/m-lab/tcp-info v1.5.3
@@ -17,5 +17,5 @@ require (
 	github.com/prometheus/prometheus v2.5.0+incompatible // indirect
 	go.uber.org/goleak v1.1.12
 	gopkg.in/m-lab/pipe.v3 v3.0.0-20180108231244-604e84f43ee0
-	gopkg.in/square/go-jose.v2 v2.5.1 // indirect
+	gopkg.in/square/go-jose.v2 v2.5.1
 )
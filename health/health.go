@@ -0,0 +1,266 @@
+// Package health implements liveness and readiness probes for orchestrators
+// like Kubernetes, and an authenticated endpoint to control lame duck mode
+// without sending signals to the server.
+package health
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/m-lab/ndt-server/janitor"
+	"github.com/m-lab/ndt-server/lameduck"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/netx"
+)
+
+// Status is the JSON document returned by the probe endpoints.
+type Status struct {
+	// Status is "ok" when the probe succeeds and "fail" otherwise.
+	Status      string
+	LameDuck    bool
+	ActiveTests int
+	// Listeners maps each registered listener name to its address.
+	Listeners map[string]string
+	// Checks maps each check name to "ok" or to the reason it failed.
+	Checks map[string]string
+}
+
+// Checker reports the health of the server. Listeners are registered with
+// AddListener once they are serving.
+type Checker struct {
+	datadir   string
+	mu        sync.Mutex
+	listeners map[string]string
+	stopped   bool
+	bbr       error
+	tcpinfo   error
+}
+
+// New creates a Checker that verifies that datadir is writable. New also probes
+// once whether the platform supports BBR and TCP_INFO on TCP connections.
+func New(datadir string) *Checker {
+	c := &Checker{
+		datadir:   datadir,
+		listeners: make(map[string]string),
+	}
+	c.bbr, c.tcpinfo = probePlatform()
+	return c
+}
+
+// AddListener records that the named listener is serving on addr.
+func (c *Checker) AddListener(name, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listeners[name] = addr
+}
+
+// StopListeners records that the server is shutting down and that listeners
+// are no longer accepting new connections.
+func (c *Checker) StopListeners() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+}
+
+// Healthz reports whether the server is alive. It fails when listeners have
+// stopped or the datadir is not writable, i.e. when a restart may help. Lame
+// duck mode does not fail the liveness probe.
+func (c *Checker) Healthz(rw http.ResponseWriter, req *http.Request) {
+	status := c.status()
+	ok := status.Checks["listeners"] == "ok" && status.Checks["datadir"] == "ok"
+	writeStatus(rw, status, ok)
+}
+
+// Readyz reports whether the server is ready to run new tests. In addition to
+// the liveness checks, it fails while the server is in lame duck mode or the
+// disk is too full to save results.
+func (c *Checker) Readyz(rw http.ResponseWriter, req *http.Request) {
+	status := c.status()
+	ok := status.Checks["listeners"] == "ok" && status.Checks["datadir"] == "ok" &&
+		status.Checks["disk"] == "ok" && !status.LameDuck
+	writeStatus(rw, status, ok)
+}
+
+func (c *Checker) status() *Status {
+	status := &Status{
+		LameDuck:    lameduck.LameDuck(),
+		ActiveTests: lameduck.Active(),
+		Listeners:   c.copyListeners(),
+		Checks: map[string]string{
+			"listeners": c.checkListeners(),
+			"datadir":   result(checkWritable(c.datadir)),
+			"disk":      result(janitor.Admit()),
+			"bbr":       result(c.bbr),
+			"tcpinfo":   result(c.tcpinfo),
+		},
+	}
+	if status.LameDuck {
+		status.Checks["lameduck"] = "enabled"
+	} else {
+		status.Checks["lameduck"] = "ok"
+	}
+	return status
+}
+
+func (c *Checker) checkListeners() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return "stopped"
+	}
+	if len(c.listeners) == 0 {
+		return "no listeners"
+	}
+	return "ok"
+}
+
+func (c *Checker) copyListeners() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[string]string, len(c.listeners))
+	for name, addr := range c.listeners {
+		m[name] = addr
+	}
+	return m
+}
+
+func result(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// checkWritable verifies that a file can be created in dir.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// probePlatform opens a loopback TCP connection and attempts to enable BBR and
+// read TCP_INFO from it.
+func probePlatform() (bbrErr, tcpinfoErr error) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return err, err
+	}
+	ln := netx.NewListener(l)
+	defer ln.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return err, err
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		return err, err
+	}
+	defer conn.Close()
+	ci := netx.ToConnInfo(conn)
+	bbrErr = ci.EnableBBR()
+	_, _, tcpinfoErr = ci.ReadInfo()
+	return bbrErr, tcpinfoErr
+}
+
+func writeStatus(rw http.ResponseWriter, status *Status, ok bool) {
+	code := http.StatusOK
+	status.Status = "ok"
+	if !ok {
+		// 503 - https://tools.ietf.org/html/rfc7231#section-6.6.4
+		code = http.StatusServiceUnavailable
+		status.Status = "fail"
+	}
+	writeJSON(rw, code, status)
+}
+
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	rw.Write(b)
+}
+
+// lameDuckStatus is the JSON document returned by the lame duck endpoint.
+type lameDuckStatus struct {
+	LameDuck    bool
+	ActiveTests int
+}
+
+// LameDuckHandler returns a handler to read (GET) or change (POST) the lame
+// duck status. A POST request must include an "enabled" parameter with a
+// boolean value. Once the server is shutting down, disabling lame duck fails
+// with 409 Conflict. Every request must present secret as a bearer token in the
+// Authorization header. When secret is empty, every request is rejected.
+func LameDuckHandler(secret []byte) http.Handler {
+	return Authorize(secret, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		code := http.StatusOK
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			enabled, err := strconv.ParseBool(req.FormValue("enabled"))
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			logging.Logger.Infof("health: setting lame duck to %t from %s", enabled, req.RemoteAddr)
+			if err := lameduck.SetLameDuck(enabled); err != nil {
+				// 409 - https://tools.ietf.org/html/rfc7231#section-6.5.8
+				code = http.StatusConflict
+			}
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(rw, code, &lameDuckStatus{
+			LameDuck:    lameduck.LameDuck(),
+			ActiveTests: lameduck.Active(),
+		})
+	}))
+}
+
+// Authorize returns a handler that passes the requests that present secret as
+// a bearer token in the Authorization header on to next, and rejects all
+// others. When secret is empty, every request is rejected.
+func Authorize(secret []byte, next http.Handler) http.Handler {
+	secret = bytes.TrimSpace(secret)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !authorized(req, secret) {
+			// 401 - https://tools.ietf.org/html/rfc7235#section-3.1
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+func authorized(req *http.Request, secret []byte) bool {
+	if len(secret) == 0 {
+		return false
+	}
+	auth := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	token := []byte(strings.TrimPrefix(auth, prefix))
+	return subtle.ConstantTimeCompare(token, secret) == 1
+}
@@ -0,0 +1,166 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/lameduck"
+)
+
+func getStatus(t *testing.T, h http.HandlerFunc) (int, *Status) {
+	rw := httptest.NewRecorder()
+	h(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	s := &Status{}
+	if err := json.Unmarshal(rw.Body.Bytes(), s); err != nil {
+		t.Fatalf("failed to parse status %q: %v", rw.Body.String(), err)
+	}
+	return rw.Code, s
+}
+
+func TestChecker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestChecker")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	defer lameduck.SetLameDuck(false)
+
+	c := New(dir)
+	// Without listeners the server is neither healthy nor ready.
+	if code, _ := getStatus(t, c.Healthz); code != http.StatusServiceUnavailable {
+		t.Errorf("Healthz() without listeners = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	c.AddListener("ndt7", ":443")
+	code, s := getStatus(t, c.Readyz)
+	if code != http.StatusOK || s.Status != "ok" {
+		t.Errorf("Readyz() = %d %#v, want %d", code, s, http.StatusOK)
+	}
+	if s.Listeners["ndt7"] != ":443" {
+		t.Errorf("Readyz() listeners = %v, want ndt7", s.Listeners)
+	}
+
+	// Lame duck fails readiness, but not liveness.
+	lameduck.SetLameDuck(true)
+	if code, _ := getStatus(t, c.Readyz); code != http.StatusServiceUnavailable {
+		t.Errorf("Readyz() in lame duck = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if code, _ := getStatus(t, c.Healthz); code != http.StatusOK {
+		t.Errorf("Healthz() in lame duck = %d, want %d", code, http.StatusOK)
+	}
+	lameduck.SetLameDuck(false)
+
+	// An unwritable datadir fails both probes.
+	c.datadir = "/dev/null/not-a-dir"
+	code, s = getStatus(t, c.Healthz)
+	if code != http.StatusServiceUnavailable || s.Checks["datadir"] == "ok" {
+		t.Errorf("Healthz() with bad datadir = %d %v", code, s.Checks)
+	}
+	c.datadir = dir
+
+	c.StopListeners()
+	if code, _ := getStatus(t, c.Healthz); code != http.StatusServiceUnavailable {
+		t.Errorf("Healthz() after stop = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestLameDuckHandler(t *testing.T) {
+	defer lameduck.SetLameDuck(false)
+	tests := []struct {
+		name     string
+		secret   string
+		method   string
+		target   string
+		auth     string
+		wantCode int
+		wantLame bool
+	}{
+		{
+			name:     "no-secret-configured",
+			method:   http.MethodGet,
+			target:   "/lameduck",
+			auth:     "Bearer ",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "wrong-secret",
+			secret:   "s3cret\n",
+			method:   http.MethodPost,
+			target:   "/lameduck?enabled=true",
+			auth:     "Bearer wrong",
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "enable",
+			secret:   "s3cret\n",
+			method:   http.MethodPost,
+			target:   "/lameduck?enabled=true",
+			auth:     "Bearer s3cret",
+			wantCode: http.StatusOK,
+			wantLame: true,
+		},
+		{
+			name:     "get",
+			secret:   "s3cret",
+			method:   http.MethodGet,
+			target:   "/lameduck",
+			auth:     "Bearer s3cret",
+			wantCode: http.StatusOK,
+			wantLame: true,
+		},
+		{
+			name:     "bad-value",
+			secret:   "s3cret",
+			method:   http.MethodPost,
+			target:   "/lameduck?enabled=maybe",
+			auth:     "Bearer s3cret",
+			wantCode: http.StatusBadRequest,
+			wantLame: true,
+		},
+		{
+			name:     "disable",
+			secret:   "s3cret",
+			method:   http.MethodPost,
+			target:   "/lameduck?enabled=false",
+			auth:     "Bearer s3cret",
+			wantCode: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := LameDuckHandler([]byte(tt.secret))
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(""))
+			req.Header.Set("Authorization", tt.auth)
+			h.ServeHTTP(rw, req)
+			if rw.Code != tt.wantCode {
+				t.Errorf("LameDuckHandler() code = %d, want %d", rw.Code, tt.wantCode)
+			}
+			if lameduck.LameDuck() != tt.wantLame {
+				t.Errorf("LameDuck() = %t, want %t", lameduck.LameDuck(), tt.wantLame)
+			}
+		})
+	}
+}
+
+func TestLameDuckHandler_shutdown(t *testing.T) {
+	defer lameduck.SetDefault(lameduck.New())
+	lameduck.SetDefault(lameduck.New())
+	lameduck.Shutdown(context.Background())
+
+	h := LameDuckHandler([]byte("s3cret"))
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/lameduck?enabled=false", strings.NewReader(""))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusConflict {
+		t.Errorf("LameDuckHandler() code = %d, want %d", rw.Code, http.StatusConflict)
+	}
+	if !lameduck.LameDuck() {
+		t.Error("LameDuckHandler() should not disable lame duck during shutdown")
+	}
+}
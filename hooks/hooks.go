@@ -0,0 +1,234 @@
+// Package hooks runs hooks when tests complete, e.g. to trigger path
+// diagnostics for slow results. A hook is either a command, which receives the
+// context of the test in its environment and on stdin, or a unix socket, which
+// receives it as a JSON message. Hooks run once for every test direction, in
+// the background, with a timeout and a limit on how many run at once.
+//
+// Hooks only see the client IP as archived, so hooks that probe the client,
+// e.g. with traceroute, do not work when client IPs are anonymized.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/index"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/sink"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	hookRuns = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_hook_runs_total",
+			Help: "Number of post-test hook runs, by hook and outcome.",
+		},
+		[]string{"hook", "result"},
+	)
+	hookDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ndt_hook_duration_seconds",
+			Help:    "How long post-test hooks run.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		},
+		[]string{"hook"},
+	)
+)
+
+// Event is the context of a completed test direction.
+type Event struct {
+	UUID      string
+	Protocol  string
+	Direction string
+	// ClientIP is anonymized like in the archival data, i.e. it is a netblock
+	// or a keyed hash, rather than the address of the client, when the
+	// -anonymize.ip or -anonymize.ip-key flags are set.
+	ClientIP           string
+	StartTime          time.Time
+	MeanThroughputMbps float64
+	Error              string `json:",omitempty"`
+	// ErrorClass is one of the index.ErrorClasses.
+	ErrorClass string
+	// LimitingFactor is what mostly limited a download, see
+	// index.Entry.LimitingFactor.
+	LimitingFactor string `json:",omitempty"`
+	// Path is the archival file of the result. It is empty when results are
+	// not written to the data directory.
+	Path string `json:",omitempty"`
+}
+
+// env returns the event as environment variables.
+func (e *Event) env() []string {
+	return []string{
+		"NDT_UUID=" + e.UUID,
+		"NDT_PROTOCOL=" + e.Protocol,
+		"NDT_DIRECTION=" + e.Direction,
+		"NDT_CLIENT_IP=" + e.ClientIP,
+		"NDT_START_TIME=" + e.StartTime.UTC().Format(time.RFC3339Nano),
+		"NDT_MEAN_THROUGHPUT_MBPS=" + strconv.FormatFloat(e.MeanThroughputMbps, 'f', -1, 64),
+		"NDT_ERROR_CLASS=" + e.ErrorClass,
+		"NDT_LIMITING_FACTOR=" + e.LimitingFactor,
+		"NDT_FILE=" + e.Path,
+	}
+}
+
+// Hook is implemented by every kind of hook.
+type Hook interface {
+	Run(ctx context.Context, e *Event) error
+}
+
+// Exec is a hook that runs a command. The command receives the event in
+// NDT_* environment variables, and as a JSON object on stdin. Its output goes
+// to the stderr of the server. The command is killed when the context expires.
+type Exec struct {
+	Command string
+	Args    []string
+}
+
+// Run runs the command for e and returns an error when it fails.
+func (x *Exec) Run(ctx context.Context, e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, x.Command, x.Args...)
+	cmd.Env = append(os.Environ(), e.env()...)
+	cmd.Stdin = bytes.NewReader(append(b, '\n'))
+	// Hooks that start background processes keep their output open, so the
+	// output must not be a pipe that Wait waits for.
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Socket is a hook that writes the event as a line of JSON to a new
+// connection to a unix socket.
+type Socket struct {
+	Path string
+}
+
+// Run sends e to the socket.
+func (s *Socket) Run(ctx context.Context, e *Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", s.Path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, err = conn.Write(append(b, '\n'))
+	return err
+}
+
+type namedHook struct {
+	name string
+	hook Hook
+}
+
+// Runner is a sink.ResultSink that runs its hooks for every test direction of
+// the results written to it. Write never waits for the hooks. When the maximum
+// number of hooks are already running, further runs are dropped.
+type Runner struct {
+	hooks   []namedHook
+	timeout time.Duration
+	slots   chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewRunner creates a Runner without hooks that gives every hook run the
+// timeout to complete, and runs at most maxConcurrent hooks at once.
+func NewRunner(timeout time.Duration, maxConcurrent int) *Runner {
+	return &Runner{
+		timeout: timeout,
+		slots:   make(chan struct{}, maxConcurrent),
+	}
+}
+
+// Add adds a hook to r. Add must not be called once results are being
+// written.
+func (r *Runner) Add(name string, h Hook) {
+	r.hooks = append(r.hooks, namedHook{name: name, hook: h})
+}
+
+// Len returns the number of hooks of r.
+func (r *Runner) Len() int {
+	return len(r.hooks)
+}
+
+// Write starts the hooks for every test direction of res.
+func (r *Runner) Write(res *sink.Result) error {
+	clientIP := ""
+	switch d := res.Data.(type) {
+	case *data.NDT5Result:
+		clientIP = d.ClientIP
+	case *data.NDT7Result:
+		clientIP = d.ClientIP
+	}
+	for _, entry := range index.Summarize(res) {
+		e := &Event{
+			UUID:               entry.UUID,
+			Protocol:           entry.Protocol,
+			Direction:          entry.Direction,
+			ClientIP:           clientIP,
+			StartTime:          entry.Time,
+			MeanThroughputMbps: entry.MeanThroughputMbps,
+			Error:              entry.Error,
+			ErrorClass:         entry.ErrorClass,
+			LimitingFactor:     entry.LimitingFactor,
+			Path:               res.Path,
+		}
+		for _, h := range r.hooks {
+			select {
+			case r.slots <- struct{}{}:
+			default:
+				hookRuns.WithLabelValues(h.name, "dropped").Inc()
+				continue
+			}
+			r.wg.Add(1)
+			go r.run(h, e)
+		}
+	}
+	return nil
+}
+
+func (r *Runner) run(h namedHook, e *Event) {
+	defer r.wg.Done()
+	defer func() { <-r.slots }()
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	start := time.Now()
+	err := h.hook.Run(ctx, e)
+	hookDuration.WithLabelValues(h.name).Observe(time.Since(start).Seconds())
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		hookRuns.WithLabelValues(h.name, "timeout").Inc()
+		logging.Logger.WithField("hook", h.name).WithField("uuid", e.UUID).Warn("hooks: hook timed out")
+	case err != nil:
+		hookRuns.WithLabelValues(h.name, "error").Inc()
+		logging.Logger.WithField("hook", h.name).WithField("uuid", e.UUID).WithError(err).Warn("hooks: hook failed")
+	default:
+		hookRuns.WithLabelValues(h.name, "ok").Inc()
+	}
+}
+
+// Close waits for the running hooks to complete.
+func (r *Runner) Close() error {
+	r.wg.Wait()
+	return nil
+}
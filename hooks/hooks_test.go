@@ -0,0 +1,148 @@
+package hooks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/sink"
+	"github.com/m-lab/ndt-server/sink/sinktest"
+)
+
+type fakeHook struct {
+	mu     sync.Mutex
+	events []*Event
+	err    error
+	block  bool
+}
+
+func (f *fakeHook) Run(ctx context.Context, e *Event) error {
+	f.mu.Lock()
+	f.events = append(f.events, e)
+	f.mu.Unlock()
+	if f.block {
+		<-ctx.Done()
+	}
+	return f.err
+}
+
+func TestRunner(t *testing.T) {
+	good := &fakeHook{}
+	bad := &fakeHook{err: errors.New("broken")}
+	r := NewRunner(time.Second, 10)
+	r.Add("good", good)
+	r.Add("bad", bad)
+	if r.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", r.Len())
+	}
+	res := sinktest.NDT5("ndt5-uuid", "192.0.2.1", sinktest.Start)
+	res.Path = "/var/spool/ndt/ndt5/2020/03/04/ndt5-uuid.json"
+	rtx.Must(r.Write(res), "Could not write result")
+	rtx.Must(r.Write(&sink.Result{Protocol: "ndt9"}), "Could not write unknown result")
+	rtx.Must(r.Close(), "Could not close")
+
+	if len(good.events) != 2 || len(bad.events) != 2 {
+		t.Fatalf("hooks ran %d and %d times, want once per direction", len(good.events), len(bad.events))
+	}
+	byDirection := map[string]*Event{}
+	for _, e := range good.events {
+		byDirection[e.Direction] = e
+	}
+	down := byDirection["download"]
+	if down == nil || down.UUID != "ndt5-uuid" || down.ClientIP != "192.0.2.1" ||
+		down.MeanThroughputMbps != 20 || down.ErrorClass != "timeout" || !strings.HasSuffix(down.Path, "ndt5-uuid.json") {
+		t.Errorf("download event = %+v", down)
+	}
+	if up := byDirection["upload"]; up == nil || up.MeanThroughputMbps != 5 || up.ErrorClass != "none" {
+		t.Errorf("upload event = %+v", up)
+	}
+}
+
+func TestRunner_limits(t *testing.T) {
+	slow := &fakeHook{block: true}
+	r := NewRunner(100*time.Millisecond, 1)
+	r.Add("slow", slow)
+	// Only one of the two directions may run, and it times out.
+	start := time.Now()
+	rtx.Must(r.Write(sinktest.NDT5("ndt5-uuid", "192.0.2.1", sinktest.Start)), "Could not write result")
+	if time.Since(start) > 50*time.Millisecond {
+		t.Error("Write() waited for the hooks")
+	}
+	rtx.Must(r.Close(), "Could not close")
+	if len(slow.events) != 1 {
+		t.Errorf("hook ran %d times, want 1", len(slow.events))
+	}
+}
+
+func TestExec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestExec")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	x := &Exec{Command: "/bin/sh", Args: []string{"-c", `echo "$NDT_UUID $NDT_DIRECTION $NDT_FILE" > ` + out + ` && cat >> ` + out}}
+	e := &Event{UUID: "abc", Direction: "download", Path: "/file"}
+	rtx.Must(x.Run(context.Background(), e), "Could not run command")
+	b, err := ioutil.ReadFile(out)
+	rtx.Must(err, "Could not read output")
+	lines := strings.SplitN(string(b), "\n", 2)
+	if lines[0] != "abc download /file" {
+		t.Errorf("environment = %q, want the event", lines[0])
+	}
+	var got Event
+	rtx.Must(json.Unmarshal([]byte(lines[1]), &got), "Could not parse stdin %q", lines[1])
+	if got.UUID != "abc" {
+		t.Errorf("stdin UUID = %q, want abc", got.UUID)
+	}
+
+	if err := (&Exec{Command: "/bin/false"}).Run(context.Background(), e); err == nil {
+		t.Error("Run() of a failing command should fail")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := (&Exec{Command: "/bin/sleep", Args: []string{"10"}}).Run(ctx, e); err == nil {
+		t.Error("Run() should fail when the command times out")
+	}
+}
+
+func TestSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSocket")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hooks.sock")
+
+	s := &Socket{Path: path}
+	if err := s.Run(context.Background(), &Event{UUID: "lost"}); err == nil {
+		t.Error("Run() without a listener should fail")
+	}
+
+	l, err := net.Listen("unix", path)
+	rtx.Must(err, "Could not listen")
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- line
+	}()
+	rtx.Must(s.Run(context.Background(), &Event{UUID: "abc"}), "Could not send event")
+	var got Event
+	rtx.Must(json.Unmarshal([]byte(<-received), &got), "Could not parse message")
+	if got.UUID != "abc" {
+		t.Errorf("UUID = %q, want abc", got.UUID)
+	}
+}
@@ -0,0 +1,92 @@
+package index
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/m-lab/ndt-server/lameduck"
+	"github.com/m-lab/ndt-server/summary"
+)
+
+// Entry summarizes the result of one test direction.
+type Entry struct {
+	UUID string
+	// Time is the start time of the test.
+	Time time.Time
+	// ClientPrefix is the network of the client, e.g. 192.0.2.0/24, or the
+	// anonymized client IP when it is not an address.
+	ClientPrefix string
+	Protocol     string
+	// Direction is "download" or "upload". It is empty for ndt5 tests that
+	// did not run any subtest.
+	Direction          string
+	MeanThroughputMbps float64
+	Error              string `json:",omitempty"`
+	// ErrorClass is one of the ErrorClasses.
+	ErrorClass string
+	// LimitingFactor is what mostly limited a download, one of the
+	// tcpinfox.Limit constants. It is empty for uploads.
+	LimitingFactor string `json:",omitempty"`
+}
+
+// key identifies the test direction of an Entry.
+func (e *Entry) key() string {
+	return e.Protocol + "/" + e.Direction + "/" + e.UUID
+}
+
+// ErrorClasses are the classes of errors, from the most to the least specific.
+var ErrorClasses = []string{"none", "shutdown", "timeout", "reset", "closed", "other"}
+
+// classify returns the class of the error message msg.
+func classify(msg string) string {
+	msg = strings.ToLower(msg)
+	switch {
+	case msg == "":
+		return "none"
+	case msg == lameduck.ErrShutdown.Error():
+		return "shutdown"
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "deadline exceeded"):
+		return "timeout"
+	case strings.Contains(msg, "reset by peer"), strings.Contains(msg, "broken pipe"):
+		return "reset"
+	case strings.Contains(msg, "close"), strings.Contains(msg, "eof"):
+		return "closed"
+	}
+	return "other"
+}
+
+// clientPrefix returns the /24 network of an IPv4 client and the /48 network
+// of an IPv6 client.
+func clientPrefix(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if v4 := addr.To4(); v4 != nil {
+		n := net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+		return n.String()
+	}
+	n := net.IPNet{IP: addr.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}
+	return n.String()
+}
+
+// entries converts the summaries of the test directions of a result to
+// entries.
+func entries(tests []summary.Test) []Entry {
+	entries := make([]Entry, len(tests))
+	for i, t := range tests {
+		entries[i] = Entry{
+			UUID:               t.UUID,
+			Time:               t.StartTime,
+			ClientPrefix:       clientPrefix(t.ClientIP),
+			Protocol:           t.Protocol,
+			Direction:          t.Direction,
+			MeanThroughputMbps: t.ThroughputMbps,
+			Error:              t.Error,
+			ErrorClass:         classify(t.Error),
+			LimitingFactor:     t.LimitingFactor,
+		}
+	}
+	return entries
+}
@@ -0,0 +1,114 @@
+package index
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/m-lab/ndt-server/logging"
+)
+
+const (
+	defaultLimit = 100
+	maxLimit     = 10000
+)
+
+// SearchHandler serves GET requests that search the index. The parameters
+// are "uuid", "from" and "to" as RFC3339 times, "client", "protocol", "error"
+// for the error class and "limit". The response is a JSON array of entries,
+// newest first.
+func (ix *Index) SearchHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		// 405 - https://tools.ietf.org/html/rfc7231#section-6.5.5
+		rw.Header().Set("Allow", http.MethodGet)
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseQuery(req)
+	if err != nil {
+		// 400 - https://tools.ietf.org/html/rfc7231#section-6.5.1
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := ix.Search(q)
+	if err != nil {
+		logging.Logger.WithError(err).Warn("index: search failed")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []Entry{}
+	}
+	writeJSON(rw, http.StatusOK, entries)
+}
+
+func parseQuery(req *http.Request) (Query, error) {
+	v := req.URL.Query()
+	q := Query{
+		UUID:       v.Get("uuid"),
+		Client:     v.Get("client"),
+		Protocol:   v.Get("protocol"),
+		ErrorClass: v.Get("error"),
+		Limit:      defaultLimit,
+	}
+	var err error
+	if s := v.Get("from"); s != "" {
+		if q.From, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, err
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		if q.To, err = time.Parse(time.RFC3339, s); err != nil {
+			return q, err
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil {
+			return q, err
+		}
+		if q.Limit <= 0 || q.Limit > maxLimit {
+			q.Limit = maxLimit
+		}
+	}
+	return q, nil
+}
+
+// rebuildStatus is the JSON document returned by the rebuild endpoint.
+type rebuildStatus struct {
+	Entries int
+}
+
+// RebuildHandler serves POST requests that rebuild the index, and responds
+// once the index is rebuilt.
+func (ix *Index) RebuildHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	logging.Logger.Infof("index: rebuilding from %s", req.RemoteAddr)
+	n, err := ix.Rebuild()
+	switch {
+	case err == ErrRebuilding:
+		// 409 - https://tools.ietf.org/html/rfc7231#section-6.5.8
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		logging.Logger.WithError(err).Warn("index: rebuild failed")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(rw, http.StatusOK, &rebuildStatus{Entries: n})
+}
+
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	rw.Write(b)
+}
@@ -0,0 +1,365 @@
+// Package index keeps a searchable summary of all results in the data
+// directory, so that the result of a single test can be found without reading
+// every result file. The Index is a result sink that appends one line of JSON
+// per test direction to a file in the data directory. The file is append-only
+// while the server runs, and can be rebuilt by scanning the existing results,
+// e.g. after results were written by an older server.
+package index
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/sink"
+	"github.com/m-lab/ndt-server/summary"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// Dir is the directory, relative to the data directory, that holds the
+	// index. It is hidden, so that uploaders and the janitor ignore it.
+	Dir = ".index"
+
+	fileName = "results.ndjson"
+)
+
+var (
+	// ErrRebuilding is returned by Rebuild while another rebuild is running.
+	ErrRebuilding = errors.New("index is being rebuilt")
+
+	rebuilds = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_results_index_rebuilds_total",
+			Help: "Number of rebuilds of the results index, by outcome.",
+		},
+		[]string{"result"},
+	)
+	rebuildFiles = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_results_index_rebuild_files_total",
+			Help: "Number of result files scanned while rebuilding the results index, by outcome.",
+		},
+		[]string{"result"},
+	)
+)
+
+// Index is the index of the results in a data directory. Index implements
+// sink.ResultSink.
+type Index struct {
+	datadir string
+	path    string
+
+	mu sync.Mutex
+	fp *os.File
+	// pending collects the entries written while a rebuild is running.
+	pending    []Entry
+	rebuilding bool
+}
+
+// Open opens the index of the results in datadir, and creates an empty index
+// if there is none.
+func Open(datadir string) (*Index, error) {
+	dir := filepath.Join(datadir, Dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ix := &Index{datadir: datadir, path: filepath.Join(dir, fileName)}
+	fp, err := ix.open()
+	if err != nil {
+		return nil, err
+	}
+	ix.fp = fp
+	return ix, nil
+}
+
+func (ix *Index) open() (*os.File, error) {
+	return os.OpenFile(ix.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// Empty returns whether the index has no entries.
+func (ix *Index) Empty() bool {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	info, err := ix.fp.Stat()
+	return err == nil && info.Size() == 0
+}
+
+// Summarize returns one Entry for each test direction of r, or nil when r is
+// neither an ndt5 nor an ndt7 result.
+func Summarize(r *sink.Result) []Entry {
+	switch d := r.Data.(type) {
+	case *data.NDT5Result:
+		return entries(summary.NDT5(d))
+	case *data.NDT7Result:
+		return entries(summary.NDT7(d))
+	}
+	return nil
+}
+
+// Write adds the entries that summarize r to the index.
+func (ix *Index) Write(r *sink.Result) error {
+	entries := Summarize(r)
+	if len(entries) == 0 {
+		return nil
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.rebuilding {
+		ix.pending = append(ix.pending, entries...)
+	}
+	return appendEntries(ix.fp, entries)
+}
+
+// appendEntries writes entries to w with a single write, so that readers never
+// see a partial line.
+func appendEntries(w io.Writer, entries []Entry) error {
+	var b []byte
+	for i := range entries {
+		line, err := json.Marshal(&entries[i])
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// Close closes the index file.
+func (ix *Index) Close() error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.fp.Close()
+}
+
+// Query selects entries of the index. Zero values match all entries.
+type Query struct {
+	UUID string
+	// From and To limit the start time of the tests to [From, To).
+	From, To time.Time
+	// Client selects the clients by network, e.g. 192.0.2.0/24, by address,
+	// or by their anonymized IP.
+	Client     string
+	Protocol   string
+	ErrorClass string
+	// Limit is the maximum number of entries to return.
+	Limit int
+}
+
+func (q *Query) match(e *Entry, client func(string) bool) bool {
+	return (q.UUID == "" || e.UUID == q.UUID) &&
+		(q.From.IsZero() || !e.Time.Before(q.From)) &&
+		(q.To.IsZero() || e.Time.Before(q.To)) &&
+		(q.Client == "" || client(e.ClientPrefix)) &&
+		(q.Protocol == "" || e.Protocol == q.Protocol) &&
+		(q.ErrorClass == "" || e.ErrorClass == q.ErrorClass)
+}
+
+// Search returns the most recently written entries that match q, newest first.
+func (ix *Index) Search(q Query) ([]Entry, error) {
+	fp, err := os.Open(ix.path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	client := matchClient(q.Client)
+	// Keep the last Limit matches in a ring.
+	var ring []Entry
+	next := 0
+	s := bufio.NewScanner(fp)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		var e Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil || !q.match(&e, client) {
+			continue
+		}
+		if q.Limit <= 0 || len(ring) < q.Limit {
+			ring = append(ring, e)
+			continue
+		}
+		ring[next] = e
+		next = (next + 1) % q.Limit
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(ring))
+	for i := len(ring) - 1; i >= 0; i-- {
+		entries = append(entries, ring[(next+i)%len(ring)])
+	}
+	return entries, nil
+}
+
+// matchClient returns a function that tells whether a client prefix of an
+// Entry matches the Client of a Query.
+func matchClient(client string) func(string) bool {
+	if _, n, err := net.ParseCIDR(client); err == nil {
+		return func(prefix string) bool {
+			ip, _, err := net.ParseCIDR(prefix)
+			return err == nil && n.Contains(ip)
+		}
+	}
+	if ip := net.ParseIP(client); ip != nil {
+		return func(prefix string) bool {
+			_, n, err := net.ParseCIDR(prefix)
+			return err == nil && n.Contains(ip)
+		}
+	}
+	return func(prefix string) bool {
+		return prefix == client
+	}
+}
+
+// Rebuild replaces the index with the summaries of all result files in the
+// data directory, and returns the number of entries. Results written while
+// Rebuild runs are kept in the new index.
+func (ix *Index) Rebuild() (int, error) {
+	ix.mu.Lock()
+	if ix.rebuilding {
+		ix.mu.Unlock()
+		return 0, ErrRebuilding
+	}
+	ix.rebuilding = true
+	ix.pending = nil
+	ix.mu.Unlock()
+
+	n, err := ix.rebuild()
+	if err != nil {
+		rebuilds.WithLabelValues("error").Inc()
+	} else {
+		rebuilds.WithLabelValues("ok").Inc()
+	}
+	return n, err
+}
+
+func (ix *Index) rebuild() (int, error) {
+	defer func() {
+		ix.mu.Lock()
+		ix.rebuilding = false
+		ix.pending = nil
+		ix.mu.Unlock()
+	}()
+	entries, err := scan(ix.datadir)
+	if err != nil {
+		return 0, err
+	}
+	sort.SliceStable(entries, func(i, k int) bool {
+		return entries[i].Time.Before(entries[k].Time)
+	})
+	tmp, err := os.Create(ix.path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if err := appendEntries(tmp, entries); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	// Results written during the scan may or may not have been found by it.
+	scanned := make(map[string]bool, len(entries))
+	for i := range entries {
+		scanned[entries[i].key()] = true
+	}
+	var missing []Entry
+	for _, e := range ix.pending {
+		if !scanned[e.key()] {
+			missing = append(missing, e)
+		}
+	}
+	if err := appendEntries(tmp, missing); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), ix.path); err != nil {
+		return 0, err
+	}
+	fp, err := ix.open()
+	if err != nil {
+		return 0, err
+	}
+	ix.fp.Close()
+	ix.fp = fp
+	return len(entries) + len(missing), nil
+}
+
+// scan returns the entries for all result files in datadir.
+func scan(datadir string) ([]Entry, error) {
+	var entries []Entry
+	for _, protocol := range []string{"ndt5", "ndt7"} {
+		root := filepath.Join(datadir, protocol)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || !strings.HasSuffix(path, ".json") && !strings.HasSuffix(path, ".json.gz") {
+				return nil
+			}
+			e, err := readEntries(path, protocol)
+			if err != nil {
+				rebuildFiles.WithLabelValues("error").Inc()
+				logging.Logger.WithError(err).WithField("file", path).Warn("index: could not read result file")
+				return nil
+			}
+			rebuildFiles.WithLabelValues("ok").Inc()
+			entries = append(entries, e...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// readEntries returns the entries for the result file at path.
+func readEntries(path, protocol string) ([]Entry, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var r io.Reader = fp
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(fp)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	dec := json.NewDecoder(r)
+	if protocol == "ndt5" {
+		var result data.NDT5Result
+		if err := dec.Decode(&result); err != nil {
+			return nil, err
+		}
+		return entries(summary.NDT5(&result)), nil
+	}
+	var result data.NDT7Result
+	if err := dec.Decode(&result); err != nil {
+		return nil, err
+	}
+	return entries(summary.NDT7(&result)), nil
+}
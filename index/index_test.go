@@ -0,0 +1,150 @@
+package index
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/sink"
+	"github.com/m-lab/ndt-server/sink/sinktest"
+	"github.com/m-lab/ndt-server/tcpinfox"
+)
+
+func uuids(entries []Entry) string {
+	var s []string
+	for _, e := range entries {
+		s = append(s, e.UUID+"/"+e.Direction)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestIndex")
+	rtx.Must(err, "could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	ix, err := Open(dir)
+	rtx.Must(err, "could not open index")
+	defer ix.Close()
+	if !ix.Empty() {
+		t.Errorf("Empty() = false for a new index")
+	}
+	rtx.Must(ix.Write(sinktest.NDT7("a", "192.0.2.1", sinktest.Start, 1250000)), "could not write")
+	rtx.Must(ix.Write(sinktest.NDT5("b", "2001:db8::1", sinktest.Start.Add(time.Hour))), "could not write")
+	c := sinktest.NDT7("c", "192.0.2.200", sinktest.Start.Add(2*time.Hour), 1250000)
+	c.Data.(*data.NDT7Result).Download.Error = "websocket: close 1006 (abnormal closure)"
+	rtx.Must(ix.Write(c), "could not write")
+
+	tests := []struct {
+		name string
+		q    Query
+		want string
+	}{
+		{name: "all", q: Query{}, want: "c/download,b/upload,b/download,a/download"},
+		{name: "limit", q: Query{Limit: 2}, want: "c/download,b/upload"},
+		{name: "uuid", q: Query{UUID: "a"}, want: "a/download"},
+		{name: "time", q: Query{From: sinktest.Start.Add(time.Hour), To: sinktest.Start.Add(2 * time.Hour)}, want: "b/upload,b/download"},
+		{name: "network", q: Query{Client: "192.0.2.0/24"}, want: "c/download,a/download"},
+		{name: "address", q: Query{Client: "2001:db8::2"}, want: "b/upload,b/download"},
+		{name: "protocol", q: Query{Protocol: "ndt5"}, want: "b/upload,b/download"},
+		{name: "timeout", q: Query{ErrorClass: "timeout"}, want: "b/download"},
+		{name: "closed", q: Query{ErrorClass: "closed"}, want: "c/download"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := ix.Search(tt.q)
+			rtx.Must(err, "Search failed")
+			if got := uuids(entries); got != tt.want {
+				t.Errorf("Search() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	entries, err := ix.Search(Query{UUID: "a"})
+	rtx.Must(err, "Search failed")
+	if len(entries) != 1 || entries[0].MeanThroughputMbps != 10 || entries[0].ClientPrefix != "192.0.2.0/24" ||
+		entries[0].LimitingFactor != tcpinfox.LimitCongestion {
+		t.Errorf("Search() = %+v, want 10 Mbps from 192.0.2.0/24 limited by congestion", entries)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRebuild")
+	rtx.Must(err, "could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	files := sink.NewFile(dir, sink.NDT5Legacy)
+	rtx.Must(files.Write(sinktest.NDT7("a", "192.0.2.1", sinktest.Start, 1250000)), "could not write file")
+	rtx.Must(files.Write(sinktest.NDT5("b", "192.0.2.2", sinktest.Start.Add(time.Hour))), "could not write file")
+	rtx.Must(ioutil.WriteFile(dir+"/ndt7/broken.json.gz", []byte("garbage"), 0644), "could not write file")
+
+	ix, err := Open(dir)
+	rtx.Must(err, "could not open index")
+	defer ix.Close()
+	rtx.Must(ix.Write(sinktest.NDT7("c", "192.0.2.3", sinktest.Start.Add(2*time.Hour), 1250000)), "could not write")
+	n, err := ix.Rebuild()
+	rtx.Must(err, "Rebuild failed")
+	if n != 3 {
+		t.Errorf("Rebuild() = %d, want 3", n)
+	}
+	// The rebuilt index only contains the results in files.
+	entries, err := ix.Search(Query{})
+	rtx.Must(err, "Search failed")
+	if got := uuids(entries); got != "b/upload,b/download,a/download" {
+		t.Errorf("Search() after Rebuild = %s", got)
+	}
+	// New results are appended to the rebuilt index.
+	rtx.Must(ix.Write(sinktest.NDT7("d", "192.0.2.4", sinktest.Start.Add(3*time.Hour), 1250000)), "could not write")
+	entries, err = ix.Search(Query{Limit: 1})
+	rtx.Must(err, "Search failed")
+	if got := uuids(entries); got != "d/download" {
+		t.Errorf("Search() after Write = %s", got)
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSearchHandler")
+	rtx.Must(err, "could not create tempdir")
+	defer os.RemoveAll(dir)
+	ix, err := Open(dir)
+	rtx.Must(err, "could not open index")
+	defer ix.Close()
+	rtx.Must(ix.Write(sinktest.NDT7("a", "192.0.2.1", sinktest.Start, 1250000)), "could not write")
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		code   int
+		want   string
+	}{
+		{name: "match", method: http.MethodGet, target: "/results/search?uuid=a&from=2020-03-04T00:00:00Z", code: http.StatusOK, want: `"UUID":"a"`},
+		{name: "empty", method: http.MethodGet, target: "/results/search?uuid=b", code: http.StatusOK, want: "[]"},
+		{name: "bad-time", method: http.MethodGet, target: "/results/search?from=yesterday", code: http.StatusBadRequest},
+		{name: "bad-method", method: http.MethodPost, target: "/results/search", code: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			ix.SearchHandler(rw, httptest.NewRequest(tt.method, tt.target, nil))
+			if rw.Code != tt.code {
+				t.Fatalf("SearchHandler() = %d, want %d", rw.Code, tt.code)
+			}
+			if !strings.Contains(rw.Body.String(), tt.want) {
+				t.Errorf("SearchHandler() body = %s, want %s", rw.Body.String(), tt.want)
+			}
+		})
+	}
+
+	rw := httptest.NewRecorder()
+	ix.RebuildHandler(rw, httptest.NewRequest(http.MethodPost, "/results/rebuild", nil))
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"Entries":0`) {
+		t.Errorf("RebuildHandler() = %d %s, want an empty index", rw.Code, rw.Body.String())
+	}
+}
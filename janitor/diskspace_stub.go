@@ -0,0 +1,7 @@
+// +build !linux
+
+package janitor
+
+func diskSpace(dir string) (total, avail uint64, err error) {
+	return 0, 0, ErrNoSupport
+}
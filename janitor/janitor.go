@@ -0,0 +1,317 @@
+// Package janitor keeps the data directory from filling the disk on servers
+// without an uploader. A Janitor periodically removes, or moves to an archive
+// directory, the oldest day directories of results once they exceed the
+// configured maximum age or total size. When the free space on the disk falls
+// below a critical threshold anyway, new tests are refused until space is
+// available again, because their results could not be saved.
+package janitor
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrDiskFull is returned by Admit when the free space on the disk of the
+	// data directory is below the configured minimum.
+	ErrDiskFull = errors.New("not enough free disk space for results")
+
+	// ErrNoSupport is returned on systems where the free disk space cannot be
+	// determined.
+	ErrNoSupport = errors.New("free disk space not supported")
+
+	resultBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ndt_datadir_result_bytes",
+			Help: "Total size of the result files in the data directory, by data type.",
+		},
+		[]string{"datatype"},
+	)
+	filesystemBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ndt_datadir_filesystem_bytes",
+			Help: "Size of the filesystem holding the data directory, and the space available to the server.",
+		},
+		[]string{"state"},
+	)
+	diskFull = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ndt_datadir_disk_full",
+			Help: "Indicates when new tests are refused because the disk is critically full.",
+		},
+	)
+	removedDays = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_janitor_removed_days_total",
+			Help: "Number of day directories removed from the data directory, by reason and action.",
+		},
+		[]string{"reason", "action"},
+	)
+	janitorRuns = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_janitor_runs_total",
+			Help: "Number of janitor runs, by outcome.",
+		},
+		[]string{"result"},
+	)
+
+	mu             sync.RWMutex
+	defaultJanitor *Janitor
+)
+
+// Config contains the retention limits enforced by a Janitor. A zero value
+// disables the corresponding limit.
+type Config struct {
+	// MaxAge is how long results are kept.
+	MaxAge time.Duration
+	// MaxBytes is the maximum total size of the results.
+	MaxBytes int64
+	// MinFreeBytes is the free disk space below which new tests are refused.
+	MinFreeBytes int64
+	// ArchiveDir, when not empty, is where removed day directories are moved
+	// instead of being deleted. It must be on the same filesystem as the data
+	// directory.
+	ArchiveDir string
+}
+
+// Janitor enforces a Config on a data directory.
+type Janitor struct {
+	datadir string
+	config  Config
+
+	mu   sync.Mutex
+	full bool
+}
+
+// day is a directory with the results of one data type for one day, e.g.
+// <datadir>/ndt7/2020/03/04.
+type day struct {
+	datatype string
+	rel      string
+	date     time.Time
+	size     int64
+}
+
+// New creates a Janitor for datadir.
+func New(datadir string, config Config) *Janitor {
+	return &Janitor{datadir: datadir, config: config}
+}
+
+// Run cleans up the data directory immediately and then every interval, until
+// ctx is canceled.
+func (j *Janitor) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := j.Clean(time.Now()); err != nil {
+			logging.Logger.WithError(err).Warn("janitor: could not clean up the data directory")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Clean removes the day directories that exceed the configured limits, as of
+// now, and updates whether new tests are refused. The directories for the
+// current and the previous day are never removed, because tests may still be
+// writing to them.
+func (j *Janitor) Clean(now time.Time) error {
+	err := j.clean(now)
+	if err != nil {
+		janitorRuns.WithLabelValues("error").Inc()
+	} else {
+		janitorRuns.WithLabelValues("ok").Inc()
+	}
+	j.checkFree()
+	return err
+}
+
+func (j *Janitor) clean(now time.Time) error {
+	days, err := j.days()
+	if err != nil {
+		return err
+	}
+	sizes := make(map[string]int64)
+	var total int64
+	for _, d := range days {
+		sizes[d.datatype] += d.size
+		total += d.size
+	}
+	// Days are sorted oldest first, so removing from the front removes the
+	// oldest results of all data types first.
+	protected := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	for _, d := range days {
+		if !d.date.Before(protected) {
+			break
+		}
+		reason := ""
+		switch {
+		case j.config.MaxAge > 0 && d.date.AddDate(0, 0, 1).Before(now.Add(-j.config.MaxAge)):
+			reason = "age"
+		case j.config.MaxBytes > 0 && total > j.config.MaxBytes:
+			reason = "quota"
+		default:
+			continue
+		}
+		action, err := j.remove(d)
+		if err != nil {
+			return err
+		}
+		removedDays.WithLabelValues(reason, action).Inc()
+		logging.Logger.WithField("dir", d.rel).Infof("janitor: %s day directory, %s limit exceeded", action, reason)
+		sizes[d.datatype] -= d.size
+		total -= d.size
+	}
+	for datatype, size := range sizes {
+		resultBytes.WithLabelValues(datatype).Set(float64(size))
+	}
+	return nil
+}
+
+// days returns all day directories in the data directory, oldest first.
+func (j *Janitor) days() ([]day, error) {
+	entries, err := ioutil.ReadDir(j.datadir)
+	if err != nil {
+		return nil, err
+	}
+	var days []day
+	for _, e := range entries {
+		// Hidden directories hold temporary and quarantined files.
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		dirs, err := filepath.Glob(filepath.Join(j.datadir, e.Name(), "[0-9][0-9][0-9][0-9]", "[0-9][0-9]", "[0-9][0-9]"))
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			rel, err := filepath.Rel(j.datadir, dir)
+			if err != nil {
+				return nil, err
+			}
+			date, err := time.Parse("2006/01/02", filepath.ToSlash(strings.TrimPrefix(rel, e.Name()+string(filepath.Separator))))
+			if err != nil {
+				continue
+			}
+			size, err := dirSize(dir)
+			if err != nil {
+				return nil, err
+			}
+			days = append(days, day{datatype: e.Name(), rel: rel, date: date, size: size})
+		}
+	}
+	sort.SliceStable(days, func(i, k int) bool {
+		return days[i].date.Before(days[k].date)
+	})
+	return days, nil
+}
+
+// remove deletes or archives d, and removes its parent directories once they
+// are empty. It returns the action taken.
+func (j *Janitor) remove(d day) (string, error) {
+	dir := filepath.Join(j.datadir, d.rel)
+	action := "deleted"
+	if j.config.ArchiveDir != "" {
+		dst := filepath.Join(j.config.ArchiveDir, d.rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return "", err
+		}
+		if err := os.Rename(dir, dst); err != nil {
+			return "", err
+		}
+		action = "archived"
+	} else if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	// Remove the month and year directories, which fails once they contain
+	// other days.
+	parent := filepath.Dir(dir)
+	for i := 0; i < 2 && os.Remove(parent) == nil; i++ {
+		parent = filepath.Dir(parent)
+	}
+	return action, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// checkFree updates the filesystem metrics and whether the disk is full.
+func (j *Janitor) checkFree() {
+	total, avail, err := diskSpace(j.datadir)
+	full := false
+	if err == nil {
+		filesystemBytes.WithLabelValues("size").Set(float64(total))
+		filesystemBytes.WithLabelValues("available").Set(float64(avail))
+		full = j.config.MinFreeBytes > 0 && avail < uint64(j.config.MinFreeBytes)
+	} else if err != ErrNoSupport {
+		logging.Logger.WithError(err).Warn("janitor: could not determine free disk space")
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if full != j.full {
+		if full {
+			logging.Logger.WithField("available", avail).Warn("janitor: disk almost full, refusing new tests")
+		} else {
+			logging.Logger.Info("janitor: enough disk space available, accepting new tests")
+		}
+	}
+	j.full = full
+	if full {
+		diskFull.Set(1)
+	} else {
+		diskFull.Set(0)
+	}
+}
+
+// Admit returns ErrDiskFull when new tests should be refused. It is safe to
+// call Admit on a nil Janitor, which admits all tests.
+func (j *Janitor) Admit() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.full {
+		return ErrDiskFull
+	}
+	return nil
+}
+
+// SetDefault sets the Janitor consulted by the package-level Admit function.
+func SetDefault(j *Janitor) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultJanitor = j
+}
+
+// Admit returns ErrDiskFull when the default Janitor refuses new tests.
+func Admit() error {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultJanitor.Admit()
+}
@@ -0,0 +1,145 @@
+package janitor
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+)
+
+// setup creates a data directory with 100 bytes of results per day directory.
+func setup(t *testing.T, days ...string) string {
+	dir, err := ioutil.TempDir("", "TestJanitor")
+	rtx.Must(err, "Could not create tempdir")
+	for _, d := range days {
+		rtx.Must(os.MkdirAll(filepath.Join(dir, d), 0755), "Could not create day directory")
+		rtx.Must(ioutil.WriteFile(filepath.Join(dir, d, "result.json"), make([]byte, 100), 0644), "Could not write result")
+	}
+	// Temporary files and other directories are not touched.
+	rtx.Must(os.MkdirAll(filepath.Join(dir, ".tmp/2019/01/01"), 0755), "Could not create hidden directory")
+	rtx.Must(os.MkdirAll(filepath.Join(dir, "webhook-spool"), 0755), "Could not create spool directory")
+	return dir
+}
+
+// remaining returns the day directories left in dir.
+func remaining(dir string) []string {
+	m, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*", "*"))
+	var days []string
+	for _, d := range m {
+		rel, _ := filepath.Rel(dir, d)
+		days = append(days, filepath.ToSlash(rel))
+	}
+	sort.Strings(days)
+	return days
+}
+
+func TestJanitor_Clean(t *testing.T) {
+	now := time.Date(2020, 3, 10, 12, 0, 0, 0, time.UTC)
+	all := []string{"ndt5/2020/03/01", "ndt7/2020/03/02", "ndt7/2020/03/08", "ndt7/2020/03/09", "ndt5/2020/03/10"}
+	tests := []struct {
+		name     string
+		config   Config
+		want     []string
+		archived []string
+	}{
+		{
+			name: "unlimited",
+			want: all,
+		},
+		{
+			name:   "max-age",
+			config: Config{MaxAge: 72 * time.Hour},
+			want:   all[2:],
+		},
+		{
+			name:   "max-bytes",
+			config: Config{MaxBytes: 350},
+			want:   all[2:],
+		},
+		{
+			name:   "recent-days-are-kept",
+			config: Config{MaxBytes: 1},
+			want:   all[3:],
+		},
+		{
+			name:     "archive",
+			config:   Config{MaxAge: time.Hour},
+			want:     all[3:],
+			archived: all[:3],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := setup(t, all...)
+			defer os.RemoveAll(dir)
+			if tt.archived != nil {
+				tt.config.ArchiveDir = dir + "-archive"
+				defer os.RemoveAll(tt.config.ArchiveDir)
+			}
+			j := New(dir, tt.config)
+			rtx.Must(j.Clean(now), "Could not clean")
+			got := remaining(dir)
+			if !equal(got, append(tt.want, ".tmp/2019/01/01")) {
+				t.Errorf("remaining days = %v, want %v", got, tt.want)
+			}
+			if tt.archived != nil {
+				if got := remaining(tt.config.ArchiveDir); !equal(got, tt.archived) {
+					t.Errorf("archived days = %v, want %v", got, tt.archived)
+				}
+			}
+			// Empty month and year directories are removed too.
+			if tt.name == "max-age" {
+				if _, err := os.Stat(filepath.Join(dir, "ndt5/2020")); err != nil {
+					t.Errorf("year directory with remaining days was removed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func equal(a, b []string) bool {
+	sort.Strings(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestJanitor_Admit(t *testing.T) {
+	var nilJanitor *Janitor
+	if err := nilJanitor.Admit(); err != nil {
+		t.Errorf("nil Admit() = %v, want nil", err)
+	}
+	dir := setup(t)
+	defer os.RemoveAll(dir)
+
+	j := New(dir, Config{MinFreeBytes: 1})
+	rtx.Must(j.Clean(time.Now()), "Could not clean")
+	if err := j.Admit(); err != nil {
+		t.Errorf("Admit() = %v, want nil", err)
+	}
+	if runtime.GOOS != "linux" {
+		t.Skip("free disk space is only supported on linux")
+	}
+	j = New(dir, Config{MinFreeBytes: math.MaxInt64})
+	rtx.Must(j.Clean(time.Now()), "Could not clean")
+	if err := j.Admit(); err != ErrDiskFull {
+		t.Errorf("Admit() = %v, want %v", err, ErrDiskFull)
+	}
+	SetDefault(j)
+	defer SetDefault(nil)
+	if err := Admit(); err != ErrDiskFull {
+		t.Errorf("package Admit() = %v, want %v", err, ErrDiskFull)
+	}
+}
@@ -0,0 +1,253 @@
+// Package lameduck tracks the measurements running on the server so that the
+// server can stop accepting new tests while the running ones complete. A server
+// in lame duck mode refuses new tests. On shutdown, running tests are given
+// until a deadline to complete, after which they are interrupted so that their
+// archival data is saved before the process exits.
+package lameduck
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrLameDuck is returned by Begin when the server is in lame duck mode.
+	ErrLameDuck = errors.New("server is in lame duck mode")
+	// ErrShutdown is reported by Test.Err for tests interrupted because the
+	// shutdown deadline expired before they completed.
+	ErrShutdown = errors.New("test interrupted by server shutdown")
+
+	// ErrShuttingDown is returned by SetLameDuck when lame duck mode is
+	// disabled after Shutdown has started.
+	ErrShuttingDown = errors.New("server is shutting down")
+
+	// FlushTimeout is how long Shutdown waits for interrupted tests to save
+	// their results before giving up on them.
+	FlushTimeout = 10 * time.Second
+
+	// A metric to use to signal that the server is in lame duck mode.
+	lameDuck = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "lame_duck_experiment",
+		Help: "Indicates when the server is in lame duck",
+	})
+	interruptedTests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ndt_shutdown_interrupted_tests_total",
+		Help: "Number of tests interrupted because the shutdown deadline expired.",
+	})
+
+	mu             sync.RWMutex
+	defaultDrainer = New()
+)
+
+// Drainer keeps track of running tests and of the lame duck status.
+type Drainer struct {
+	mu       sync.Mutex
+	lameDuck bool
+	// shutdown is set once Shutdown has started, after which lame duck mode
+	// cannot be disabled.
+	shutdown bool
+	tests    map[*Test]struct{}
+	idle     chan struct{}
+}
+
+// Test represents a single running measurement registered with a Drainer.
+type Test struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	drainer     *Drainer
+	once        sync.Once
+	interrupted int32
+}
+
+// New creates a new Drainer that is not in lame duck mode.
+func New() *Drainer {
+	idle := make(chan struct{})
+	close(idle)
+	return &Drainer{
+		tests: make(map[*Test]struct{}),
+		idle:  idle,
+	}
+}
+
+// SetLameDuck enables or disables lame duck mode. It returns ErrShuttingDown,
+// and leaves lame duck mode enabled, when disabling it after Shutdown has
+// started.
+func (d *Drainer) SetLameDuck(enabled bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.shutdown && !enabled {
+		return ErrShuttingDown
+	}
+	d.lameDuck = enabled
+	return nil
+}
+
+// LameDuck reports whether lame duck mode is enabled.
+func (d *Drainer) LameDuck() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lameDuck
+}
+
+// Active returns the number of tests currently running.
+func (d *Drainer) Active() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.tests)
+}
+
+// Begin registers a new test derived from parent. Begin returns ErrLameDuck if
+// the server is in lame duck mode, in which case the test should be refused.
+// Callers must call Test.Done once the test has completed and its results have
+// been saved.
+func (d *Drainer) Begin(parent context.Context) (*Test, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.lameDuck {
+		return nil, ErrLameDuck
+	}
+	ctx, cancel := context.WithCancel(parent)
+	t := &Test{
+		ctx:     ctx,
+		cancel:  cancel,
+		drainer: d,
+	}
+	if len(d.tests) == 0 {
+		d.idle = make(chan struct{})
+	}
+	d.tests[t] = struct{}{}
+	return t, nil
+}
+
+func (d *Drainer) remove(t *Test) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.tests, t)
+	if len(d.tests) == 0 {
+		close(d.idle)
+	}
+}
+
+// wait blocks until no tests are running or ctx expires. wait reports whether
+// all tests have completed.
+func (d *Drainer) wait(ctx context.Context) bool {
+	d.mu.Lock()
+	idle := d.idle
+	d.mu.Unlock()
+	select {
+	case <-idle:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Shutdown enables lame duck mode and waits for running tests to complete.
+// When ctx expires before they do, the remaining tests are interrupted and
+// Shutdown waits up to FlushTimeout for them to save their results. Shutdown
+// returns the number of interrupted tests. Lame duck mode cannot be disabled
+// once Shutdown has started.
+func (d *Drainer) Shutdown(ctx context.Context) int {
+	d.mu.Lock()
+	d.lameDuck = true
+	d.shutdown = true
+	d.mu.Unlock()
+	if d.wait(ctx) {
+		return 0
+	}
+	d.mu.Lock()
+	count := len(d.tests)
+	for t := range d.tests {
+		atomic.StoreInt32(&t.interrupted, 1)
+		t.cancel()
+	}
+	d.mu.Unlock()
+	interruptedTests.Add(float64(count))
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), FlushTimeout)
+	defer cancel()
+	d.wait(flushCtx)
+	return count
+}
+
+// Context returns the context of the test. The context is canceled when the
+// test is interrupted during shutdown or once Done is called.
+func (t *Test) Context() context.Context {
+	return t.ctx
+}
+
+// Err returns ErrShutdown if the test was interrupted by Shutdown, and nil
+// otherwise.
+func (t *Test) Err() error {
+	if atomic.LoadInt32(&t.interrupted) != 0 {
+		return ErrShutdown
+	}
+	return nil
+}
+
+// Done marks the test as complete. It is safe to call Done more than once.
+func (t *Test) Done() {
+	t.once.Do(func() {
+		t.cancel()
+		t.drainer.remove(t)
+	})
+}
+
+// SetDefault sets the Drainer used by the package-level functions. Tests that
+// are running on the previous Drainer stay there.
+func SetDefault(d *Drainer) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultDrainer = d
+	if d.LameDuck() {
+		lameDuck.Set(1)
+	} else {
+		lameDuck.Set(0)
+	}
+}
+
+func getDefault() *Drainer {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultDrainer
+}
+
+// SetLameDuck enables or disables lame duck mode for the default Drainer.
+func SetLameDuck(enabled bool) error {
+	if err := getDefault().SetLameDuck(enabled); err != nil {
+		return err
+	}
+	if enabled {
+		lameDuck.Set(1)
+	} else {
+		lameDuck.Set(0)
+	}
+	return nil
+}
+
+// LameDuck reports whether the default Drainer is in lame duck mode.
+func LameDuck() bool {
+	return getDefault().LameDuck()
+}
+
+// Active returns the number of tests running on the default Drainer.
+func Active() int {
+	return getDefault().Active()
+}
+
+// Begin registers a new test with the default Drainer.
+func Begin(parent context.Context) (*Test, error) {
+	return getDefault().Begin(parent)
+}
+
+// Shutdown enables lame duck mode and drains the default Drainer.
+func Shutdown(ctx context.Context) int {
+	lameDuck.Set(1)
+	return getDefault().Shutdown(ctx)
+}
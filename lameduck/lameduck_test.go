@@ -0,0 +1,97 @@
+package lameduck
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDrainer_Begin(t *testing.T) {
+	d := New()
+	t1, err := d.Begin(context.Background())
+	if err != nil {
+		t.Fatalf("Begin() unexpected error = %v", err)
+	}
+	if d.Active() != 1 {
+		t.Errorf("Active() = %d, want 1", d.Active())
+	}
+	d.SetLameDuck(true)
+	if _, err := d.Begin(context.Background()); err != ErrLameDuck {
+		t.Errorf("Begin() in lame duck error = %v, want %v", err, ErrLameDuck)
+	}
+	t1.Done()
+	t1.Done() // Calling Done twice is safe.
+	if d.Active() != 0 {
+		t.Errorf("Active() = %d, want 0", d.Active())
+	}
+	if t1.Context().Err() == nil {
+		t.Error("Test context should be canceled after Done")
+	}
+	if t1.Err() != nil {
+		t.Errorf("Err() = %v, want nil", t1.Err())
+	}
+	d.SetLameDuck(false)
+	if _, err := d.Begin(context.Background()); err != nil {
+		t.Errorf("Begin() after lame duck error = %v", err)
+	}
+}
+
+func TestDrainer_ShutdownIdle(t *testing.T) {
+	d := New()
+	if n := d.Shutdown(context.Background()); n != 0 {
+		t.Errorf("Shutdown() = %d, want 0", n)
+	}
+	if !d.LameDuck() {
+		t.Error("Shutdown() should enable lame duck mode")
+	}
+	// Lame duck mode is sticky once Shutdown has started.
+	if err := d.SetLameDuck(false); err != ErrShuttingDown {
+		t.Errorf("SetLameDuck(false) after Shutdown error = %v, want %v", err, ErrShuttingDown)
+	}
+	if !d.LameDuck() {
+		t.Error("SetLameDuck(false) should not disable lame duck mode after Shutdown")
+	}
+}
+
+func TestDrainer_ShutdownCompletes(t *testing.T) {
+	d := New()
+	test, err := d.Begin(context.Background())
+	if err != nil {
+		t.Fatalf("Begin() unexpected error = %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		test.Done()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if n := d.Shutdown(ctx); n != 0 {
+		t.Errorf("Shutdown() = %d, want 0", n)
+	}
+	if test.Err() != nil {
+		t.Errorf("Err() = %v, want nil", test.Err())
+	}
+}
+
+func TestDrainer_ShutdownInterrupts(t *testing.T) {
+	d := New()
+	test, err := d.Begin(context.Background())
+	if err != nil {
+		t.Fatalf("Begin() unexpected error = %v", err)
+	}
+	// Simulate a test that runs until it is interrupted and then saves results.
+	var saved error
+	go func() {
+		<-test.Context().Done()
+		saved = test.Err()
+		test.Done()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if n := d.Shutdown(ctx); n != 1 {
+		t.Errorf("Shutdown() = %d, want 1", n)
+	}
+	if saved != ErrShutdown {
+		t.Errorf("interrupted test Err() = %v, want %v", saved, ErrShutdown)
+	}
+}
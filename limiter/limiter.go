@@ -0,0 +1,233 @@
+// Package limiter implements per-client and per-prefix limits on the number
+// of measurements a server is willing to run. Misconfigured clients sometimes
+// start a new test every few seconds; the Limiter rejects such clients before
+// a test begins so they neither consume server capacity nor skew the data.
+package limiter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/m-lab/ndt-server/anonymize"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrTooManyTests is returned when a client IP has already started the
+	// maximum number of tests allowed within the configured window.
+	ErrTooManyTests = errors.New("too many tests from client")
+	// ErrTooManyConcurrent is returned when the client's network prefix already
+	// has the maximum number of tests allowed running concurrently.
+	ErrTooManyConcurrent = errors.New("too many concurrent tests from client prefix")
+
+	limiterRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_limiter_requests_total",
+			Help: "Number of test requests evaluated by the rate limiter, by outcome.",
+		},
+		[]string{"protocol", "result"},
+	)
+)
+
+// Config contains the limits enforced by a Limiter. A zero value for
+// MaxTests or MaxConcurrent disables that limit.
+type Config struct {
+	// Window is the period over which MaxTests is counted.
+	Window time.Duration
+	// MaxTests is the number of tests a single client IP may start per Window.
+	MaxTests int
+	// MaxConcurrent is the number of tests that may run at the same time from
+	// a single network prefix.
+	MaxConcurrent int
+	// IPv4PrefixLen and IPv6PrefixLen define the network prefix used to
+	// group clients for MaxConcurrent, e.g. 24 and 48.
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+}
+
+// Limiter tracks recent and running tests per client.
+type Limiter struct {
+	mu      sync.Mutex
+	config  Config
+	history map[string][]time.Time
+	active  map[string]int
+	now     func() time.Time
+	// ticker is the ticker of Watch, which SetConfig resets when the window
+	// changes.
+	ticker *time.Ticker
+}
+
+// New creates a new Limiter using config and starts a goroutine that
+// periodically forgets expired client history until ctx is canceled. When
+// config specifies no limits, New returns nil. A nil *Limiter is valid and
+// accepts every request.
+func New(ctx context.Context, config Config) *Limiter {
+	if config.MaxTests <= 0 && config.MaxConcurrent <= 0 {
+		return nil
+	}
+	l := &Limiter{
+		config:  config,
+		history: make(map[string][]time.Time),
+		active:  make(map[string]int),
+		now:     time.Now,
+	}
+	go l.Watch(ctx)
+	return l
+}
+
+// Prefix returns the string form of the network prefix containing ip
+// according to the configured prefix lengths.
+func (l *Limiter) Prefix(ip net.IP) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.prefix(ip)
+}
+
+// prefix is Prefix for callers that hold l.mu.
+func (l *Limiter) prefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return prefixString(ip4, l.config.IPv4PrefixLen, 32)
+	}
+	return prefixString(ip, l.config.IPv6PrefixLen, 128)
+}
+
+func prefixString(ip net.IP, ones, bits int) string {
+	if ones <= 0 || ones > bits {
+		ones = bits
+	}
+	return ip.Mask(net.CIDRMask(ones, bits)).String() + "/" + strconv.Itoa(ones)
+}
+
+// Acquire checks whether a new test from ip may start. On success, Acquire
+// returns a release function that must be called once the test completes. On
+// failure, Acquire returns ErrTooManyTests or ErrTooManyConcurrent; the
+// rejection is counted and logged. A nil ip is always accepted.
+func (l *Limiter) Acquire(proto string, ip net.IP) (func(), error) {
+	if l == nil || ip == nil {
+		return func() {}, nil
+	}
+	client := ip.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prefix := l.prefix(ip)
+	now := l.now()
+	if l.config.MaxTests > 0 {
+		recent := l.expire(client, now)
+		if len(recent) >= l.config.MaxTests {
+			l.reject(proto, client, prefix, ErrTooManyTests)
+			return nil, ErrTooManyTests
+		}
+	}
+	if l.config.MaxConcurrent > 0 && l.active[prefix] >= l.config.MaxConcurrent {
+		l.reject(proto, client, prefix, ErrTooManyConcurrent)
+		return nil, ErrTooManyConcurrent
+	}
+	if l.config.MaxTests > 0 {
+		l.history[client] = append(l.history[client], now)
+	}
+	l.active[prefix]++
+	limiterRequests.WithLabelValues(proto, "accepted").Inc()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(prefix) })
+	}, nil
+}
+
+// SetConfig replaces the limits enforced by l. Tests that are already running
+// are unaffected.
+func (l *Limiter) SetConfig(config Config) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	changed := config.Window != l.config.Window
+	l.config = config
+	if changed && l.ticker != nil {
+		l.ticker.Reset(l.period())
+	}
+}
+
+// period returns how often Watch expires client history. The caller must hold
+// l.mu.
+func (l *Limiter) period() time.Duration {
+	if l.config.Window <= 0 {
+		return time.Minute
+	}
+	return l.config.Window
+}
+
+// Watch removes client history older than the configured window once per
+// window until ctx is canceled. Callers should typically run Watch in a
+// goroutine.
+func (l *Limiter) Watch(ctx context.Context) {
+	l.mu.Lock()
+	t := time.NewTicker(l.period())
+	l.ticker = t
+	l.mu.Unlock()
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			l.mu.Lock()
+			now := l.now()
+			for client := range l.history {
+				l.expire(client, now)
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// expire drops timestamps older than the window from the client history and
+// returns the remaining ones. The caller must hold l.mu.
+func (l *Limiter) expire(client string, now time.Time) []time.Time {
+	recent := l.history[client]
+	i := 0
+	for i < len(recent) && now.Sub(recent[i]) >= l.config.Window {
+		i++
+	}
+	recent = recent[i:]
+	if len(recent) == 0 {
+		delete(l.history, client)
+		return nil
+	}
+	l.history[client] = recent
+	return recent
+}
+
+func (l *Limiter) release(prefix string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active[prefix]--
+	if l.active[prefix] <= 0 {
+		delete(l.active, prefix)
+	}
+}
+
+// reject counts and audit-logs a rejected request. The caller must hold l.mu.
+func (l *Limiter) reject(proto, client, prefix string, err error) {
+	result := "rejected-rate"
+	if err == ErrTooManyConcurrent {
+		result = "rejected-concurrency"
+	}
+	limiterRequests.WithLabelValues(proto, result).Inc()
+	logging.Logger.WithFields(log.Fields{
+		"protocol": proto,
+		"client":   anonymize.IPString(client),
+		"prefix":   anonymize.Prefix(prefix),
+		"active":   l.active[prefix],
+		"recent":   len(l.history[client]),
+	}).WithError(err).Warn("limiter: rejected test")
+}
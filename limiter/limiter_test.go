@@ -0,0 +1,142 @@
+package limiter
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if l := New(ctx, Config{Window: time.Minute}); l != nil {
+		t.Errorf("New() with no limits = %v, want nil", l)
+	}
+	// A nil Limiter accepts everything.
+	var l *Limiter
+	release, err := l.Acquire("test", net.ParseIP("192.0.2.1"))
+	if err != nil {
+		t.Errorf("nil Limiter.Acquire() error = %v, want nil", err)
+	}
+	release()
+}
+
+func TestLimiter_Prefix(t *testing.T) {
+	l := &Limiter{config: Config{IPv4PrefixLen: 24, IPv6PrefixLen: 48}}
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "192.0.2.55", want: "192.0.2.0/24"},
+		{ip: "2001:db8:1:2:3::4", want: "2001:db8:1::/48"},
+	}
+	for _, tt := range tests {
+		if got := l.Prefix(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Limiter.Prefix(%s) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestLimiter_Acquire(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := &Limiter{
+		config: Config{
+			Window:        time.Minute,
+			MaxTests:      2,
+			MaxConcurrent: 2,
+			IPv4PrefixLen: 24,
+		},
+		history: make(map[string][]time.Time),
+		active:  make(map[string]int),
+		now:     func() time.Time { return now },
+	}
+	a := net.ParseIP("192.0.2.1")
+	b := net.ParseIP("192.0.2.2")
+	c := net.ParseIP("192.0.2.3")
+
+	ra1, err := l.Acquire("test", a)
+	if err != nil {
+		t.Fatalf("Acquire(a) unexpected error = %v", err)
+	}
+	rb, err := l.Acquire("test", b)
+	if err != nil {
+		t.Fatalf("Acquire(b) unexpected error = %v", err)
+	}
+	// Two concurrent tests from the same /24 are running.
+	if _, err := l.Acquire("test", c); err != ErrTooManyConcurrent {
+		t.Errorf("Acquire(c) error = %v, want %v", err, ErrTooManyConcurrent)
+	}
+	rb()
+	rb() // Releasing twice must not free a second slot.
+	ra2, err := l.Acquire("test", a)
+	if err != nil {
+		t.Fatalf("Acquire(a) second test unexpected error = %v", err)
+	}
+	ra1()
+	ra2()
+	// Client a has used both of its tests for this window.
+	if _, err := l.Acquire("test", a); err != ErrTooManyTests {
+		t.Errorf("Acquire(a) third test error = %v, want %v", err, ErrTooManyTests)
+	}
+	// After the window passes, client a may test again.
+	now = now.Add(time.Minute)
+	r, err := l.Acquire("test", a)
+	if err != nil {
+		t.Errorf("Acquire(a) after window unexpected error = %v", err)
+	}
+	r()
+	if len(l.active) != 0 {
+		t.Errorf("active prefixes after release = %v, want none", l.active)
+	}
+}
+
+func TestLimiter_Watch(t *testing.T) {
+	now := time.Now()
+	l := &Limiter{
+		config:  Config{Window: time.Millisecond, MaxTests: 1},
+		history: map[string][]time.Time{"192.0.2.1": {now.Add(-time.Hour)}},
+		active:  make(map[string]int),
+		now:     time.Now,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	l.Watch(ctx)
+	if len(l.history) != 0 {
+		t.Errorf("history after Watch = %v, want empty", l.history)
+	}
+}
+
+func TestLimiter_SetConfig(t *testing.T) {
+	now := time.Now()
+	l := &Limiter{
+		config:  Config{Window: time.Hour, MaxTests: 1},
+		history: map[string][]time.Time{"192.0.2.1": {now.Add(-time.Minute)}},
+		active:  make(map[string]int),
+		now:     time.Now,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go func() {
+		// Acquire and SetConfig may run at the same time.
+		l.Acquire("test", net.ParseIP("192.0.2.2"))
+		// Wait for Watch to start with the old window. The shorter window
+		// applies to the next expiry, not an hour later.
+		for {
+			l.mu.Lock()
+			started := l.ticker != nil
+			l.mu.Unlock()
+			if started {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		l.SetConfig(Config{Window: time.Millisecond, MaxTests: 1})
+	}()
+	l.Watch(ctx)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.history) != 0 {
+		t.Errorf("history after Watch = %v, want empty", l.history)
+	}
+}
@@ -0,0 +1,249 @@
+package logging
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/m-lab/access/controller"
+	"github.com/m-lab/ndt-server/anonymize"
+)
+
+// AccessEntry is an entry of the JSON access log. Requests rejected by access
+// control, e.g. because of an invalid token or by the tx controller, have
+// Admitted set to false.
+type AccessEntry struct {
+	Time   time.Time
+	Client string
+	Method string
+	Path   string
+	// Status is 101 for requests upgraded to WebSockets.
+	Status int
+	// Duration is the time taken to serve the request, in seconds. For ndt7
+	// subtests it includes the whole subtest.
+	Duration float64
+	// Bytes is the size of the response body. For ndt7 subtests, which send
+	// and receive their data after the upgrade, it is the number of bytes
+	// acknowledged by the client in downloads and received by the server in
+	// uploads, from the last TCP_INFO of the subtest.
+	Bytes        int64
+	UserAgent    string `json:",omitempty"`
+	TokenSubject string `json:",omitempty"`
+	// UUID is the UUID of the ndt7 subtest served by the request, which joins
+	// the entry with the result.
+	UUID     string `json:",omitempty"`
+	Admitted bool
+}
+
+// accessState collects the fields of an AccessEntry that are only known by
+// the handlers behind access control.
+type accessState struct {
+	mu       sync.Mutex
+	uuid     string
+	bytes    int64
+	subject  string
+	admitted bool
+}
+
+type accessKey struct{}
+
+// JSONAccessLog writes an access log with one JSON object per request. It is
+// safe to call the methods of a nil JSONAccessLog, which logs nothing.
+type JSONAccessLog struct {
+	mu   sync.Mutex
+	enc  *json.Encoder
+	path string
+	fp   *os.File
+}
+
+// NewJSONAccessLog returns a JSONAccessLog writing to w.
+func NewJSONAccessLog(w io.Writer) *JSONAccessLog {
+	return &JSONAccessLog{enc: json.NewEncoder(w)}
+}
+
+// OpenJSONAccessLog returns a JSONAccessLog appending to the file at path,
+// which is created if needed.
+func OpenJSONAccessLog(path string) (*JSONAccessLog, error) {
+	l := &JSONAccessLog{path: path}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reopen reopens the file of a JSONAccessLog created by OpenJSONAccessLog, so
+// that the log follows the file when it is rotated. It has no effect on other
+// JSONAccessLogs.
+func (l *JSONAccessLog) Reopen() error {
+	if l == nil || l.path == "" {
+		return nil
+	}
+	fp, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fp != nil {
+		l.fp.Close()
+	}
+	l.fp = fp
+	l.enc = json.NewEncoder(fp)
+	return nil
+}
+
+// Close closes the file of a JSONAccessLog created by OpenJSONAccessLog. The
+// log writes nothing afterwards.
+func (l *JSONAccessLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc = nil
+	if l.fp == nil {
+		return nil
+	}
+	err := l.fp.Close()
+	l.fp = nil
+	return err
+}
+
+// Handler wraps next, which should include the access controllers, with a
+// handler that writes an entry for every request once next returns. Client
+// addresses are anonymized as configured by the anonymize package. Use
+// AccessAdmitted behind the access controllers to record the token subject.
+func (l *JSONAccessLog) Handler(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		state := &accessState{}
+		rw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), accessKey{}, state)))
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		state.mu.Lock()
+		entry := &AccessEntry{
+			Time:         start.UTC(),
+			Client:       anonymize.IPString(host),
+			Method:       r.Method,
+			Path:         r.URL.Path,
+			Status:       rw.status,
+			Duration:     time.Since(start).Seconds(),
+			Bytes:        rw.bytes + state.bytes,
+			UserAgent:    r.UserAgent(),
+			TokenSubject: state.subject,
+			UUID:         state.uuid,
+			Admitted:     state.admitted,
+		}
+		state.mu.Unlock()
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		l.write(entry)
+	})
+}
+
+func (l *JSONAccessLog) write(entry *AccessEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.enc == nil {
+		return
+	}
+	if err := l.enc.Encode(entry); err != nil {
+		Logger.WithError(err).Warn("logging: could not write access log entry")
+	}
+}
+
+// AccessAdmitted wraps next with a handler that records in the JSON access
+// log that the request was admitted by the access controllers, along with the
+// subject of its access token, if any. It must be placed behind the access
+// controllers.
+func AccessAdmitted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if state, ok := r.Context().Value(accessKey{}).(*accessState); ok {
+			state.mu.Lock()
+			state.admitted = true
+			if claim := controller.GetClaim(r.Context()); claim != nil {
+				state.subject = claim.Subject
+			}
+			state.mu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetAccessUUID records the UUID of the test served by the request with the
+// given context in the JSON access log.
+func SetAccessUUID(ctx context.Context, uuid string) {
+	if state, ok := ctx.Value(accessKey{}).(*accessState); ok {
+		state.mu.Lock()
+		state.uuid = uuid
+		state.mu.Unlock()
+	}
+}
+
+// SetAccessBytes records the number of bytes transferred after the upgrade by
+// the test served by the request with the given context in the JSON access
+// log.
+func SetAccessBytes(ctx context.Context, bytes int64) {
+	if state, ok := ctx.Value(accessKey{}).(*accessState); ok {
+		state.mu.Lock()
+		state.bytes = bytes
+		state.mu.Unlock()
+	}
+}
+
+// accessWriter records the status and size of a response. It supports
+// hijacking, so that WebSocket upgrades are logged too.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("logging: response does not support hijacking")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
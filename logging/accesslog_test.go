@@ -0,0 +1,139 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/access/controller"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// fakeController admits requests with a token, like the token controller.
+func fakeController(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("access_token")
+		if token == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ctx := controller.SetClaim(r.Context(), &jwt.Claims{Subject: token})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func TestJSONAccessLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewJSONAccessLog(buf)
+	h := l.Handler(fakeController(AccessAdmitted(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetAccessUUID(r.Context(), "test-uuid")
+		SetAccessBytes(r.Context(), 1000)
+		w.Write([]byte("hello"))
+	}))))
+
+	tests := []struct {
+		name string
+		url  string
+		want AccessEntry
+	}{
+		{
+			name: "admitted",
+			url:  "/ndt/v7/download?access_token=subject",
+			want: AccessEntry{
+				Method: "GET", Path: "/ndt/v7/download", Status: 200, Bytes: 1005,
+				UserAgent: "test", TokenSubject: "subject", UUID: "test-uuid", Admitted: true,
+			},
+		},
+		{
+			name: "rejected",
+			url:  "/ndt/v7/download",
+			want: AccessEntry{
+				Method: "GET", Path: "/ndt/v7/download", Status: 401, UserAgent: "test",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			req := httptest.NewRequest("GET", tt.url, nil)
+			req.Header.Set("User-Agent", "test")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			var got AccessEntry
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("Could not parse entry %q: %v", buf.String(), err)
+			}
+			if got.Time.IsZero() || got.Client == "" || got.Duration < 0 {
+				t.Errorf("Entry = %+v, want a time, a client and a duration", got)
+			}
+			got.Time, got.Client, got.Duration = tt.want.Time, "", 0
+			if got != tt.want {
+				t.Errorf("Entry = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// A nil JSONAccessLog logs nothing.
+	var nilLog *JSONAccessLog
+	next := http.NotFoundHandler()
+	if nilLog.Handler(next) == nil {
+		t.Error("Handler() of a nil JSONAccessLog should return next")
+	}
+}
+
+func TestOpenJSONAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestOpenJSONAccessLog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.json")
+	l, err := OpenJSONAccessLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := l.Handler(http.NotFoundHandler())
+	get := func(url string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+	read := func(name string) string {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// After a rotation, entries go to the new file.
+	get("/before")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reopen(); err != nil {
+		t.Fatalf("Reopen() = %v", err)
+	}
+	get("/after")
+	if old, cur := read(path+".1"), read(path); !strings.Contains(old, "/before") || strings.Contains(old, "/after") ||
+		!strings.Contains(cur, "/after") {
+		t.Errorf("rotated log = %q, log = %q, want one entry in each", old, cur)
+	}
+
+	// Nothing is written once the log is closed.
+	if err := l.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	get("/closed")
+	if strings.Contains(read(path), "/closed") {
+		t.Error("A closed log should not write entries")
+	}
+
+	if _, err := OpenJSONAccessLog(filepath.Join(dir, "missing", "access.json")); err == nil {
+		t.Error("OpenJSONAccessLog() in a missing directory should fail")
+	}
+}
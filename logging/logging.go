@@ -3,29 +3,157 @@
 package logging
 
 import (
+	"context"
+	"fmt"
+	"io"
 	golog "log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/apex/log/handlers/json"
 	"github.com/gorilla/handlers"
+	"github.com/m-lab/ndt-server/anonymize"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 // Logger is a logger that logs messages on the standard error
 // in a structured JSON format, to simplify processing. Emitting logs
 // on the standard error is consistent with the standard practices
-// when dockerising an Apache or Nginx instance.
+// when dockerising an Apache or Nginx instance. Use SetLevel, rather than
+// Logger.Level, to change the level while the server is running.
 var Logger = log.Logger{
-	Handler: json.New(os.Stderr),
+	Handler: &levelHandler{handler: json.New(os.Stderr)},
 	Level:   log.DebugLevel,
 }
 
+// level is the minimum level of the messages emitted by Logger.
+var level = int32(log.DebugLevel)
+
+// warningsPerSecond is the maximum number of warnings with the same message
+// emitted by Logger every second, or zero for no limit.
+var warningsPerSecond = int32(0)
+
+var droppedMessages = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ndt_log_messages_dropped_total",
+		Help: "Number of log messages dropped by sampling, by level.",
+	},
+	[]string{"level"},
+)
+
+// levelHandler drops messages below the current level, and samples warnings
+// when SetWarningSampling is in use. Unlike Logger.Level, the level can safely
+// be changed while other goroutines are logging.
+type levelHandler struct {
+	handler log.Handler
+
+	mu          sync.Mutex
+	windowStart time.Time
+	warnings    map[string]int
+}
+
+func (h *levelHandler) HandleLog(e *log.Entry) error {
+	if e.Level < log.Level(atomic.LoadInt32(&level)) {
+		return nil
+	}
+	if e.Level == log.WarnLevel && !h.sample(e.Message) {
+		droppedMessages.WithLabelValues(e.Level.String()).Inc()
+		return nil
+	}
+	return h.handler.HandleLog(e)
+}
+
+// sample reports whether a warning with the given message may be emitted.
+// Warnings are counted by message, so that a flood of a single warning, e.g.
+// caused by one misbehaving client, does not hide the others.
+func (h *levelHandler) sample(message string) bool {
+	limit := int(atomic.LoadInt32(&warningsPerSecond))
+	if limit <= 0 {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now := time.Now(); h.warnings == nil || now.Sub(h.windowStart) >= time.Second {
+		h.windowStart = now
+		h.warnings = make(map[string]int)
+	}
+	h.warnings[message]++
+	return h.warnings[message] <= limit
+}
+
+// SetLevel sets the minimum level of the messages emitted by Logger. Valid
+// levels are "debug", "info", "warn", "error" and "fatal".
+func SetLevel(name string) error {
+	l, err := log.ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&level, int32(l))
+	return nil
+}
+
+// SetWarningSampling limits the warnings with the same message emitted by
+// Logger to n every second. Zero disables the limit.
+func SetWarningSampling(n int) {
+	atomic.StoreInt32(&warningsPerSecond, int32(n))
+}
+
+type loggerKey struct{}
+
+// NewContext returns a copy of ctx carrying logger, usually one returned by
+// ForTest. Use FromContext to log with it.
+func NewContext(ctx context.Context, logger log.Interface) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger of the test carried by ctx, or Logger when
+// ctx carries none.
+func FromContext(ctx context.Context) log.Interface {
+	if l, ok := ctx.Value(loggerKey{}).(log.Interface); ok {
+		return l
+	}
+	return &Logger
+}
+
+// ForTest returns a logger whose entries have the protocol and UUID of a test.
+func ForTest(protocol, uuid string) log.Interface {
+	return Logger.WithFields(log.Fields{
+		"protocol": protocol,
+		"uuid":     uuid,
+	})
+}
+
 // MakeAccessLogHandler wraps |handler| with another handler that logs
 // access to each resource on the standard output. This is consistent with
-// the way in which Apache and Nginx are dockerised. We do not emit JSON
-// access logs, because access logs are a fairly standard format that
-// has been around for a long time now, so better to follow such standard.
+// the way in which Apache and Nginx are dockerised. These access logs use the
+// Apache format, because it is a fairly standard format that has been around
+// for a long time now. JSONAccessLog writes an optional JSON access log that
+// can be joined with the results. Client addresses are anonymized as
+// configured by the anonymize package.
 func MakeAccessLogHandler(handler http.Handler) http.Handler {
-	return handlers.LoggingHandler(golog.Writer(), handler)
+	return handlers.CustomLoggingHandler(golog.Writer(), handler, writeAccessLog)
+}
+
+// writeAccessLog writes an entry in Apache Common Log Format, like
+// handlers.LoggingHandler, but with the client address anonymized.
+func writeAccessLog(w io.Writer, params handlers.LogFormatterParams) {
+	req := params.Request
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	uri := req.RequestURI
+	if uri == "" {
+		uri = params.URL.RequestURI()
+	}
+	fmt.Fprintf(w, "%s - - [%s] \"%s %s %s\" %d %d\n",
+		anonymize.IPString(host), params.TimeStamp.Format("02/Jan/2006:15:04:05 -0700"),
+		req.Method, strings.ReplaceAll(uri, `"`, `\"`), req.Proto, params.StatusCode, params.Size)
 }
@@ -2,10 +2,12 @@ package logging
 
 import (
 	"bytes"
+	"context"
 	"log"
 	"net/http"
 	"testing"
 
+	apexlog "github.com/apex/log"
 	"github.com/m-lab/go/httpx"
 	"github.com/m-lab/go/rtx"
 )
@@ -38,3 +40,64 @@ func TestMakeAccessLogHandler(t *testing.T) {
 		t.Error("We should not have had an empty string")
 	}
 }
+
+func TestSetLevel(t *testing.T) {
+	defer SetLevel("debug")
+	if err := SetLevel("loud"); err == nil {
+		t.Error("SetLevel() with an invalid level should fail")
+	}
+	var entries []*apexlog.Entry
+	logger := apexlog.Logger{
+		Handler: &levelHandler{handler: apexlog.HandlerFunc(func(e *apexlog.Entry) error {
+			entries = append(entries, e)
+			return nil
+		})},
+		Level: apexlog.DebugLevel,
+	}
+	rtx.Must(SetLevel("warn"), "Could not set level")
+	logger.Info("dropped")
+	logger.Warn("kept")
+	if len(entries) != 1 || entries[0].Message != "kept" {
+		t.Errorf("levelHandler passed %d entries, want only the warning", len(entries))
+	}
+}
+
+func TestSetWarningSampling(t *testing.T) {
+	defer SetWarningSampling(0)
+	var entries []*apexlog.Entry
+	logger := apexlog.Logger{
+		Handler: &levelHandler{handler: apexlog.HandlerFunc(func(e *apexlog.Entry) error {
+			entries = append(entries, e)
+			return nil
+		})},
+		Level: apexlog.DebugLevel,
+	}
+	SetWarningSampling(2)
+	for i := 0; i < 5; i++ {
+		logger.Warn("noisy")
+		logger.Info("info")
+	}
+	logger.Warn("quiet")
+	// Two noisy warnings, five infos and the quiet warning.
+	if len(entries) != 8 {
+		t.Errorf("levelHandler passed %d entries, want 8", len(entries))
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if l := FromContext(context.Background()); l != &Logger {
+		t.Errorf("FromContext() = %v, want Logger", l)
+	}
+	var entries []*apexlog.Entry
+	old := Logger.Handler
+	defer func() { Logger.Handler = old }()
+	Logger.Handler = apexlog.HandlerFunc(func(e *apexlog.Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	ctx := NewContext(context.Background(), ForTest("ndt7", "uuid"))
+	FromContext(ctx).Info("test")
+	if len(entries) != 1 || entries[0].Fields["uuid"] != "uuid" || entries[0].Fields["protocol"] != "ndt7" {
+		t.Errorf("FromContext() logged %v, want one entry with the protocol and UUID", entries)
+	}
+}
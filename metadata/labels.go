@@ -0,0 +1,34 @@
+package metadata
+
+import "sync"
+
+// Labels holds the deployment-specific server metadata. The metadata may be
+// replaced while the server runs, e.g. when the configuration is reloaded, and
+// tests started afterwards record the new values.
+type Labels struct {
+	mu     sync.RWMutex
+	values []NameValue
+}
+
+// NewLabels creates Labels with the given initial values.
+func NewLabels(values []NameValue) *Labels {
+	return &Labels{values: values}
+}
+
+// Get returns the current metadata. It is safe to call Get on a nil Labels,
+// which has no metadata.
+func (l *Labels) Get() []NameValue {
+	if l == nil {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.values
+}
+
+// Set replaces the metadata. The slice must not be modified afterwards.
+func (l *Labels) Set(values []NameValue) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.values = values
+}
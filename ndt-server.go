@@ -1,34 +1,56 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/justinas/alice"
 	"github.com/m-lab/access/controller"
 	"github.com/m-lab/access/token"
+	goanonymize "github.com/m-lab/go/anonymize"
 	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/memoryless"
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/annotation"
+	"github.com/m-lab/ndt-server/anonymize"
+	"github.com/m-lab/ndt-server/certs"
+	"github.com/m-lab/ndt-server/config"
+	"github.com/m-lab/ndt-server/events"
+	"github.com/m-lab/ndt-server/health"
+	"github.com/m-lab/ndt-server/hooks"
+	"github.com/m-lab/ndt-server/index"
+	"github.com/m-lab/ndt-server/janitor"
+	"github.com/m-lab/ndt-server/lameduck"
+	"github.com/m-lab/ndt-server/limiter"
 	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metadata"
 	ndt5handler "github.com/m-lab/ndt-server/ndt5/handler"
 	"github.com/m-lab/ndt-server/ndt5/plain"
 	"github.com/m-lab/ndt-server/ndt7/handler"
 	"github.com/m-lab/ndt-server/ndt7/listener"
+	"github.com/m-lab/ndt-server/ndt7/measurer"
+	"github.com/m-lab/ndt-server/ndt7/retrieval"
+	"github.com/m-lab/ndt-server/ndt7/samplefields"
 	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/netx"
 	"github.com/m-lab/ndt-server/platformx"
+	"github.com/m-lab/ndt-server/safefile"
+	"github.com/m-lab/ndt-server/sink"
 	"github.com/m-lab/ndt-server/version"
-
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var (
@@ -38,22 +60,64 @@ var (
 	ndt5Addr          = flag.String("ndt5_addr", ":3001", "The address and port to use for the unencrypted ndt5 test")
 	ndt5WsAddr        = flag.String("ndt5_ws_addr", "127.0.0.1:3002", "The address and port to use for the ndt5 WS test")
 	ndt5WssAddr       = flag.String("ndt5_wss_addr", ":3010", "The address and port to use for the ndt5 WSS test")
-	certFile          = flag.String("cert", "", "The file with server certificates in PEM format.")
-	keyFile           = flag.String("key", "", "The file with server key in PEM format.")
+	clientCAFile      = flag.String("tls.client-ca", "", "File with CA certificates in PEM format. When set, TLS clients must present a certificate signed by one of them instead of an access token")
+	certReload        = flag.Duration("cert.reload-interval", 10*time.Second, "How often to check the certificate and key files for changes")
 	tlsVersion        = flag.String("tls.version", "", "Minimum TLS version. Valid values: 1.2 or 1.3")
 	dataDir           = flag.String("datadir", "/var/spool/ndt", "The directory in which to write data files")
 	htmlDir           = flag.String("htmldir", "html", "The directory from which to serve static web content.")
+	limitWindow       = flag.Duration("limiter.window", time.Minute, "The period over which tests per client IP are counted")
+	limitMaxTests     = flag.Int("limiter.max-tests", 0, "Maximum tests a client IP may start per window (0 means unlimited)")
+	limitConcurrent   = flag.Int("limiter.max-concurrent", 0, "Maximum concurrent tests per client network prefix (0 means unlimited)")
+	limitIPv4Prefix   = flag.Int("limiter.ipv4-prefix", 24, "Prefix length used to group IPv4 clients for the concurrency limit")
+	limitIPv6Prefix   = flag.Int("limiter.ipv6-prefix", 48, "Prefix length used to group IPv6 clients for the concurrency limit")
+	adminAddr         = flag.String("admin_addr", "", "The address and port for health probes and lame duck control. Disabled when empty.")
+	shutdownDeadline  = flag.Duration("shutdown.deadline", time.Minute, "How long to wait for running tests to complete before shutting down")
+	samplingMin       = flag.Duration("ndt7.sampling.min", spec.MinPoissonSamplingInterval, "Minimum interval between ndt7 measurements")
+	samplingExpected  = flag.Duration("ndt7.sampling.expected", spec.AveragePoissonSamplingInterval, "Average interval between ndt7 measurements")
+	samplingMax       = flag.Duration("ndt7.sampling.max", spec.MaxPoissonSamplingInterval, "Maximum interval between ndt7 measurements")
+	samplesInterval   = flag.Duration("ndt7.samples.interval", 0, "Interval of the high resolution sampler, whose samples are archived but not sent to the client (0 means disabled)")
+	samplesFields     = flag.String("ndt7.samples.fields", strings.Join(samplefields.Default, ","), "Comma separated TCPInfo and BBRInfo fields kept by the high resolution sampler")
+	logLevel          = flag.String("log.level", "debug", "Minimum level of structured log messages: debug, info, warn, error or fatal")
+	logAccessJSON     = flag.String("log.access-json", "", "Write a JSON access log, which includes requests rejected by access control, to stdout, when set to '-', or to the file at the given path, which is reopened on SIGHUP")
+	logWarnSampling   = flag.Int("log.warning-sampling", 0, "Maximum number of warnings with the same message logged every second (0 means unlimited)")
+	configFile        = flag.String("config", "", "JSON config file. Flags and environment variables take precedence over the file. Labels, limits and log settings are reloaded on SIGHUP")
+	configValidate    = flag.Bool("config.validate", false, "Validate the config file, report any errors and exit")
+	janitorMaxAge     = flag.Duration("janitor.max-age", 0, "Remove results older than this from the data directory (0 means keep forever)")
+	janitorMaxBytes   = flag.Int64("janitor.max-bytes", 0, "Remove the oldest results when the results in the data directory exceed this size in bytes (0 means unlimited)")
+	janitorMinFree    = flag.Int64("janitor.min-free-bytes", 0, "Refuse new tests while less than this many bytes are free on the disk of the data directory (0 disables the check)")
+	janitorArchiveDir = flag.String("janitor.archive-dir", "", "Move removed results to this directory, on the same filesystem as the data directory, instead of deleting them")
+	janitorInterval   = flag.Duration("janitor.interval", time.Minute, "How often to enforce the data directory limits")
+	resultsFile       = flag.Bool("results.file", true, "Write results to files in the data directory")
+	resultsNDJSON     = flag.String("results.ndjson", "", "Write results as newline delimited JSON to stdout, when set to '-', or to the unix socket at the given path")
+	resultsWebhook    = flag.String("results.webhook", "", "URL to POST every result to as JSON. Disabled when empty")
+	webhookSpool      = flag.String("results.webhook-spool", "", "Directory for results waiting for delivery to the webhook (default <datadir>/.webhook-spool)")
+	webhookTimeout    = flag.Duration("results.webhook-timeout", 10*time.Second, "How long to wait for the webhook to accept a result before retrying")
+	resultsIndex      = flag.Bool("results.index", true, "Keep an index of all results in the data directory, searchable on the admin server")
+	retrievalSize     = flag.Int("results.retrieval-size", 1000, "Number of recent ndt7 results that clients may retrieve from "+spec.ResultURLPath+"<uuid> (0 disables retrieval)")
+	retrievalTTL      = flag.Duration("results.retrieval-ttl", 10*time.Minute, "How long clients may retrieve the result of an ndt7 subtest")
+	eventSocket       = flag.String("events.socket", "", "Publish the opening and closing of measurement connections on the unix socket at the given path, using the tcp-info eventsocket protocol. Disabled when empty")
+	hookExec          = flag.String("hooks.exec", "", "Command to run, with its arguments separated by spaces, for every completed test direction. The command receives the test in NDT_* environment variables and as JSON on stdin. The client IP is anonymized like in the results, so hooks cannot reach clients when -anonymize.ip or -anonymize.ip-key is set")
+	hookSocket        = flag.String("hooks.socket", "", "Unix socket to send every completed test direction to as a line of JSON. The client IP is anonymized like in the results")
+	hookTimeout       = flag.Duration("hooks.timeout", time.Minute, "How long a post-test hook may run before it is killed")
+	hookConcurrent    = flag.Int("hooks.max-concurrent", 10, "Maximum number of post-test hooks running at once. Further hook runs are dropped")
+	annotationASNs    = flag.String("annotation.asn-file", "", "Prefix to origin AS table in the routeviews pfx2as format, to annotate results with the AS of the client")
+	annotationGeo     = flag.String("annotation.geo-file", "", "Geo database in CSV format, with one network,country_code,region line per prefix, to annotate results with the location of the client")
+	annotationReload  = flag.Duration("annotation.reload-interval", time.Minute, "How often to check the annotation databases for changes")
+	annotationMetrics = flag.Bool("annotation.metrics", false, "Count results by client country and AS in Prometheus metrics")
+	annotationMaxASNs = flag.Int("annotation.metric-asns", 100, "Maximum number of distinct ASes used as metric labels. Further ASes are counted as 'other'")
 	deploymentLabels  = flagx.KeyValue{}
 	tokenVerifyKey    = flagx.FileBytesArray{}
 	tokenRequired5    bool
 	tokenRequired7    bool
 	tokenMachine      string
-
-	// A metric to use to signal that the server is in lame duck mode.
-	lameDuck = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "lame_duck_experiment",
-		Help: "Indicates when the server is in lame duck",
-	})
+	adminToken        = flagx.FileBytes{}
+	certFiles         = flagx.StringArray{}
+	keyFiles          = flagx.StringArray{}
+	anonymizeKey      = flagx.FileBytes{}
+	ndt5Layout        = flagx.Enum{
+		Options: []string{string(sink.NDT5Legacy), string(sink.NDT5Unified)},
+		Value:   string(sink.NDT5Legacy),
+	}
 
 	// Context for the whole program.
 	ctx, cancel = context.WithCancel(context.Background())
@@ -65,12 +129,14 @@ func init() {
 	flag.BoolVar(&tokenRequired7, "ndt7.token.required", false, "Require access token in NDT7 requests")
 	flag.StringVar(&tokenMachine, "token.machine", "", "Use given machine name to verify token claims")
 	flag.Var(&deploymentLabels, "label", "Labels to identify the type of deployment.")
+	flag.Var(&adminToken, "admin.token", "File containing the bearer token required to change lame duck status")
+	flag.Var(&certFiles, "cert", "The file with server certificates in PEM format. May be repeated, with one -key for each -cert.")
+	flag.Var(&anonymizeKey, "anonymize.ip-key", "File containing a secret key. When given, anonymized client IPs are replaced with a keyed hash")
+	flag.Var(&ndt5Layout, "results.ndt5-layout", "File layout of ndt5 results: legacy writes <uuid>.json, unified writes gzip compressed files named like ndt7 results")
+	flag.Var(&keyFiles, "key", "The file with server key in PEM format. May be repeated, in the same order as -cert.")
 }
 
 func catchSigterm() {
-	// Disable lame duck status.
-	lameDuck.Set(0)
-
 	// Register channel to receive SIGTERM events.
 	c := make(chan os.Signal, 1)
 	defer close(c)
@@ -79,21 +145,189 @@ func catchSigterm() {
 	// Wait until we receive a SIGTERM or the context is canceled.
 	select {
 	case <-c:
-		fmt.Println("Received SIGTERM")
+		log.Println("Received SIGTERM")
 	case <-ctx.Done():
-		fmt.Println("Canceled")
+		log.Println("Canceled")
 	}
-	// Set lame duck status. This will remain set until exit.
-	lameDuck.Set(1)
+	// Set lame duck status. New tests are refused while running tests continue.
+	lameduck.SetLameDuck(true)
 	// When we receive a second SIGTERM, cancel the context and shut everything
-	// down. This should cause main() to exit cleanly.
+	// down. This should cause main() to wait for running tests and then exit
+	// cleanly.
 	select {
 	case <-c:
-		fmt.Println("Received SIGTERM")
+		log.Println("Received SIGTERM")
 		cancel()
 	case <-ctx.Done():
-		fmt.Println("Canceled")
+		log.Println("Canceled")
+	}
+}
+
+// catchSighup calls reload whenever a SIGHUP is received, until the context is
+// canceled.
+func catchSighup(reload func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-c:
+			log.Println("Received SIGHUP, reloading")
+			reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// validateConfig reports all errors in the config file and returns the exit
+// status for the validate mode.
+func validateConfig(file string) int {
+	if file == "" {
+		fmt.Fprintln(os.Stderr, "No config file given with -config")
+		return 2
+	}
+	_, err := config.Load(file)
+	if errs, ok := err.(config.Errors); ok {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(file, "is valid")
+	return 0
+}
+
+// reloadConfig applies the settings of the config file that are safe to change
+// while the server is running: the deployment labels, the limits and the log
+// settings. As at startup, the flags in fixed, which were given on the command
+// line or through the environment, take precedence over the file. Settings
+// removed from the file go back to their default values. Changes to other
+// settings require a restart.
+func reloadConfig(fixed map[string]struct{}, labels *metadata.Labels, lim *limiter.Limiter) error {
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		return err
+	}
+	// The flags are only set at startup, so the reloaded settings go to a
+	// separate FlagSet. Its values are the defaults of the flags, or the
+	// startup values of the fixed flags.
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	level := fs.String("log.level", "", "")
+	warnSampling := fs.Int("log.warning-sampling", 0, "")
+	limits := limiter.Config{}
+	fs.DurationVar(&limits.Window, "limiter.window", 0, "")
+	fs.IntVar(&limits.MaxTests, "limiter.max-tests", 0, "")
+	fs.IntVar(&limits.MaxConcurrent, "limiter.max-concurrent", 0, "")
+	fs.IntVar(&limits.IPv4PrefixLen, "limiter.ipv4-prefix", 0, "")
+	fs.IntVar(&limits.IPv6PrefixLen, "limiter.ipv6-prefix", 0, "")
+	fs.VisitAll(func(f *flag.Flag) {
+		startup := flag.CommandLine.Lookup(f.Name)
+		value := startup.DefValue
+		if _, ok := fixed[f.Name]; ok {
+			value = startup.Value.String()
+		}
+		if e := f.Value.Set(value); e != nil && err == nil {
+			err = e
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := cfg.Reapply(fs, fixed); err != nil {
+		return err
+	}
+	if lim == nil && (limits.MaxTests > 0 || limits.MaxConcurrent > 0) {
+		return errors.New("limits were disabled at startup, a restart is required to enable them")
+	}
+	if _, ok := fixed["label"]; !ok {
+		labels.Set(cfg.ServerMetadata())
+	}
+	// The level was validated by config.Load.
+	logging.SetLevel(*level)
+	logging.SetWarningSampling(*warnSampling)
+	lim.SetConfig(limits)
+	return nil
+}
+
+// jsonAccessLog opens the JSON access log selected by the -log.access-json
+// flag. It returns nil when the log is disabled.
+func jsonAccessLog() (*logging.JSONAccessLog, error) {
+	switch *logAccessJSON {
+	case "":
+		return nil, nil
+	case "-":
+		return logging.NewJSONAccessLog(os.Stdout), nil
+	}
+	return logging.OpenJSONAccessLog(*logAccessJSON)
+}
+
+// withAccessLogs wraps handler, protected by the access controllers of ac,
+// with the access logs. The JSON access log, if any, also records the requests
+// rejected by the access controllers.
+func withAccessLogs(accessLog *logging.JSONAccessLog, ac alice.Chain, handler http.Handler) http.Handler {
+	return accessLog.Handler(ac.Then(logging.AccessAdmitted(logging.MakeAccessLogHandler(handler))))
+}
+
+// ndt7Routes serves ndt7Mux, protected by the access controllers of ac, and
+// the results in store, protected only by the access controllers of acResult.
+// Both have the access logs. store may be nil when results are not retrievable.
+func ndt7Routes(accessLog *logging.JSONAccessLog, ac alice.Chain, ndt7Mux http.Handler, acResult alice.Chain, store *retrieval.Store) http.Handler {
+	if store == nil {
+		return withAccessLogs(accessLog, ac, ndt7Mux)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", withAccessLogs(accessLog, ac, ndt7Mux))
+	mux.Handle(spec.ResultURLPath, withAccessLogs(accessLog, acResult, store))
+	return mux
+}
+
+// resultSinks returns the sinks that receive the results of all tests, as
+// selected by the -results.* flags.
+func resultSinks() (*sink.Multi, error) {
+	results := sink.NewMulti()
+	if *resultsFile {
+		results.Add("file", sink.NewFile(*dataDir, sink.NDT5Layout(ndt5Layout.Value)))
+	}
+	switch *resultsNDJSON {
+	case "":
+	case "-":
+		results.Add("ndjson", sink.NewNDJSON(os.Stdout))
+	default:
+		results.Add("ndjson", sink.NewUnixNDJSON(*resultsNDJSON))
+	}
+	if *resultsWebhook != "" {
+		spool := *webhookSpool
+		if spool == "" {
+			spool = path.Join(*dataDir, sink.WebhookSpoolDir)
+		}
+		w, err := sink.NewWebhook(*resultsWebhook, spool, *webhookTimeout)
+		if err != nil {
+			return nil, err
+		}
+		results.Add("webhook", w)
+	}
+	return results, nil
+}
+
+// certPairs returns the certificate/key pairs given with the -cert and -key
+// flags.
+func certPairs() ([]certs.Pair, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("got %d -cert and %d -key flags, they must match", len(certFiles), len(keyFiles))
+	}
+	var pairs []certs.Pair
+	for i := range certFiles {
+		if certFiles[i] == "" || keyFiles[i] == "" {
+			continue
+		}
+		pairs = append(pairs, certs.Pair{CertFile: certFiles[i], KeyFile: keyFiles[i]})
 	}
+	return pairs, nil
 }
 
 func init() {
@@ -126,6 +360,17 @@ func httpServer(addr string, handler http.Handler) *http.Server {
 	}
 }
 
+// configureTLS sets up config to use the certificates from certManager and,
+// when clientCAs is not nil, to verify the client certificates against them.
+// The end of the handshake is recorded on the timeline of the connection.
+func configureTLS(config *tls.Config, certManager *certs.Manager, clientCAs *x509.CertPool) {
+	config.GetCertificate = certManager.GetCertificate
+	if clientCAs != nil {
+		certs.VerifyClientCerts(config, clientCAs)
+	}
+	netx.RecordTLSHandshake(config)
+}
+
 // parseDeploymentLabels() returns an array of key-value pairs of type
 // []metadata.NameValue with the deployment label pairs passed in through
 // the "label" flag.
@@ -153,8 +398,39 @@ func parseDeploymentLabels() []metadata.NameValue {
 func main() {
 	flag.Parse()
 	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not parse env args")
+	if *configValidate {
+		os.Exit(validateConfig(*configFile))
+	}
+	// Flags given on the command line or through the environment take
+	// precedence over the config file, also when it is reloaded.
+	fixedFlags := flagx.AssignedFlags(flag.CommandLine)
+	if *configFile != "" {
+		cfg, err := config.Load(*configFile)
+		rtx.Must(err, "Invalid config file")
+		rtx.Must(cfg.Apply(flag.CommandLine), "Could not apply config file")
+	}
+	rtx.Must(logging.SetLevel(*logLevel), "Invalid log level")
+	logging.SetWarningSampling(*logWarnSampling)
+	// Client addresses are anonymized with the method given by the
+	// -anonymize.ip flag, and then hashed if a key is given.
+	anonymize.SetDefault(anonymize.New(goanonymize.IPAnonymizationFlag, bytes.TrimSpace(anonymizeKey)))
+	measurer.Sampling = memoryless.Config{
+		Min:      *samplingMin,
+		Expected: *samplingExpected,
+		Max:      *samplingMax,
+	}
+	rtx.Must(measurer.Sampling.Check(), "Invalid ndt7 sampling intervals")
+	if *samplesInterval > 0 {
+		samples, err := measurer.NewSampleConfig(*samplesInterval, strings.Split(*samplesFields, ","))
+		rtx.Must(err, "Invalid ndt7 high resolution sampler")
+		measurer.HighResolution = samples
+	}
+
+	serverMetadata := metadata.NewLabels(parseDeploymentLabels())
 
-	serverMetadata := parseDeploymentLabels()
+	// Start without lame duck status. A previous run of main in the same
+	// process, e.g. in the unit tests, leaves its Drainer shut down.
+	lameduck.SetDefault(lameduck.New())
 
 	// TODO: Decide if signal handling is the right approach here.
 	go catchSigterm()
@@ -163,6 +439,7 @@ func main() {
 	defer promSrv.Close()
 
 	platformx.WarnIfNotFullySupported()
+	checker := health.New(*dataDir)
 
 	// Setup sequence of access control http.Handlers. NewVerifier errors are
 	// not fatal as long as tokens are not required. This allows access tokens
@@ -176,77 +453,281 @@ func main() {
 	// NDT5 uses a raw server, which requires tx5. NDT7 is HTTP only.
 	ac5, tx5 := controller.Setup(ctx, v, tokenRequired5, tokenMachine)
 	ac7, _ := controller.Setup(ctx, v, tokenRequired7, tokenMachine)
+	accessLog, err := jsonAccessLog()
+	rtx.Must(err, "Could not open the JSON access log")
+
+	// Per-client rate limits shared by the raw ndt5 and the ndt7 servers. The
+	// limiter is nil, and accepts all clients, when no limits are configured.
+	limits := limiter.Config{
+		Window:        *limitWindow,
+		MaxTests:      *limitMaxTests,
+		MaxConcurrent: *limitConcurrent,
+		IPv4PrefixLen: *limitIPv4Prefix,
+		IPv6PrefixLen: *limitIPv6Prefix,
+	}
+	lim := limiter.New(ctx, limits)
+
+	// Finish or set aside the result files that a crash left half-written,
+	// before any new results are written.
+	recovered, quarantined, err := safefile.Recover(*dataDir)
+	rtx.Must(err, "Could not recover result files")
+	if recovered > 0 || quarantined > 0 {
+		log.Printf("Recovered %d result files, quarantined %d incomplete result files", recovered, quarantined)
+	}
+
+	// Keep the data directory within its limits, and refuse new tests when the
+	// disk is critically full.
+	jan := janitor.New(*dataDir, janitor.Config{
+		MaxAge:       *janitorMaxAge,
+		MaxBytes:     *janitorMaxBytes,
+		MinFreeBytes: *janitorMinFree,
+		ArchiveDir:   *janitorArchiveDir,
+	})
+	janitor.SetDefault(jan)
+	go jan.Run(ctx, *janitorInterval)
+
+	// Sidecars may follow the measurement connections by their UUIDs.
+	if *eventSocket != "" {
+		ev := events.New(*eventSocket)
+		rtx.Must(ev.Listen(), "Could not listen on the event socket %s", *eventSocket)
+		defer ev.Close()
+		events.SetDefault(ev)
+	}
+
+	// Results are annotated with the network and location of the client.
+	var annotator *annotation.Annotator
+	if *annotationASNs != "" || *annotationGeo != "" {
+		annotator, err = annotation.New(annotation.Config{
+			ASNFile:    *annotationASNs,
+			GeoFile:    *annotationGeo,
+			Metrics:    *annotationMetrics,
+			MetricASNs: *annotationMaxASNs,
+		})
+		rtx.Must(err, "Could not load the annotation databases")
+		annotation.SetDefault(annotator)
+		go annotator.Watch(ctx, *annotationReload)
+	}
+
+	// All protocols write their results to the same sinks. The sinks are
+	// closed after running tests have been drained.
+	results, err := resultSinks()
+	rtx.Must(err, "Could not set up result sinks")
+	defer results.Close()
+	if results.Len() == 0 {
+		log.Println("WARNING: no result sinks are enabled, results will be discarded")
+	}
+	// The index summarizes all results for the admin search API. A new index
+	// is filled with the results already in the data directory.
+	var ix *index.Index
+	if *resultsIndex {
+		ix, err = index.Open(*dataDir)
+		rtx.Must(err, "Could not open the results index")
+		results.Add("index", ix)
+		if ix.Empty() {
+			go func() {
+				n, err := ix.Rebuild()
+				if err != nil {
+					log.Println("Could not rebuild the results index:", err)
+					return
+				}
+				log.Printf("Rebuilt the results index with %d entries", n)
+			}()
+		}
+	}
+	// Recent ndt7 results are kept in memory for clients to retrieve.
+	var store *retrieval.Store
+	if *retrievalSize > 0 {
+		store = retrieval.New(*retrievalSize, *retrievalTTL)
+		results.Add("retrieval", store)
+	}
+	// Hooks run after the result is written, so they receive its file.
+	runner := hooks.NewRunner(*hookTimeout, *hookConcurrent)
+	if fields := strings.Fields(*hookExec); len(fields) > 0 {
+		runner.Add("exec", &hooks.Exec{Command: fields[0], Args: fields[1:]})
+	}
+	if *hookSocket != "" {
+		runner.Add("socket", &hooks.Socket{Path: *hookSocket})
+	}
+	if runner.Len() > 0 {
+		results.Add("hooks", runner)
+	}
 
 	// The ndt5 protocol serving non-HTTP-based tests - forwards to Ws-based
 	// server if the first three bytes are "GET".
-	ndt5Server := plain.NewServer(*dataDir+"/ndt5", *ndt5WsAddr, serverMetadata)
+	ndt5Server := plain.NewServer(results, *ndt5WsAddr, serverMetadata, lim)
 	rtx.Must(
 		ndt5Server.ListenAndServe(ctx, *ndt5Addr, tx5),
 		"Could not start raw server")
+	checker.AddListener("ndt5", ndt5Server.Addr().String())
 
 	// The ndt5 protocol serving Ws-based tests. Most clients are hard-coded to
 	// connect to the raw server, which will forward things along.
 	ndt5WsMux := http.NewServeMux()
 	ndt5WsMux.Handle("/", http.FileServer(http.Dir(*htmlDir)))
-	ndt5WsMux.Handle("/ndt_protocol", ndt5handler.NewWS(*dataDir+"/ndt5", serverMetadata))
+	ndt5WsMux.Handle("/ndt_protocol", ndt5handler.NewWS(results, serverMetadata))
 	controller.AllowPathLabel("/ndt_protocol")
 	ndt5WsServer := httpServer(
 		*ndt5WsAddr,
 		// NOTE: do not use `ac.Then()` to prevent 'double jeopardy' for
 		// forwarded clients when txcontroller is enabled.
-		logging.MakeAccessLogHandler(ndt5WsMux),
+		withAccessLogs(accessLog, alice.New(), ndt5WsMux),
 	)
 	log.Println("About to listen for unencrypted ndt5 NDT tests on " + *ndt5WsAddr)
 	rtx.Must(listener.ListenAndServeAsync(ndt5WsServer), "Could not start unencrypted ndt5 NDT server")
 	defer ndt5WsServer.Close()
+	servers := []*http.Server{ndt5WsServer}
+	checker.AddListener("ndt5_ws", ndt5WsServer.Addr)
 
 	// The ndt7 listener serving up NDT7 tests, likely on standard ports.
 	ndt7Mux := http.NewServeMux()
 	ndt7Mux.Handle("/", http.FileServer(http.Dir(*htmlDir)))
 	ndt7Handler := &handler.Handler{
-		DataDir:        *dataDir,
+		Results:        results,
 		SecurePort:     *ndt7Addr,
 		InsecurePort:   *ndt7AddrCleartext,
 		ServerMetadata: serverMetadata,
+		Limiter:        lim,
+		Retrieval:      store,
 	}
 	ndt7Mux.Handle(spec.DownloadURLPath, http.HandlerFunc(ndt7Handler.Download))
 	ndt7Mux.Handle(spec.UploadURLPath, http.HandlerFunc(ndt7Handler.Upload))
 	controller.AllowPathLabel(spec.DownloadURLPath)
 	controller.AllowPathLabel(spec.UploadURLPath)
+	// Results are retrieved with the one-time secret of the test, so the
+	// result path accepts clients without access tokens or client
+	// certificates.
+	acResult, _ := controller.Setup(ctx, v, false, tokenMachine)
 	ndt7ServerCleartext := httpServer(
 		*ndt7AddrCleartext,
-		ac7.Then(logging.MakeAccessLogHandler(ndt7Mux)),
+		ndt7Routes(accessLog, ac7, ndt7Mux, acResult, store),
 	)
 	log.Println("About to listen for ndt7 cleartext tests on " + *ndt7AddrCleartext)
 	rtx.Must(listener.ListenAndServeAsync(ndt7ServerCleartext), "Could not start ndt7 cleartext server")
 	defer ndt7ServerCleartext.Close()
+	servers = append(servers, ndt7ServerCleartext)
+	checker.AddListener("ndt7_cleartext", ndt7ServerCleartext.Addr)
 
 	// Only start TLS-based services if certs and keys are provided
-	if *certFile != "" && *keyFile != "" {
+	pairs, err := certPairs()
+	rtx.Must(err, "Invalid -cert and -key flags")
+	var certManager *certs.Manager
+	if len(pairs) > 0 {
+		// One certificate manager provides the certificates for all TLS
+		// listeners, and reloads them when the files change or on SIGHUP.
+		certManager, err = certs.NewManager(pairs)
+		rtx.Must(err, "Could not load certificates")
+		go certManager.Watch(ctx, *certReload)
+
+		// With client certificates, verified certificates replace access
+		// tokens on the TLS listeners and the other access controllers still
+		// apply. The result path does not require a certificate.
+		ac5TLS, ac7TLS := ac5, ac7
+		var clientCAs *x509.CertPool
+		if *clientCAFile != "" {
+			clientCAs, err = certs.LoadClientCAs(*clientCAFile)
+			rtx.Must(err, "Could not load client CA certificates")
+			ac5TLS = alice.New(certs.ClientCertController{}.Limit).Extend(acResult)
+			ac7TLS = ac5TLS
+		}
+
 		// The ndt5 protocol serving WsS-based tests.
 		ndt5WssMux := http.NewServeMux()
-		ndt5WssMux.Handle("/", http.FileServer(http.Dir(*htmlDir)))
-		ndt5WssMux.Handle("/ndt_protocol", ndt5handler.NewWSS(*dataDir+"/ndt5", *certFile, *keyFile, serverMetadata))
 		ndt5WssServer := httpServer(
 			*ndt5WssAddr,
-			ac5.Then(logging.MakeAccessLogHandler(ndt5WssMux)),
+			withAccessLogs(accessLog, ac5TLS, ndt5WssMux),
 		)
+		configureTLS(ndt5WssServer.TLSConfig, certManager, clientCAs)
+		ndt5WssMux.Handle("/", http.FileServer(http.Dir(*htmlDir)))
+		ndt5WssMux.Handle("/ndt_protocol", ndt5handler.NewWSS(results, ndt5WssServer.TLSConfig, serverMetadata))
 		log.Println("About to listen for ndt5 WsS tests on " + *ndt5WssAddr)
-		rtx.Must(listener.ListenAndServeTLSAsync(ndt5WssServer, *certFile, *keyFile), "Could not start ndt5 WsS server")
+		rtx.Must(listener.ListenAndServeTLSAsync(ndt5WssServer, "", ""), "Could not start ndt5 WsS server")
 		defer ndt5WssServer.Close()
+		servers = append(servers, ndt5WssServer)
+		checker.AddListener("ndt5_wss", ndt5WssServer.Addr)
 
 		// The ndt7 listener serving up WSS based tests
 		ndt7Server := httpServer(
 			*ndt7Addr,
-			ac7.Then(logging.MakeAccessLogHandler(ndt7Mux)),
+			ndt7Routes(accessLog, ac7TLS, ndt7Mux, acResult, store),
 		)
+		configureTLS(ndt7Server.TLSConfig, certManager, clientCAs)
 		log.Println("About to listen for ndt7 tests on " + *ndt7Addr)
-		rtx.Must(listener.ListenAndServeTLSAsync(ndt7Server, *certFile, *keyFile), "Could not start ndt7 server")
+		rtx.Must(listener.ListenAndServeTLSAsync(ndt7Server, "", ""), "Could not start ndt7 server")
 		defer ndt7Server.Close()
+		servers = append(servers, ndt7Server)
+		checker.AddListener("ndt7", ndt7Server.Addr)
 	} else {
-		log.Printf("Cert=%q and Key=%q means no TLS services will be started.\n", *certFile, *keyFile)
+		log.Printf("Cert=%q and Key=%q means no TLS services will be started.\n", certFiles, keyFiles)
+	}
+
+	// Reload certificates, annotation databases and the safe settings of the
+	// config file on SIGHUP.
+	go catchSighup(func() {
+		if certManager != nil {
+			if err := certManager.Reload(); err != nil {
+				log.Println("Could not reload certificates:", err)
+			}
+		}
+		if annotator != nil {
+			if err := annotator.Reload(); err != nil {
+				log.Println("Could not reload annotation databases:", err)
+			}
+		}
+		// Follow the JSON access log file when it is rotated.
+		if err := accessLog.Reopen(); err != nil {
+			log.Println("Could not reopen the JSON access log:", err)
+		}
+		if *configFile != "" {
+			if err := reloadConfig(fixedFlags, serverMetadata, lim); err != nil {
+				log.Println("Could not reload config file:", err)
+			} else {
+				log.Println("Reloaded config file", *configFile)
+			}
+		}
+	})
+
+	// Health probes and lame duck control, for orchestrators and rollout tools.
+	if *adminAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.HandleFunc("/healthz", checker.Healthz)
+		adminMux.HandleFunc("/readyz", checker.Readyz)
+		adminMux.Handle("/lameduck", health.LameDuckHandler(adminToken))
+		if ix != nil {
+			adminMux.Handle("/results/search", health.Authorize(adminToken, http.HandlerFunc(ix.SearchHandler)))
+			adminMux.Handle("/results/rebuild", health.Authorize(adminToken, http.HandlerFunc(ix.RebuildHandler)))
+		}
+		adminServer := httpServer(*adminAddr, withAccessLogs(accessLog, alice.New(), adminMux))
+		log.Println("About to listen for health probes on " + *adminAddr)
+		rtx.Must(listener.ListenAndServeAsync(adminServer), "Could not start admin server")
+		defer adminServer.Close()
 	}
 
 	// Serve until the context is canceled.
 	<-ctx.Done()
+	checker.StopListeners()
+	shutdown(servers)
+	if err := accessLog.Close(); err != nil {
+		log.Println("Could not close the JSON access log:", err)
+	}
+}
+
+// shutdown refuses new tests and waits up to the shutdown deadline for running
+// tests to complete. Tests still running at the deadline are interrupted, and
+// save their results with a shutdown error, before the servers are shut down.
+func shutdown(servers []*http.Server) {
+	log.Printf("Shutting down: waiting up to %s for %d running tests", *shutdownDeadline, lameduck.Active())
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), *shutdownDeadline)
+	defer drainCancel()
+	if n := lameduck.Shutdown(drainCtx); n > 0 {
+		log.Printf("Interrupted %d tests at the shutdown deadline", n)
+	}
+	// Hijacked websocket connections are not tracked by http.Server.Shutdown,
+	// so this only waits for regular requests, e.g. static file downloads.
+	closeCtx, closeCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer closeCancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(closeCtx); err != nil {
+			log.Println("Could not shut down server", srv.Addr, err)
+		}
+	}
 }
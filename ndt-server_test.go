@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"io/ioutil"
 	"log"
@@ -15,13 +16,20 @@ import (
 	"testing"
 	"time"
 
+	"github.com/m-lab/access/controller"
 	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/osx"
 	"github.com/m-lab/go/prometheusx/promtest"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/limiter"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metadata"
+	"github.com/m-lab/ndt-server/ndt7/retrieval"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/sink"
 	"go.uber.org/goleak"
 	"gopkg.in/m-lab/pipe.v3"
+	"gopkg.in/square/go-jose.v2/jwt"
 )
 
 // Get a bunch of open ports, and then close them. Hopefully the ports will
@@ -377,6 +385,101 @@ func Test_ParseDeploymentLabels(t *testing.T) {
 	}
 }
 
+func Test_reloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "Test_reloadConfig")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ndt-server.json")
+	rtx.Must(ioutil.WriteFile(file, []byte(`{
+  "labels": {"deployment": "file"},
+  "limits": {"max_tests": 5}
+}`), 0644), "Could not write config")
+	defer func(old string) { *configFile = old }(*configFile)
+	*configFile = file
+
+	flagLabels := []metadata.NameValue{{Name: "deployment", Value: "flag"}}
+	labels := metadata.NewLabels(flagLabels)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lim := limiter.New(ctx, limiter.Config{MaxTests: 1, Window: time.Minute})
+
+	// Labels given on the command line take precedence over the file.
+	fixed := map[string]struct{}{"label": {}}
+	rtx.Must(reloadConfig(fixed, labels, lim), "Could not reload config")
+	if got := labels.Get(); !reflect.DeepEqual(got, flagLabels) {
+		t.Errorf("labels = %v, want %v from the command line", got, flagLabels)
+	}
+
+	// Otherwise the file wins.
+	rtx.Must(reloadConfig(nil, labels, lim), "Could not reload config")
+	if got := labels.Get(); len(got) != 1 || got[0].Value != "file" {
+		t.Errorf("labels = %v, want the labels from the file", got)
+	}
+
+	// Limits cannot be enabled without a restart.
+	if err := reloadConfig(nil, labels, nil); err == nil {
+		t.Error("reloadConfig() should fail to enable limits disabled at startup")
+	}
+
+	// Settings removed from the file go back to their defaults, not to the
+	// values that the file had at startup, unless they are fixed.
+	rtx.Must(ioutil.WriteFile(file, []byte(`{}`), 0644), "Could not write config")
+	defer func(old int) { *limitMaxTests = old }(*limitMaxTests)
+	*limitMaxTests = 5
+	rtx.Must(reloadConfig(nil, labels, nil), "Could not reload config")
+	if got := labels.Get(); len(got) != 0 {
+		t.Errorf("labels = %v, want none", got)
+	}
+	fixed = map[string]struct{}{"limiter.max-tests": {}}
+	if err := reloadConfig(fixed, labels, nil); err == nil {
+		t.Error("reloadConfig() should keep the fixed limits")
+	}
+}
+
+// rejectVerifier rejects all access tokens.
+type rejectVerifier struct{}
+
+func (*rejectVerifier) Verify(token string, exp jwt.Expected) (*jwt.Claims, error) {
+	return nil, jwt.ErrExpired
+}
+
+func Test_ndt7Routes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Tokens are required for the tests, but not for the results.
+	ac, _ := controller.Setup(ctx, &rejectVerifier{}, true, "mlab1.example")
+	acResult, _ := controller.Setup(ctx, &rejectVerifier{}, false, "mlab1.example")
+	store := retrieval.New(10, time.Minute)
+	secret, err := store.Grant("abc", "")
+	rtx.Must(err, "Could not grant access")
+	rtx.Must(store.Write(&sink.Result{Protocol: "ndt7", UUID: "abc", Data: 1}), "Could not write result")
+	buf := &bytes.Buffer{}
+	h := ndt7Routes(logging.NewJSONAccessLog(buf), ac, http.NewServeMux(), acResult, store)
+
+	tests := []struct {
+		name string
+		url  string
+		want int
+	}{
+		{name: "download", url: spec.DownloadURLPath, want: http.StatusUnauthorized},
+		{name: "result", url: spec.ResultURLPath + "abc?secret=" + secret, want: http.StatusOK},
+		{name: "result-used", url: spec.ResultURLPath + "abc?secret=" + secret, want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rw.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.url, rw.Code, tt.want)
+			}
+			if buf.Len() == 0 {
+				t.Errorf("GET %s was not in the JSON access log", tt.url)
+			}
+		})
+	}
+}
+
 func sortNameValueSlice(nv []metadata.NameValue) {
 	sort.Slice(nv, func(i, j int) bool {
 		return nv[i].Name < nv[j].Name
@@ -2,15 +2,17 @@ package c2s
 
 import (
 	"context"
-	"log"
 	"strconv"
 	"time"
 
 	"github.com/m-lab/go/warnonerror"
+	"github.com/m-lab/ndt-server/events"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/ndt5/metrics"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
 	"github.com/m-lab/ndt-server/ndt5/web100"
+	"github.com/m-lab/ndt-server/timeline"
 )
 
 // ArchivalData is the data saved by the C2S test. If a researcher wants deeper
@@ -46,27 +48,30 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 		}
 	}()
 	record = &ArchivalData{}
+	logger := logging.FromContext(ctx).WithField("subtest", "c2s")
 
 	m := controlConn.Messager()
 	connType := s.ConnectionType().Label()
 
 	srv, err := s.SingleServingServer("c2s")
 	if err != nil {
-		log.Println("Could not start SingleServingServer", err)
+		logger.WithError(err).Warn("c2s: could not start SingleServingServer")
 		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "StartSingleServingServer").Inc()
 		return record, err
 	}
 
 	err = m.SendMessage(protocol.TestPrepare, []byte(strconv.Itoa(srv.Port())))
 	if err != nil {
-		log.Println("Could not send TestPrepare", err)
+		logger.WithError(err).Warn("c2s: could not send TestPrepare")
 		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "TestPrepare").Inc()
 		return record, err
 	}
+	rec := timeline.FromContext(ctx)
+	rec.Mark("c2s-test-prepare")
 
 	testConn, err := srv.ServeOnce(localContext)
 	if err != nil {
-		log.Println("Could not successfully ServeOnce", err)
+		logger.WithError(err).Warn("c2s: could not successfully ServeOnce")
 		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "ServeOnce").Inc()
 		return record, err
 	}
@@ -82,55 +87,61 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 		}()
 	}()
 
+	rec.Mark("c2s-accept")
 	record.UUID = testConn.UUID()
+	logger = logger.WithField("subtest_uuid", record.UUID)
 	record.ServerIP, record.ServerPort = testConn.ServerIPAndPort()
 	record.ClientIP, record.ClientPort = testConn.ClientIPAndPort()
+	events.Open(record.UUID, events.SockID(record.ServerIP, record.ServerPort, record.ClientIP, record.ClientPort))
+	defer events.Closed(record.UUID)
 
 	err = m.SendMessage(protocol.TestStart, []byte{})
 	if err != nil {
-		log.Println("Could not send TestStart", err, record.UUID)
+		logger.WithError(err).Warn("c2s: could not send TestStart")
 		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "TestStart").Inc()
 		return record, err
 	}
+	rec.Mark("c2s-test-start")
 
 	record.StartTime = time.Now()
-	web100Metrics, err := drainForeverButMeasureFor(ctx, testConn, 10*time.Second)
+	web100Metrics, err := drainForeverButMeasureFor(logging.NewContext(ctx, logger), testConn, 10*time.Second)
 	record.EndTime = time.Now()
 	seconds := record.EndTime.Sub(record.StartTime).Seconds()
-	log.Println("Ended C2S test on", testConn, record.UUID)
+	logger.WithField("conn", testConn.String()).Debug("c2s: ended test")
 	if err != nil {
 		if web100Metrics.TCPInfo.BytesReceived == 0 {
-			log.Println("Could not drain the test connection", err, record.UUID)
+			logger.WithError(err).Warn("c2s: could not drain the test connection")
 			metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "Drain").Inc()
 			return record, err
 		}
 		// It is possible for the client to reach 10 seconds slightly before the server does.
 		if seconds < 9 {
-			log.Printf("C2S test client only uploaded for %f seconds  %s\n", seconds, record.UUID)
+			logger.WithField("seconds", seconds).Warn("c2s: client stopped uploading early")
 			metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "EarlyExit").Inc()
 			return record, err
 		}
 		// More than 9 seconds is fine.
-		log.Printf("C2S test had an error (%v) after %f seconds. We will continue with the test.\n", err, seconds)
+		logger.WithError(err).WithField("seconds", seconds).Info("c2s: test had an error, but ran long enough to continue")
 	}
 
 	throughputValue := 8 * float64(web100Metrics.TCPInfo.BytesReceived) / 1000 / seconds
 	record.MeanThroughputMbps = throughputValue / 1000 // Convert Kbps to Mbps
 
-	log.Println(controlConn, "sent us", throughputValue, "Kbps")
+	logger.WithField("kbps", throughputValue).Info("c2s: measured upload rate")
 	err = m.SendMessage(protocol.TestMsg, []byte(strconv.FormatInt(int64(throughputValue), 10)))
 	if err != nil {
-		log.Println("Could not send TestMsg with C2S results", err, record.UUID)
+		logger.WithError(err).Warn("c2s: could not send TestMsg with the results")
 		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "TestMsg").Inc()
 		return record, err
 	}
 
 	err = m.SendMessage(protocol.TestFinalize, []byte{})
 	if err != nil {
-		log.Println("Could not send TestFinalize", err, record.UUID)
+		logger.WithError(err).Warn("c2s: could not send TestFinalize")
 		metrics.ClientTestErrors.WithLabelValues(connType, "c2s", "TestFinalize").Inc()
 		return record, err
 	}
+	rec.Mark("c2s-test-finalize")
 
 	return record, nil
 }
@@ -140,6 +151,7 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 // not close the passed-in Connection, and starts a goroutine which runs until
 // that Connection is closed.
 func drainForeverButMeasureFor(ctx context.Context, conn protocol.MeasuredConnection, d time.Duration) (*web100.Metrics, error) {
+	logger := logging.FromContext(ctx)
 	derivedCtx, derivedCancel := context.WithTimeout(ctx, d)
 	defer derivedCancel()
 
@@ -162,10 +174,10 @@ func drainForeverButMeasureFor(ctx context.Context, conn protocol.MeasuredConnec
 	var err error
 	select {
 	case <-derivedCtx.Done(): // Wait for timeout
-		log.Println("Timed out")
+		logger.Debug("c2s: measurement timed out")
 		socketStats, err = conn.StopMeasuring()
 	case err = <-errs: // Error in c2s transfer
-		log.Println("C2S error:", err)
+		logger.WithError(err).Debug("c2s: transfer ended")
 		socketStats, _ = conn.StopMeasuring()
 	}
 	if socketStats == nil {
@@ -13,4 +13,8 @@ type ArchivalData struct {
 	MessageProtocol string
 	ClientMetadata  []metadata.NameValue `json:",omitempty"`
 	ServerMetadata  []metadata.NameValue `json:",omitempty"`
+	Error           string               `json:",omitempty"`
+	// ClientCertificateSubject is the subject of the verified client
+	// certificate, when client certificates are required.
+	ClientCertificateSubject string `json:",omitempty"`
 }
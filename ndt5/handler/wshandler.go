@@ -1,19 +1,24 @@
 package handler
 
 import (
+	"crypto/tls"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 
 	"github.com/m-lab/access/controller"
 	"github.com/m-lab/go/warnonerror"
+	"github.com/m-lab/ndt-server/certs"
+	"github.com/m-lab/ndt-server/janitor"
+	"github.com/m-lab/ndt-server/lameduck"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metadata"
 	"github.com/m-lab/ndt-server/ndt5"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
 	"github.com/m-lab/ndt-server/ndt5/singleserving"
 	"github.com/m-lab/ndt-server/ndt5/ws"
+	"github.com/m-lab/ndt-server/sink"
 )
 
 // WSHandler is both an ndt.Server and an http.Handler to allow websocket-based
@@ -34,13 +39,13 @@ func (hf *httpFactory) SingleServingServer(dir string) (ndt.SingleMeasurementSer
 type httpHandler struct {
 	serverFactory  ndt.SingleMeasurementServerFactory
 	connectionType ndt.ConnectionType
-	datadir        string
-	metadata       []metadata.NameValue
+	results        sink.ResultSink
+	metadata       *metadata.Labels
 }
 
-func (s *httpHandler) DataDir() string                    { return s.datadir }
+func (s *httpHandler) ResultSink() sink.ResultSink        { return s.results }
 func (s *httpHandler) ConnectionType() ndt.ConnectionType { return s.connectionType }
-func (s *httpHandler) Metadata() []metadata.NameValue     { return s.metadata }
+func (s *httpHandler) Metadata() []metadata.NameValue     { return s.metadata.Get() }
 
 func (s *httpHandler) LoginCeremony(conn protocol.Connection) (int, error) {
 	// WS and WSS both only support JSON clients and not TLV clients.
@@ -61,46 +66,58 @@ func (s *httpHandler) SingleServingServer(dir string) (ndt.SingleMeasurementServ
 // an unrecoverable error. It is called ServeHTTP to make sure that the Server
 // implements the http.Handler interface.
 func (s *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if lameduck.LameDuck() {
+		// 503 - https://tools.ietf.org/html/rfc7231#section-6.6.4
+		w.Header().Set("Connection", "Close")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if janitor.Admit() != nil {
+		// 507 - https://tools.ietf.org/html/rfc4918#section-11.5
+		w.Header().Set("Connection", "Close")
+		w.WriteHeader(http.StatusInsufficientStorage)
+		return
+	}
 	upgrader := ws.Upgrader("ndt")
 	wsc, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("ERROR SERVER:", err)
+		logging.Logger.WithError(err).Warn("wshandler: could not upgrade to WebSockets")
 		return
 	}
 	ws := protocol.AdaptWsConn(wsc)
 	defer warnonerror.Close(ws, "Could not close connection")
 	isMon := fmt.Sprintf("%t", controller.IsMonitoring(controller.GetClaim(r.Context())))
-	ndt5.HandleControlChannel(ws, s, isMon)
+	ndt5.HandleControlChannel(ws, s, isMon, certs.GetSubject(r.Context()))
 }
 
-// NewWS returns a handler suitable for http-based connections.
-func NewWS(datadir string, metadata []metadata.NameValue) WSHandler {
+// NewWS returns a handler suitable for http-based connections. Results are
+// written to results.
+func NewWS(results sink.ResultSink, metadata *metadata.Labels) WSHandler {
 	return &httpHandler{
 		serverFactory:  &httpFactory{},
 		connectionType: ndt.WS,
-		datadir:        datadir,
+		results:        results,
 		metadata:       metadata,
 	}
 }
 
 type httpsFactory struct {
-	certFile string
-	keyFile  string
+	config *tls.Config
 }
 
 func (hf *httpsFactory) SingleServingServer(dir string) (ndt.SingleMeasurementServer, error) {
-	return singleserving.ListenWSS(dir, hf.certFile, hf.keyFile)
+	return singleserving.ListenWSS(dir, hf.config)
 }
 
-// NewWSS returns a handler suitable for https-based connections.
-func NewWSS(datadir, certFile, keyFile string, metadata []metadata.NameValue) WSHandler {
+// NewWSS returns a handler suitable for https-based connections. The
+// single-serving test servers use config for their certificates.
+func NewWSS(results sink.ResultSink, config *tls.Config, metadata *metadata.Labels) WSHandler {
 	return &httpHandler{
 		serverFactory: &httpsFactory{
-			certFile: certFile,
-			keyFile:  keyFile,
+			config: config,
 		},
 		connectionType: ndt.WSS,
-		datadir:        datadir,
+		results:        results,
 		metadata:       metadata,
 	}
 }
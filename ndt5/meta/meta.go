@@ -2,10 +2,10 @@ package meta
 
 import (
 	"context"
-	"log"
 	"strings"
 	"time"
 
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metadata"
 	"github.com/m-lab/ndt-server/ndt5/metrics"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
@@ -27,16 +27,17 @@ func ManageTest(ctx context.Context, m protocol.Messager, s ndt.Server) ([]metad
 	var message []byte
 	results := []metadata.NameValue{}
 	connType := s.ConnectionType().Label()
+	logger := logging.FromContext(ctx).WithField("subtest", "meta")
 
 	err = m.SendMessage(protocol.TestPrepare, []byte{})
 	if err != nil {
-		log.Println("META TestPrepare:", err)
+		logger.WithError(err).Warn("meta: could not send TestPrepare")
 		metrics.ClientTestErrors.WithLabelValues(connType, "meta", "TestPrepare").Inc()
 		return nil, err
 	}
 	err = m.SendMessage(protocol.TestStart, []byte{})
 	if err != nil {
-		log.Println("META TestStart:", err)
+		logger.WithError(err).Warn("meta: could not send TestStart")
 		metrics.ClientTestErrors.WithLabelValues(connType, "meta", "TestStart").Inc()
 		return nil, err
 	}
@@ -63,12 +64,12 @@ func ManageTest(ctx context.Context, m protocol.Messager, s ndt.Server) ([]metad
 		results = append(results, metadata.NameValue{Name: name, Value: value})
 	}
 	if localCtx.Err() != nil {
-		log.Println("META context error:", localCtx.Err())
+		logger.WithError(localCtx.Err()).Warn("meta: context error")
 		metrics.ClientTestErrors.WithLabelValues(connType, "meta", "context").Inc()
 		return nil, localCtx.Err()
 	}
 	if err != nil {
-		log.Println("Error reading JSON message:", err)
+		logger.WithError(err).Warn("meta: could not read TestMsg")
 		metrics.ClientTestErrors.WithLabelValues(connType, "meta", "ReceiveMessage").Inc()
 		return nil, err
 	}
@@ -76,7 +77,7 @@ func ManageTest(ctx context.Context, m protocol.Messager, s ndt.Server) ([]metad
 	metrics.SubmittedMetaValues.Observe(float64(count))
 	err = m.SendMessage(protocol.TestFinalize, []byte{})
 	if err != nil {
-		log.Println("META TestFinalize:", err)
+		logger.WithError(err).Warn("meta: could not send TestFinalize")
 		metrics.ClientTestErrors.WithLabelValues(connType, "meta", "TestFinalize").Inc()
 		return nil, err
 	}
@@ -9,6 +9,7 @@ import (
 	"github.com/m-lab/ndt-server/metadata"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/sink"
 )
 
 type sendMessage struct {
@@ -32,8 +33,8 @@ func (s *fakeServer) SingleServingServer(direction string) (ndt.SingleMeasuremen
 func (s *fakeServer) ConnectionType() ndt.ConnectionType {
 	return ndt.Plain
 }
-func (s *fakeServer) DataDir() string {
-	return ""
+func (s *fakeServer) ResultSink() sink.ResultSink {
+	return nil
 }
 func (s *fakeServer) Metadata() []metadata.NameValue {
 	return []metadata.NameValue{}
@@ -2,11 +2,7 @@ package ndt5
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"log"
-	"os"
-	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -18,7 +14,12 @@ import (
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/warnonerror"
 
+	"github.com/m-lab/ndt-server/annotation"
 	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/events"
+	"github.com/m-lab/ndt-server/janitor"
+	"github.com/m-lab/ndt-server/lameduck"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metrics"
 	"github.com/m-lab/ndt-server/ndt5/c2s"
 	"github.com/m-lab/ndt-server/ndt5/meta"
@@ -26,6 +27,9 @@ import (
 	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
 	"github.com/m-lab/ndt-server/ndt5/s2c"
+	"github.com/m-lab/ndt-server/netx"
+	"github.com/m-lab/ndt-server/sink"
+	"github.com/m-lab/ndt-server/timeline"
 )
 
 const (
@@ -37,31 +41,22 @@ const (
 	cTestMETA   = 32
 )
 
-// SaveData archives the data to disk.
-func SaveData(record *data.NDT5Result, datadir string) {
+// SaveData archives the record with the result sink of the server.
+func SaveData(record *data.NDT5Result, results sink.ResultSink) {
 	if record == nil {
-		log.Println("nil record won't be saved")
+		logging.Logger.Warn("ndt5: nil record won't be saved")
 		return
 	}
-	dir := path.Join(datadir, record.StartTime.Format("2006/01/02"))
-	err := os.MkdirAll(dir, 0777)
+	err := results.Write(&sink.Result{
+		Protocol:  "ndt5",
+		UUID:      record.Control.UUID,
+		StartTime: record.StartTime,
+		Data:      record,
+	})
 	if err != nil {
-		log.Printf("Could not create directory %s: %v\n", dir, err)
-		return
+		logging.ForTest(record.Control.Protocol.Label(), record.Control.UUID).WithError(err).Warn(
+			"ndt5: could not save result")
 	}
-	file, err := protocol.UUIDToFile(dir, record.Control.UUID)
-	if err != nil {
-		log.Println("Could not open file:", err)
-		return
-	}
-	defer file.Close()
-	enc := json.NewEncoder(file)
-	err = enc.Encode(record)
-	if err != nil {
-		log.Println("ERROR: Could not encode", record, "to", file.Name(), "err:", err)
-		return
-	}
-	log.Println("Wrote", file.Name())
 }
 
 func panicMsgToErrType(msg string) string {
@@ -91,9 +86,34 @@ func panicMsgToErrType(msg string) string {
 // to run every test, and to never need to know whether the underlying
 // connection is just a TCP socket, a WS connection, or a WSS connection. It
 // only needs a connection, and a factory for making single-use servers for
-// connections of that same type.
-func HandleControlChannel(conn protocol.Connection, s ndt.Server, isMon string) {
+// connections of that same type. The subject of the verified client
+// certificate, if any, is recorded in the archival data.
+func HandleControlChannel(conn protocol.Connection, s ndt.Server, isMon, subject string) {
 	connType := s.ConnectionType().Label()
+	// Refuse new tests when their results could not be saved.
+	if err := janitor.Admit(); err != nil {
+		logging.Logger.WithError(err).WithField("conn", conn.String()).Debug("ndt5: refusing test")
+		ndt5metrics.ControlCount.WithLabelValues(connType, "disk-full").Inc()
+		return
+	}
+	// Refuse new tests while the server is in lame duck mode.
+	test, err := lameduck.Begin(context.Background())
+	if err != nil {
+		logging.Logger.WithError(err).WithField("conn", conn.String()).Debug("ndt5: refusing test")
+		ndt5metrics.ControlCount.WithLabelValues(connType, "lame-duck").Inc()
+		return
+	}
+	defer test.Done()
+	// Every log entry of the test has its protocol and UUID.
+	logger := logging.ForTest(connType, conn.UUID())
+	// If the test is interrupted by a server shutdown, close the control
+	// channel so that any pending reads or writes fail promptly.
+	go func() {
+		<-test.Context().Done()
+		if test.Err() != nil {
+			conn.Close()
+		}
+	}()
 	metrics.ActiveTests.WithLabelValues(connType).Inc()
 	defer metrics.ActiveTests.WithLabelValues(connType).Dec()
 	defer func(start time.Time) {
@@ -104,7 +124,7 @@ func HandleControlChannel(conn protocol.Connection, s ndt.Server, isMon string)
 		completed := "okay"
 		r := recover()
 		if r != nil {
-			log.Println("Test failed, but we recovered:", r)
+			logger.WithField("panic", fmt.Sprint(r)).Warn("ndt5: test failed, but we recovered")
 			// All of our panic messages begin with an informative first word.  Use that as a label.
 			errType := panicMsgToErrType(fmt.Sprint(r))
 			ndt5metrics.ControlPanicCount.WithLabelValues(connType, errType).Inc()
@@ -112,16 +132,17 @@ func HandleControlChannel(conn protocol.Connection, s ndt.Server, isMon string)
 		}
 		ndt5metrics.ControlCount.WithLabelValues(connType, completed).Inc()
 	}()
-	handleControlChannel(conn, s, isMon)
+	handleControlChannel(logging.NewContext(test.Context(), logger), test, conn, s, isMon, subject)
 }
 
-func handleControlChannel(conn protocol.Connection, s ndt.Server, isMon string) {
+func handleControlChannel(ctx context.Context, test *lameduck.Test, conn protocol.Connection, s ndt.Server, isMon, subject string) {
 	// Nothing should take more than 45 seconds, and exiting this method should
 	// cause all resources used by the test to be reclaimed.
-	ctx, cancel := context.WithTimeout(context.Background(), 45*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 45*time.Second)
 	defer cancel()
+	logger := logging.FromContext(ctx)
 
-	log.Println("Handling connection", conn)
+	logger.WithField("conn", conn.String()).Info("ndt5: handling connection")
 	defer warnonerror.Close(conn, "Could not close "+conn.String())
 	connType := s.ConnectionType().Label()
 	sIP, sPort := conn.ServerIPAndPort()
@@ -129,20 +150,38 @@ func handleControlChannel(conn protocol.Connection, s ndt.Server, isMon string)
 	record := &data.NDT5Result{
 		GitShortCommit: prometheusx.GitShortCommit,
 		Version:        version.Version,
+		SchemaVersion:  data.SchemaVersion,
 		StartTime:      time.Now(),
 		Control: &control.ArchivalData{
-			UUID:           conn.UUID(),
-			Protocol:       s.ConnectionType(),
-			ServerMetadata: s.Metadata(),
+			UUID:                     conn.UUID(),
+			Protocol:                 s.ConnectionType(),
+			ServerMetadata:           s.Metadata(),
+			ClientCertificateSubject: subject,
 		},
 		ServerIP:   sIP,
 		ServerPort: sPort,
 		ClientIP:   cIP,
 		ClientPort: cPort,
 	}
+	if addr := netx.ToTCPAddr(conn.ClientAddr()); addr != nil {
+		record.ClientAnnotation = annotation.Annotate("ndt5", addr.IP)
+	}
+	// The timeline of the control connection also records the steps of the
+	// subtests, which find it in ctx.
+	rec := netx.ToTimeline(conn.ClientAddr())
+	if rec == nil {
+		rec = timeline.NewRecorder(record.StartTime)
+	}
+	ctx = timeline.NewContext(ctx, rec)
+	events.Open(record.Control.UUID, events.SockID(sIP, sPort, cIP, cPort))
+	defer events.Closed(record.Control.UUID)
 	defer func() {
 		record.EndTime = time.Now()
-		SaveData(record, s.DataDir())
+		record.Timeline = rec.Timeline()
+		if err := test.Err(); err != nil {
+			record.Control.Error = err.Error()
+		}
+		SaveData(record, s.ResultSink())
 	}()
 
 	tests, err := s.LoginCeremony(conn)
@@ -150,9 +189,10 @@ func handleControlChannel(conn protocol.Connection, s ndt.Server, isMon string)
 		ndt5metrics.ClientTestErrors.WithLabelValues(connType, "control", "LoginCeremony").Inc()
 	}
 	rtx.PanicOnError(err, "Login - error reading JSON message (uuid: %s)", record.Control.UUID)
+	rec.Mark("login")
 
 	if (tests & cTestStatus) == 0 {
-		log.Println("We don't support clients that don't support TestStatus")
+		logger.Info("ndt5: refusing client without TestStatus support")
 		ndt5metrics.ClientTestErrors.WithLabelValues(connType, "control", "TestStatus").Inc()
 		return
 	}
@@ -228,7 +268,7 @@ func handleControlChannel(conn protocol.Connection, s ndt.Server, isMon string)
 		rtx.PanicOnError(err, "META - Could not run meta test (uuid: %s)", record.Control.UUID)
 	}
 	speedMsg := fmt.Sprintf("You uploaded at %.4f and downloaded at %.4f", c2sRate*1000, s2cRate*1000)
-	log.Println(speedMsg)
+	logger.WithField("c2s_kbps", c2sRate*1000).WithField("s2c_kbps", s2cRate*1000).Info("ndt5: test complete")
 	// For historical reasons, clients expect results in kbps
 	rtx.PanicOnError(
 		m.SendMessage(protocol.MsgResults, []byte(speedMsg)),
@@ -5,13 +5,17 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/m-lab/ndt-server/anonymize"
+	"github.com/m-lab/ndt-server/lameduck"
+	"github.com/m-lab/ndt-server/limiter"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metadata"
 	"github.com/m-lab/ndt-server/ndt5"
 	ndt5metrics "github.com/m-lab/ndt-server/ndt5/metrics"
@@ -19,6 +23,7 @@ import (
 	"github.com/m-lab/ndt-server/ndt5/protocol"
 	"github.com/m-lab/ndt-server/ndt5/singleserving"
 	"github.com/m-lab/ndt-server/netx"
+	"github.com/m-lab/ndt-server/sink"
 )
 
 // plainServer handles requests that are TCP-based but not HTTP(S) based. If it
@@ -28,9 +33,10 @@ type plainServer struct {
 	wsAddr   string
 	dialer   *net.Dialer
 	listener *netx.Listener
-	datadir  string
+	results  sink.ResultSink
 	timeout  time.Duration
-	metadata []metadata.NameValue
+	metadata *metadata.Labels
+	limiter  *limiter.Limiter
 }
 
 func (ps *plainServer) SingleServingServer(direction string) (ndt.SingleMeasurementServer, error) {
@@ -56,7 +62,8 @@ func (ps *plainServer) sniffThenHandle(ctx context.Context, conn net.Conn) {
 	input := bufio.NewReader(conn)
 	lead, err := input.Peek(3)
 	if err != nil {
-		log.Println("Could not handle connection", conn, "due to", err)
+		logging.Logger.WithError(err).WithField("client", anonymize.Addr(conn.RemoteAddr().String())).Warn(
+			"plain: could not handle connection")
 		return
 	}
 	if string(lead) == "GET" {
@@ -69,9 +76,19 @@ func (ps *plainServer) sniffThenHandle(ctx context.Context, conn net.Conn) {
 		// We must forward instead of doing an HTTP redirect because existing deployed
 		// clients don't support redirects, e.g.
 		//    https://github.com/websockets/ws/issues/812
+		//
+		// The forwarded connection is registered as a test, so that shutdown
+		// waits for the test running through it to complete.
+		test, err := lameduck.Begin(ctx)
+		if err != nil {
+			ndt5metrics.ControlCount.WithLabelValues(ndt.Plain.Label(), "lame-duck").Inc()
+			return
+		}
+		defer test.Done()
+		ctx = test.Context()
 		fwd, err := ps.dialer.Dial("tcp", ps.wsAddr)
 		if err != nil {
-			log.Println("Could not forward connection", err)
+			logging.Logger.WithError(err).Warn("plain: could not forward connection")
 			return
 		}
 		wg := sync.WaitGroup{}
@@ -94,9 +111,9 @@ func (ps *plainServer) sniffThenHandle(ctx context.Context, conn net.Conn) {
 		// When the context is canceled, close `fwd` and return (returning closes
 		// `conn`). Note that this cancellation could be caused by:
 		//
-		//   1. The context times out or is explicitly canceled, which causes fwd to
-		//   close, causing each Copy() to terminate and the waitgroup.Wait() to
-		//   complete.
+		//   1. The context times out or the test is interrupted at the shutdown
+		//   deadline, which causes fwd to close, causing each Copy() to terminate
+		//   and the waitgroup.Wait() to complete.
 		//    OR
 		//   2. The other side of the connection closes `conn` or `fwd`, either of which
 		//   causes the `Copy` operations to terminate, which causes waitgroup.Wait() to
@@ -107,7 +124,8 @@ func (ps *plainServer) sniffThenHandle(ctx context.Context, conn net.Conn) {
 		// of running to completion.
 		<-ctx.Done()
 		if err := ctx.Err(); err == context.DeadlineExceeded {
-			log.Println("Connection", conn, "timed out")
+			logging.Logger.WithField("client", anonymize.Addr(conn.RemoteAddr().String())).Warn(
+				"plain: forwarded connection timed out")
 			ndt5metrics.ClientForwardingTimeouts.Inc()
 		}
 		fwd.Close()
@@ -123,9 +141,9 @@ func (ps *plainServer) sniffThenHandle(ctx context.Context, conn net.Conn) {
 	kickoff := "123456 654321"
 	n, err := conn.Write([]byte(kickoff))
 	if n != len(kickoff) || err != nil {
-		log.Printf("Could not write %d byte kickoff string: %d bytes written err: %v\n", len(kickoff), n, err)
+		logging.Logger.WithError(err).WithField("written", n).Warn("plain: could not write kickoff string")
 	}
-	ndt5.HandleControlChannel(protocol.AdaptNetConn(conn, input), ps, "false")
+	ndt5.HandleControlChannel(protocol.AdaptNetConn(conn, input), ps, "false", "")
 }
 
 // ListenAndServe starts up the sniffing server that delegates to the
@@ -147,17 +165,35 @@ func (ps *plainServer) ListenAndServe(ctx context.Context, addr string, tx Accep
 		for ctx.Err() == nil {
 			conn, err := tx.Accept(ps.listener)
 			if err != nil {
-				log.Println("Failed to accept connection:", err)
+				logging.Logger.WithError(err).Warn("plain: failed to accept connection")
+				continue
+			}
+			// Refuse new tests while the server is in lame duck mode.
+			if lameduck.LameDuck() {
+				ndt5metrics.ControlCount.WithLabelValues(ndt.Plain.Label(), "lame-duck").Inc()
+				conn.Close()
+				continue
+			}
+			var ip net.IP
+			if addr := netx.ToTCPAddr(conn.RemoteAddr()); addr != nil {
+				ip = addr.IP
+			}
+			release, err := ps.limiter.Acquire(ndt.Plain.Label(), ip)
+			if err != nil {
+				conn.Close()
 				continue
 			}
 			go func() {
-				connCtx, connCtxCancel := context.WithTimeout(ctx, ps.timeout)
+				// Connections outlive the listener, so that shutdown can drain
+				// the tests that are running when ctx is canceled.
+				connCtx, connCtxCancel := context.WithTimeout(context.Background(), ps.timeout)
 				defer func() {
 					connCtxCancel()
+					release()
 					r := recover()
 					if r != nil {
 						// TODO add a metric for this.
-						log.Println("Recovered from panic in RawServer", r)
+						logging.Logger.WithField("panic", fmt.Sprint(r)).Warn("plain: recovered from panic in RawServer")
 					}
 				}()
 				ps.sniffThenHandle(connCtx, conn)
@@ -168,8 +204,8 @@ func (ps *plainServer) ListenAndServe(ctx context.Context, addr string, tx Accep
 }
 
 func (ps *plainServer) ConnectionType() ndt.ConnectionType { return ndt.Plain }
-func (ps *plainServer) DataDir() string                    { return ps.datadir }
-func (ps *plainServer) Metadata() []metadata.NameValue     { return ps.metadata }
+func (ps *plainServer) ResultSink() sink.ResultSink        { return ps.results }
+func (ps *plainServer) Metadata() []metadata.NameValue     { return ps.metadata.Get() }
 func (ps *plainServer) LoginCeremony(conn protocol.Connection) (int, error) {
 	flex, ok := conn.(protocol.MeasuredFlexibleConnection)
 	if !ok {
@@ -218,8 +254,10 @@ type Server interface {
 
 // NewServer creates a new TCP listener to serve the client. It forwards all
 // connection requests that look like HTTP to a different address (assumed to be
-// on the same host).
-func NewServer(datadir, wsAddr string, metadata []metadata.NameValue) Server {
+// on the same host). If lim is not nil, connections from clients exceeding
+// its limits are closed as soon as they are accepted. Results are written to
+// results.
+func NewServer(results sink.ResultSink, wsAddr string, metadata *metadata.Labels, lim *limiter.Limiter) Server {
 	return &plainServer{
 		wsAddr: wsAddr,
 		// The dialer is only contacting localhost. The timeout should be set to a
@@ -228,9 +266,10 @@ func NewServer(datadir, wsAddr string, metadata []metadata.NameValue) Server {
 		dialer: &net.Dialer{
 			Timeout: 1 * time.Second,
 		},
-		datadir: datadir,
+		results: results,
 		// No client should wait around for more than 2 minutes.
 		timeout:  2 * time.Minute,
 		metadata: metadata,
+		limiter:  lim,
 	}
 }
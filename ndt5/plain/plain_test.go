@@ -1,7 +1,9 @@
 package plain
 
 import (
+	"bufio"
 	"context"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -11,7 +13,9 @@ import (
 
 	"github.com/m-lab/go/httpx"
 	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/lameduck"
 	"github.com/m-lab/ndt-server/metadata"
+	"github.com/m-lab/ndt-server/sink"
 )
 
 type fakeAccepter struct{}
@@ -57,7 +61,7 @@ func TestNewPlainServer(t *testing.T) {
 	}
 
 	// Set up the plain server
-	tcpS := NewServer(d, wsSrv.Addr, []metadata.NameValue{})
+	tcpS := NewServer(sink.NewFile(d, sink.NDT5Legacy), wsSrv.Addr, metadata.NewLabels(nil), nil)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	fa := &fakeAccepter{}
@@ -112,7 +116,7 @@ func TestNewPlainServerBrokenForwarding(t *testing.T) {
 	rtx.Must(err, "Could not create tempdir")
 	defer os.RemoveAll(d)
 	// Set up the plain server forwarding to a non-open port.
-	tcpS := NewServer(d, "127.0.0.1:1", []metadata.NameValue{})
+	tcpS := NewServer(sink.NewFile(d, sink.NDT5Legacy), "127.0.0.1:1", metadata.NewLabels(nil), nil)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	fa := &fakeAccepter{}
@@ -126,3 +130,67 @@ func TestNewPlainServerBrokenForwarding(t *testing.T) {
 		t.Error("This should have failed")
 	}
 }
+
+func TestPlainServerDrainsForwardedConnections(t *testing.T) {
+	d, err := ioutil.TempDir("", "TestPlainServerDrainsForwardedConnections")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(d)
+	// The proxied server streams data until the client goes away.
+	h := &http.ServeMux{}
+	h.HandleFunc("/test_stream", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		for {
+			if _, err := w.Write([]byte("test")); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	wsSrv := &http.Server{
+		Addr:    ":0",
+		Handler: h,
+	}
+	rtx.Must(httpx.ListenAndServeAsync(wsSrv), "Could not start server")
+	defer wsSrv.Close()
+
+	tcpS := NewServer(sink.NewFile(d, sink.NDT5Legacy), wsSrv.Addr, metadata.NewLabels(nil), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rtx.Must(tcpS.ListenAndServe(ctx, ":0", &fakeAccepter{}), "Could not start tcp server")
+
+	// Idle connections forwarded by the other tests may still be registered.
+	active := lameduck.Active()
+	conn, err := net.Dial("tcp", tcpS.Addr().String())
+	rtx.Must(err, "Could not connect")
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /test_stream HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal("Could not read the response", err)
+	}
+	if lameduck.Active() <= active {
+		t.Error("The forwarded connection should be registered as a test")
+	}
+
+	// Canceling the server context stops the listener, but the forwarded
+	// connection keeps running until shutdown drains it.
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 5; i++ {
+		if _, err := r.Read(buf); err != nil {
+			t.Fatal("The forwarded connection was closed with the server context:", err)
+		}
+	}
+
+	// Closing the connection completes the test.
+	conn.Close()
+	for start := time.Now(); lameduck.Active() > active; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("The forwarded connection was not unregistered")
+		}
+	}
+}
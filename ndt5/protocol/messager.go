@@ -4,9 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"reflect"
 	"strconv"
+
+	"github.com/m-lab/ndt-server/logging"
 )
 
 // Encoding encodes the communication methods we support.
@@ -38,14 +39,14 @@ func (e Encoding) String() string {
 func (e Encoding) Messager(conn Connection) Messager {
 	switch e {
 	case Unknown:
-		log.Println("Error: Messager() called for Unknown type")
+		logging.Logger.Warn("protocol: Messager() called for Unknown type")
 		return nil
 	case JSON:
 		return &jsonMessager{conn}
 	case TLV:
 		return &tlvMessager{conn}
 	}
-	log.Printf("Bad Encoding value: %d\n", int(e))
+	logging.Logger.WithField("encoding", int(e)).Warn("protocol: bad Encoding value")
 	return nil
 }
 
@@ -164,7 +165,7 @@ func SendMetrics(metrics interface{}, m Messager, prefix string) error {
 				return err
 			}
 		default:
-			log.Println("Unhandled case in SendMetrics:", t.Field(i).Type.Kind())
+			logging.Logger.WithField("kind", t.Field(i).Type.Kind().String()).Warn("protocol: unhandled case in SendMetrics")
 		}
 	}
 	return nil
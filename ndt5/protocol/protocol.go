@@ -7,17 +7,18 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net"
-	"os"
 	"path"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
 
+	"github.com/m-lab/ndt-server/anonymize"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/ndt5/web100"
 	"github.com/m-lab/ndt-server/netx"
+	"github.com/m-lab/ndt-server/safefile"
 )
 
 var verbose = flag.Bool("ndt5.protocol.verbose", false, "Print the contents of every message to the log")
@@ -91,7 +92,12 @@ type Connection interface {
 	WriteMessage(messageType int, data []byte) error
 	FillUntil(t time.Time, buffer []byte) (bytesWritten int64, err error)
 	ServerIPAndPort() (string, int)
+	// ClientIPAndPort returns the client IP, anonymized as configured by the
+	// anonymize package, and the client port.
 	ClientIPAndPort() (string, int)
+	// ClientAddr returns the address of the client. It is not anonymized, and
+	// must not be archived.
+	ClientAddr() net.Addr
 	Close() error
 	UUID() string
 	String() string
@@ -100,17 +106,16 @@ type Connection interface {
 
 var badUUID = "ERROR_DISCOVERING_UUID"
 
-// UUIDToFile converts a UUID into a newly-created open file with the extension '.json'.
-func UUIDToFile(dir, uuid string) (*os.File, error) {
+// UUIDToFile creates the file for the results of the test with the given UUID,
+// with the extension '.json', in dir relative to the data directory root. The
+// file appears under its final name once it has been closed.
+func UUIDToFile(root, dir, uuid string) (*safefile.File, error) {
+	name := uuid
 	if uuid == badUUID {
-		f, err := ioutil.TempFile(dir, badUUID+"*.json")
-		if err != nil {
-			log.Println("Could not create filename for data")
-			return nil, err
-		}
-		return f, nil
+		// Tests without a UUID must not overwrite each other's results.
+		name = badUUID + strconv.FormatInt(time.Now().UnixNano(), 10)
 	}
-	return os.Create(path.Join(dir, uuid+".json"))
+	return safefile.Create(root, path.Join(dir, name+".json"))
 }
 
 // Measurable things can be measured over a given timeframe.
@@ -203,7 +208,7 @@ func (ws *wsConnection) UUID() string {
 	ci := netx.ToConnInfo(ws.UnderlyingConn())
 	id, err := ci.GetUUID()
 	if err != nil {
-		log.Println("Could not discover UUID:", err)
+		logging.Logger.WithError(err).Warn("protocol: could not discover UUID")
 		// TODO: increment a metric
 		return badUUID
 	}
@@ -215,9 +220,13 @@ func (ws *wsConnection) ServerIPAndPort() (string, int) {
 	return localAddr.IP.String(), localAddr.Port
 }
 
+func (ws *wsConnection) ClientAddr() net.Addr {
+	return ws.UnderlyingConn().RemoteAddr()
+}
+
 func (ws *wsConnection) ClientIPAndPort() (string, int) {
 	remoteAddr := netx.ToTCPAddr(ws.UnderlyingConn().RemoteAddr())
-	return remoteAddr.IP.String(), remoteAddr.Port
+	return anonymize.IP(remoteAddr.IP), remoteAddr.Port
 }
 
 // ReadBytes reads some bytes and discards them. This method is in service of
@@ -232,7 +241,7 @@ func (ws *wsConnection) ReadBytes() (int64, error) {
 }
 
 func (ws *wsConnection) String() string {
-	return ws.LocalAddr().String() + "<=WS(S),JSON=>" + ws.RemoteAddr().String()
+	return ws.LocalAddr().String() + "<=WS(S),JSON=>" + anonymize.Addr(ws.RemoteAddr().String())
 }
 
 func (ws *wsConnection) Messager() Messager {
@@ -292,12 +301,12 @@ func (nc *netConnection) StartMeasuring(ctx context.Context) {
 func (nc *netConnection) UUID() string {
 	ci := netx.ToConnInfo(nc.Conn)
 	if ci == nil {
-		log.Println("Connection is not a TCPConn")
+		logging.Logger.Warn("protocol: connection is not a TCPConn")
 		return badUUID
 	}
 	id, err := ci.GetUUID()
 	if err != nil {
-		log.Println("Could not discover UUID")
+		logging.Logger.WithError(err).Warn("protocol: could not discover UUID")
 		// TODO: increment a metric
 		return badUUID
 	}
@@ -309,13 +318,17 @@ func (nc *netConnection) ServerIPAndPort() (string, int) {
 	return localAddr.IP.String(), localAddr.Port
 }
 
+func (nc *netConnection) ClientAddr() net.Addr {
+	return nc.RemoteAddr()
+}
+
 func (nc *netConnection) ClientIPAndPort() (string, int) {
 	remoteAddr := netx.ToTCPAddr(nc.RemoteAddr())
-	return remoteAddr.IP.String(), remoteAddr.Port
+	return anonymize.IP(remoteAddr.IP), remoteAddr.Port
 }
 
 func (nc *netConnection) String() string {
-	return nc.LocalAddr().String() + "<=PLAIN," + nc.encoding.String() + "=>" + nc.RemoteAddr().String()
+	return nc.LocalAddr().String() + "<=PLAIN," + nc.encoding.String() + "=>" + anonymize.Addr(nc.RemoteAddr().String())
 }
 
 func (nc *netConnection) SetEncoding(e Encoding) {
@@ -366,7 +379,8 @@ func ReadTLVMessage(ws Connection, expectedTypes ...MessageType) ([]byte, Messag
 func WriteTLVMessage(ws Connection, msgType MessageType, message string) error {
 	msgBytes := []byte(message)
 	if *verbose {
-		log.Printf("%s is getting sent a TLV of: %s, %d, %q\n", ws.String(), msgType.String(), len(msgBytes), message)
+		logging.Logger.WithField("conn", ws.String()).Infof(
+			"protocol: sending a TLV of: %s, %d, %q", msgType.String(), len(msgBytes), message)
 	}
 	outbuff := make([]byte, 3+len(msgBytes))
 	outbuff[0] = byte(msgType)
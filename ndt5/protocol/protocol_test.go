@@ -86,6 +86,7 @@ func (fc *fakeConnection) FillUntil(t time.Time, buffer []byte) (bytesWritten in
 }
 func (fc *fakeConnection) ServerIPAndPort() (string, int) { return "", 0 }
 func (fc *fakeConnection) ClientIPAndPort() (string, int) { return "", 0 }
+func (fc *fakeConnection) ClientAddr() net.Addr           { return nil }
 func (fc *fakeConnection) Close() error                   { return nil }
 func (fc *fakeConnection) UUID() string                   { return "" }
 func (fc *fakeConnection) String() string                 { return "" }
@@ -3,14 +3,17 @@ package s2c
 import (
 	"context"
 	"errors"
-	"log"
 	"strconv"
 	"time"
 
 	"github.com/m-lab/go/warnonerror"
+	"github.com/m-lab/ndt-server/events"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/ndt5/metrics"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/tcpinfox"
+	"github.com/m-lab/ndt-server/timeline"
 	"github.com/m-lab/tcp-info/tcp"
 )
 
@@ -42,7 +45,10 @@ type ArchivalData struct {
 	// TODO: Add TCPEngine (bbr, cubic, reno, etc.), MaxThroughputKbps, and Jitter
 
 	TCPInfo *tcp.LinuxTCPInfo `json:",omitempty"`
-	Error   string            `json:",omitempty"`
+	// LimitingFactors tells what limited the transfer, from the TCPInfo of
+	// the server.
+	LimitingFactors *tcpinfox.LimitingFactors `json:",omitempty"`
+	Error           string                    `json:",omitempty"`
 }
 
 // ManageTest manages the s2c test lifecycle
@@ -50,6 +56,7 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 	localCtx, localCancel := context.WithTimeout(ctx, 30*time.Second)
 	defer localCancel()
 	record = &ArchivalData{}
+	logger := logging.FromContext(ctx).WithField("subtest", "s2c")
 	defer func() {
 		if err != nil {
 			record.Error = err.Error()
@@ -60,30 +67,36 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 
 	srv, err := s.SingleServingServer("s2c")
 	if err != nil {
-		log.Println("Could not start single serving server", err)
+		logger.WithError(err).Warn("s2c: could not start SingleServingServer")
 		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "StartSingleServingServer").Inc()
 		return record, err
 	}
 	m := controlConn.Messager()
 	err = m.SendMessage(protocol.TestPrepare, []byte(strconv.Itoa(srv.Port())))
 	if err != nil {
-		log.Println("Could not send TestPrepare", err)
+		logger.WithError(err).Warn("s2c: could not send TestPrepare")
 		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "TestPrepare").Inc()
 		return record, err
 	}
+	rec := timeline.FromContext(ctx)
+	rec.Mark("s2c-test-prepare")
 
 	testConn, err := srv.ServeOnce(localCtx)
 	if err != nil || testConn == nil {
-		log.Println("Could not successfully ServeOnce", err)
+		logger.WithError(err).Warn("s2c: could not successfully ServeOnce")
 		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "ServeOnce").Inc()
 		if err == nil {
 			err = errors.New("nil testConn, but also a nil error")
 		}
 		return record, err
 	}
+	rec.Mark("s2c-accept")
 	record.UUID = testConn.UUID()
+	logger = logger.WithField("subtest_uuid", record.UUID)
 	record.ServerIP, record.ServerPort = testConn.ServerIPAndPort()
 	record.ClientIP, record.ClientPort = testConn.ClientIPAndPort()
+	events.Open(record.UUID, events.SockID(record.ServerIP, record.ServerPort, record.ClientIP, record.ClientPort))
+	defer events.Closed(record.UUID)
 
 	dataToSend := make([]byte, 8192)
 	for i := range dataToSend {
@@ -93,20 +106,31 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 	err = m.SendMessage(protocol.TestStart, []byte{})
 	if err != nil {
 		warnonerror.Close(testConn, "Could not close test connection")
-		log.Println("Could not write TestStart", err, record.UUID)
+		logger.WithError(err).Warn("s2c: could not send TestStart")
 		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "TestStart").Inc()
 		return record, err
 	}
-
-	testConn.StartMeasuring(localCtx)
+	rec.Mark("s2c-test-start")
+
+	testConn.StartMeasuring(logging.NewContext(localCtx, logger))
+	// FillUntil does not observe the context, so close the test connection if
+	// the context is canceled, e.g. by a server shutdown, during the transfer.
+	fillCtx, fillCancel := context.WithCancel(localCtx)
+	go func() {
+		<-fillCtx.Done()
+		if localCtx.Err() != nil {
+			testConn.Close()
+		}
+	}()
 	record.StartTime = time.Now()
 	testConn.FillUntil(time.Now().Add(10*time.Second), dataToSend)
 	record.EndTime = time.Now()
+	fillCancel()
 
 	web100metrics, err := testConn.StopMeasuring()
 	if err != nil {
 		warnonerror.Close(testConn, "Could not close test connection")
-		log.Println("Could not read metrics", err, record.UUID)
+		logger.WithError(err).Warn("s2c: could not read metrics")
 		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "web100Metrics").Inc()
 		return record, err
 	}
@@ -130,11 +154,14 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 	record.CountRTT = web100metrics.CountRTT
 	record.MeanThroughputMbps = kbps / 1000 // Convert Kbps to Mbps
 	record.TCPInfo = &web100metrics.TCPInfo
+	// The test connection is only used for the transfer, so its counters
+	// start with it.
+	record.LimitingFactors = tcpinfox.Classify(nil, record.TCPInfo, record.EndTime.Sub(record.StartTime))
 
 	// Send download results to the client.
 	err = m.SendS2CResults(int64(kbps), 0, web100metrics.TCPInfo.BytesAcked)
 	if err != nil {
-		log.Println("Could not write a TestMsg", err, record.UUID)
+		logger.WithError(err).Warn("s2c: could not send TestMsg")
 		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "TestMsgSend").Inc()
 		return record, err
 	}
@@ -143,37 +170,38 @@ func ManageTest(ctx context.Context, controlConn protocol.Connection, s ndt.Serv
 	// Do not return with an error if we got anything at all from the client.
 	if err != nil && clientRateMsg == nil {
 		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "TestMsgRcv").Inc()
-		log.Println("Could not receive a TestMsg", err, record.UUID)
+		logger.WithError(err).Warn("s2c: could not receive TestMsg")
 		return record, err
 	}
-	log.Println("We measured", kbps, "and the client sent us", string(clientRateMsg))
+	logger.WithField("kbps", kbps).WithField("client_kbps", string(clientRateMsg)).Info("s2c: measured download rate")
 	clientRateKbps, err := strconv.ParseFloat(string(clientRateMsg), 64)
 	if err == nil {
 		record.ClientReportedMbps = clientRateKbps / 1000
 	} else {
-		log.Println("Could not parse number sent from client")
+		logger.WithError(err).Warn("s2c: could not parse the rate sent by the client")
 		// Being unable to parse the number should not be a fatal error, so continue.
 	}
 
 	err = protocol.SendMetrics(web100metrics, m, "")
 	if err != nil {
-		log.Println("Could not SendMetrics for the legacy data", err, record.UUID)
+		logger.WithError(err).Warn("s2c: could not send the legacy metrics")
 		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "SendMetricsLegacy").Inc()
 		return record, err
 	}
 	err = protocol.SendMetrics(record, m, "NDTResult.S2C.")
 	if err != nil {
-		log.Println("Could not SendMetrics for the archival data", err, record.UUID)
+		logger.WithError(err).Warn("s2c: could not send the archival metrics")
 		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "SendMetricsArchival").Inc()
 		return record, err
 	}
 
 	err = m.SendMessage(protocol.TestFinalize, []byte{})
 	if err != nil {
-		log.Println("Could not send TestFinalize", err, record.UUID)
+		logger.WithError(err).Warn("s2c: could not send TestFinalize")
 		metrics.ClientTestErrors.WithLabelValues(connType, "s2c", "TestFinalize").Inc()
 		return record, err
 	}
+	rec.Mark("s2c-test-finalize")
 
 	return record, nil
 }
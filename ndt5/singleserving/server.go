@@ -2,13 +2,14 @@ package singleserving
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
-	"log"
 	"net"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/m-lab/ndt-server/logging"
 	ndt5metrics "github.com/m-lab/ndt-server/ndt5/metrics"
 	"github.com/m-lab/ndt-server/ndt5/ndt"
 	"github.com/m-lab/ndt-server/ndt5/protocol"
@@ -66,7 +67,7 @@ func (s *wsServer) ServeOnce(ctx context.Context) (protocol.MeasuredConnection,
 	// ensure that the race gets resolved in just one way for the following if().
 	err := closeErr
 	if s.newConn == nil && err != nil && err != http.ErrServerClosed {
-		log.Println("Server closed incorrectly:", err)
+		logging.Logger.WithError(err).Warn("singleserving: server closed incorrectly")
 		return nil, errors.New("Server did not close correctly")
 	}
 
@@ -129,10 +130,9 @@ func listenWS(direction string) (*wsServer, error) {
 }
 
 // wssServer is a single-serving server for encrypted websockets. A wssServer is
-// just a wsServer with a different start method and two extra fields.
+// just a wsServer with a different start method and a TLS configuration.
 type wssServer struct {
 	*wsServer
-	certFile, keyFile string
 }
 
 // ListenWSS starts a single-serving encrypted websocket server. When this method
@@ -140,8 +140,9 @@ type wssServer struct {
 // the server socket will be in "listening" mode. The returned server will not
 // actually respond until ServeOnce() is called, but the connect() will not fail
 // as long as ServeOnce is called soon ("soon" is defined by os-level timeouts)
-// after this returns.
-func ListenWSS(direction, certFile, keyFile string) (ndt.SingleMeasurementServer, error) {
+// after this returns. Certificates are provided by config, which should be the
+// configuration shared with the other TLS listeners.
+func ListenWSS(direction string, config *tls.Config) (ndt.SingleMeasurementServer, error) {
 	ndt5metrics.MeasurementServerStart.WithLabelValues(string(ndt.WSS)).Inc()
 	ws, err := listenWS(direction)
 	if err != nil {
@@ -149,12 +150,11 @@ func ListenWSS(direction, certFile, keyFile string) (ndt.SingleMeasurementServer
 	}
 	wss := wssServer{
 		wsServer: ws,
-		certFile: certFile,
-		keyFile:  keyFile,
 	}
 	wss.kind = ndt.WSS
+	wss.srv.TLSConfig = config
 	wss.serve = func(l net.Listener) error {
-		return wss.srv.ServeTLS(l, wss.certFile, wss.keyFile)
+		return wss.srv.ServeTLS(l, "", "")
 	}
 	return &wss, nil
 }
@@ -3,9 +3,9 @@ package web100
 import (
 	"context"
 	"errors"
-	"log"
 	"time"
 
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/netx"
 	"github.com/m-lab/tcp-info/tcp"
 )
@@ -70,7 +70,7 @@ func measureUntilContextCancellation(ctx context.Context, ci netx.ConnInfo) (*Me
 		if err == nil {
 			snaps = append(snaps, snapshot)
 		} else {
-			log.Println("Getsockopt error:", err)
+			logging.FromContext(ctx).WithError(err).Warn("web100: could not read TCP_INFO")
 		}
 	}
 	return summarize(snaps)
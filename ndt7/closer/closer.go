@@ -2,21 +2,24 @@
 package closer
 
 import (
+	"context"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/netx"
 )
 
 // StartClosing will start closing the websocket connection.
-func StartClosing(conn *websocket.Conn) {
+func StartClosing(ctx context.Context, conn *websocket.Conn) {
 	msg := websocket.FormatCloseMessage(
 		websocket.CloseNormalClosure, "Done sending")
 	d := time.Now().Add(time.Second) // Liveness!
 	err := conn.WriteControl(websocket.CloseMessage, msg, d)
 	if err != nil {
-		logging.Logger.WithError(err).Warn("sender: conn.WriteControl failed")
+		logging.FromContext(ctx).WithError(err).Warn("sender: conn.WriteControl failed")
 		return
 	}
-	logging.Logger.Debug("sender: sending Close message")
+	netx.ToTimeline(conn.LocalAddr()).Mark("close-sent")
+	logging.FromContext(ctx).Debug("sender: sending Close message")
 }
@@ -14,6 +14,7 @@ import (
 	"github.com/m-lab/ndt-server/ndt7/model"
 	"github.com/m-lab/ndt-server/ndt7/ping"
 	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/netx"
 )
 
 func makePreparedMessage(size int) (*websocket.PreparedMessage, error) {
@@ -33,21 +34,25 @@ func makePreparedMessage(size int) (*websocket.PreparedMessage, error) {
 // MaxRuntime of the subtest. This is enforced by setting the write deadline to
 // Time.Now() + MaxRuntime.
 func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData) error {
-	logging.Logger.Debug("sender: start")
+	logger := logging.FromContext(ctx)
+	logger.Debug("sender: start")
 	proto := ndt7metrics.ConnLabel(conn)
 
 	// Start collecting connection measurements. Measurements will be sent to
 	// src until DefaultRuntime, when the src channel is closed.
 	mr := measurer.New(conn, data.UUID)
 	src := mr.Start(ctx, spec.DefaultRuntime)
-	defer logging.Logger.Debug("sender: stop")
-	defer mr.Stop(src)
+	defer logger.Debug("sender: stop")
+	defer func() {
+		mr.Stop(src)
+		data.ServerSamples = mr.Samples()
+	}()
 
-	logging.Logger.Debug("sender: generating random buffer")
+	logger.Debug("sender: generating random buffer")
 	bulkMessageSize := 1 << 13
 	preparedMessage, err := makePreparedMessage(bulkMessageSize)
 	if err != nil {
-		logging.Logger.WithError(err).Warn("sender: makePreparedMessage failed")
+		logger.WithError(err).Warn("sender: makePreparedMessage failed")
 		ndt7metrics.ClientSenderErrors.WithLabelValues(
 			proto, string(spec.SubtestDownload), "make-prepared-message").Inc()
 		return err
@@ -55,7 +60,7 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 	deadline := time.Now().Add(spec.MaxRuntime)
 	err = conn.SetWriteDeadline(deadline) // Liveness!
 	if err != nil {
-		logging.Logger.WithError(err).Warn("sender: conn.SetWriteDeadline failed")
+		logger.WithError(err).Warn("sender: conn.SetWriteDeadline failed")
 		ndt7metrics.ClientSenderErrors.WithLabelValues(
 			proto, string(spec.SubtestDownload), "set-write-deadline").Inc()
 		return err
@@ -71,13 +76,13 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 		select {
 		case m, ok := <-src:
 			if !ok { // This means that the measurer has terminated
-				closer.StartClosing(conn)
+				closer.StartClosing(ctx, conn)
 				ndt7metrics.ClientSenderErrors.WithLabelValues(
 					proto, string(spec.SubtestDownload), "measurer-closed").Inc()
 				return nil
 			}
 			if err := conn.WriteJSON(m); err != nil {
-				logging.Logger.WithError(err).Warn("sender: conn.WriteJSON failed")
+				logger.WithError(err).Warn("sender: conn.WriteJSON failed")
 				ndt7metrics.ClientSenderErrors.WithLabelValues(
 					proto, string(spec.SubtestDownload), "write-json").Inc()
 				return err
@@ -85,19 +90,22 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 			// Only save measurements sent to the client.
 			data.ServerMeasurements = append(data.ServerMeasurements, m)
 			if err := ping.SendTicks(conn, deadline); err != nil {
-				logging.Logger.WithError(err).Warn("sender: ping.SendTicks failed")
+				logger.WithError(err).Warn("sender: ping.SendTicks failed")
 				ndt7metrics.ClientSenderErrors.WithLabelValues(
 					proto, string(spec.SubtestDownload), "ping-send-ticks").Inc()
 				return err
 			}
 		default:
 			if err := conn.WritePreparedMessage(preparedMessage); err != nil {
-				logging.Logger.WithError(err).Warn(
+				logger.WithError(err).Warn(
 					"sender: conn.WritePreparedMessage failed")
 				ndt7metrics.ClientSenderErrors.WithLabelValues(
 					proto, string(spec.SubtestDownload), "write-prepared-message").Inc()
 				return err
 			}
+			if totalSent == 0 {
+				netx.ToTimeline(conn.LocalAddr()).Mark("first-bulk-byte")
+			}
 			// The following block of code implements the scaling of message size
 			// as recommended in the spec's appendix. We're not accounting for the
 			// size of JSON messages because that is small compared to the bulk
@@ -115,7 +123,7 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 			bulkMessageSize *= 2
 			preparedMessage, err = makePreparedMessage(bulkMessageSize)
 			if err != nil {
-				logging.Logger.WithError(err).Warn("sender: makePreparedMessage failed")
+				logger.WithError(err).Warn("sender: makePreparedMessage failed")
 				ndt7metrics.ClientSenderErrors.WithLabelValues(
 					proto, string(spec.SubtestDownload), "make-prepared-message").Inc()
 				return err
@@ -2,6 +2,7 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -9,37 +10,60 @@ import (
 	"regexp"
 	"time"
 
+	"github.com/apex/log"
 	"github.com/gorilla/websocket"
 
 	"github.com/m-lab/access/controller"
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/warnonerror"
+	"github.com/m-lab/ndt-server/annotation"
+	"github.com/m-lab/ndt-server/anonymize"
+	"github.com/m-lab/ndt-server/certs"
 	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/events"
+	"github.com/m-lab/ndt-server/janitor"
+	"github.com/m-lab/ndt-server/lameduck"
+	"github.com/m-lab/ndt-server/limiter"
 	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/metadata"
 	"github.com/m-lab/ndt-server/metrics"
 	"github.com/m-lab/ndt-server/ndt7/download"
 	ndt7metrics "github.com/m-lab/ndt-server/ndt7/metrics"
 	"github.com/m-lab/ndt-server/ndt7/model"
-	"github.com/m-lab/ndt-server/ndt7/results"
+	"github.com/m-lab/ndt-server/ndt7/retrieval"
 	"github.com/m-lab/ndt-server/ndt7/spec"
 	"github.com/m-lab/ndt-server/ndt7/upload"
 	"github.com/m-lab/ndt-server/netx"
+	"github.com/m-lab/ndt-server/sink"
+	"github.com/m-lab/ndt-server/tcpinfox"
 	"github.com/m-lab/ndt-server/version"
+	"github.com/m-lab/tcp-info/inetdiag"
 )
 
 // Handler handles ndt7 subtests.
 type Handler struct {
-	// DataDir is the directory where results are saved.
+	// Results receives the results of all subtests. When nil, results are
+	// saved to files in DataDir.
+	Results sink.ResultSink
+	// DataDir is the directory where results are saved when Results is nil.
 	DataDir string
 	// SecurePort should contain the port used for secure, WSS tests.
 	SecurePort string
 	// InsecurePort should contain the port used for insecure, WS tests.
 	InsecurePort string
 	// ServerMetadata contains deployment-specific metadata.
-	ServerMetadata []metadata.NameValue
+	ServerMetadata *metadata.Labels
+	// Limiter, if not nil, limits how often clients may start new tests.
+	Limiter *limiter.Limiter
+	// Retrieval, if not nil, grants clients access to the results of their
+	// subtests. It must also receive the results written to Results.
+	Retrieval *retrieval.Store
 }
 
+// errMissingProtocol is returned when the client does not request the ndt7
+// websocket subprotocol.
+var errMissingProtocol = errors.New("missing Sec-WebSocket-Protocol in request")
+
 // warnAndClose emits message as a warning and the sends a Bad Request
 // response to the client using writer.
 func warnAndClose(writer http.ResponseWriter, message string) {
@@ -61,14 +85,44 @@ func (h Handler) Upload(rw http.ResponseWriter, req *http.Request) {
 // runMeasurement conditionally runs either download or upload based on kind.
 // The kind argument must be spec.SubtestDownload or spec.SubtestUpload.
 func (h Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter, req *http.Request) {
+	// Refuse new tests when their results could not be saved.
+	if err := janitor.Admit(); err != nil {
+		logging.Logger.WithError(err).Debug("runMeasurement: refusing test")
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "disk-full").Inc()
+		// 507 - https://tools.ietf.org/html/rfc4918#section-11.5
+		rw.Header().Set("Connection", "Close")
+		rw.WriteHeader(http.StatusInsufficientStorage)
+		return
+	}
+	// Refuse new tests while the server is in lame duck mode.
+	test, err := lameduck.Begin(req.Context())
+	if err != nil {
+		logging.Logger.WithError(err).Debug("runMeasurement: refusing test")
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "lame-duck").Inc()
+		// 503 - https://tools.ietf.org/html/rfc7231#section-6.6.4
+		rw.Header().Set("Connection", "Close")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	// Done must run after the result is written, so the test is not
+	// considered complete by a draining server before its data is saved.
+	defer test.Done()
+
 	// Setup websocket connection.
-	conn := setupConn(rw, req)
-	if conn == nil {
+	conn, release, err := setupConn(rw, req, h.Limiter)
+	if err != nil {
 		// TODO: test failure.
-		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "websocket-error").Inc()
+		status := "websocket-error"
+		if err == limiter.ErrTooManyTests || err == limiter.ErrTooManyConcurrent {
+			status = "rate-limited"
+		}
+		ndt7metrics.ClientConnections.WithLabelValues(string(kind), status).Inc()
 		return
 	}
+	defer release()
 	defer warnonerror.Close(conn, "runMeasurement: ignoring conn.Close result")
+	rec := netx.ToTimeline(conn.LocalAddr())
+	rec.Mark("upgrade-done")
 	// Create measurement archival data.
 	data, err := getData(conn)
 	if err != nil {
@@ -76,12 +130,20 @@ func (h Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter, r
 		ndt7metrics.ClientConnections.WithLabelValues(string(kind), "uuid-error").Inc()
 		return
 	}
+	// Every log entry of the subtest has its protocol and UUID.
+	logger := logging.ForTest(ndt7metrics.ConnLabel(conn), data.UUID).WithField("subtest", string(kind))
+	ctx := logging.NewContext(test.Context(), logger)
+	logging.SetAccessUUID(req.Context(), data.UUID)
+	// Let sidecars know about the connection, keyed by its UUID.
+	events.Open(data.UUID, sockID(conn))
+	defer events.Closed(data.UUID)
 	// We are guaranteed to collect a result at this point (even if it's with an error)
 	ndt7metrics.ClientConnections.WithLabelValues(string(kind), "result").Inc()
 
 	// Collect most client metadata from request parameters.
 	appendClientMetadata(data, req.URL.Query())
-	data.ServerMetadata = h.ServerMetadata
+	data.ServerMetadata = h.ServerMetadata.Get()
+	data.ClientCertificateSubject = certs.GetSubject(req.Context())
 	// Create ultimate result.
 	result := setupResult(conn)
 	result.StartTime = time.Now().UTC()
@@ -89,24 +151,36 @@ func (h Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter, r
 	// Guarantee results are written even if function panics.
 	defer func() {
 		result.EndTime = time.Now().UTC()
-		h.writeResult(data.UUID, kind, result)
+		result.Timeline = rec.Timeline()
+		if err := test.Err(); err != nil {
+			data.Error = err.Error()
+		}
+		h.writeResult(logger, data.UUID, kind, result)
 	}()
 
+	// Tell the client how to retrieve the result once the subtest is done.
+	if err := h.grantRetrieval(conn, data.UUID, req); err != nil {
+		logger.WithError(err).Warn("runMeasurement: could not grant result retrieval")
+	}
+
 	// Run measurement.
 	var rate float64
 	if kind == spec.SubtestDownload {
 		result.Download = data
-		err = download.Do(req.Context(), conn, data)
+		err = download.Do(ctx, conn, data)
 		rate = downRate(data.ServerMeasurements)
+		data.LimitingFactors = limitingFactors(data.ServerMeasurements)
 	} else if kind == spec.SubtestUpload {
 		result.Upload = data
-		err = upload.Do(req.Context(), conn, data)
+		err = upload.Do(ctx, conn, data)
 		rate = upRate(data.ServerMeasurements)
 	}
+	logging.SetAccessBytes(req.Context(), subtestBytes(kind, data.ServerMeasurements))
 
 	proto := ndt7metrics.ConnLabel(conn)
 	ndt7metrics.ClientTestResults.WithLabelValues(
 		proto, string(kind), metrics.GetResultLabel(err, rate)).Inc()
+	observeSubtest(proto, kind, data, err, test.Err() != nil)
 	if rate > 0 {
 		isMon := fmt.Sprintf("%t", controller.IsMonitoring(controller.GetClaim(req.Context())))
 		// Update the common (ndt5+ndt7) measurement rates histogram.
@@ -116,12 +190,26 @@ func (h Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter, r
 
 // setupConn negotiates a websocket connection. The writer argument is the HTTP
 // response writer. The request argument is the HTTP request that we received.
-func setupConn(writer http.ResponseWriter, request *http.Request) *websocket.Conn {
+// Before upgrading, setupConn asks lim whether the client may start a new test.
+// On success, the caller must call the returned release function once the test
+// is complete.
+func setupConn(writer http.ResponseWriter, request *http.Request, lim *limiter.Limiter) (*websocket.Conn, func(), error) {
 	logging.Logger.Debug("setupConn: upgrading to WebSockets")
 	if request.Header.Get("Sec-WebSocket-Protocol") != spec.SecWebSocketProtocol {
 		warnAndClose(
 			writer, "setupConn: missing Sec-WebSocket-Protocol in request")
-		return nil
+		return nil, nil, errMissingProtocol
+	}
+	release := func() {}
+	if !controller.IsMonitoring(controller.GetClaim(request.Context())) {
+		var err error
+		release, err = lim.Acquire("ndt7", clientIP(request))
+		if err != nil {
+			// 429 - https://tools.ietf.org/html/rfc6585#section-4
+			writer.Header().Set("Connection", "Close")
+			writer.WriteHeader(http.StatusTooManyRequests)
+			return nil, nil, err
+		}
 	}
 	headers := http.Header{}
 	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
@@ -134,11 +222,22 @@ func setupConn(writer http.ResponseWriter, request *http.Request) *websocket.Con
 	}
 	conn, err := upgrader.Upgrade(writer, request, headers)
 	if err != nil {
-		return nil
+		release()
+		return nil, nil, err
 	}
-	logging.Logger.Debug("setupConn: opening results file")
+	logging.Logger.Debug("setupConn: upgraded to WebSockets")
 
-	return conn
+	return conn, release, nil
+}
+
+// clientIP returns the IP address of the client that sent request, or nil if
+// the remote address cannot be parsed.
+func clientIP(request *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
 }
 
 // setupResult creates an NDT7Result from the given conn.
@@ -156,24 +255,65 @@ func setupResult(conn *websocket.Conn) *data.NDT7Result {
 	result := &data.NDT7Result{
 		GitShortCommit: prometheusx.GitShortCommit,
 		Version:        version.Version,
-		ClientIP:       clientAddr.IP.String(),
+		SchemaVersion:  data.SchemaVersion,
+		ClientIP:       anonymize.IP(clientAddr.IP),
 		ClientPort:     clientAddr.Port,
-		ServerIP:       serverAddr.IP.String(),
-		ServerPort:     serverAddr.Port,
+		// The annotation uses the client IP before anonymization.
+		ClientAnnotation: annotation.Annotate("ndt7", clientAddr.IP),
+		ServerIP:         serverAddr.IP.String(),
+		ServerPort:       serverAddr.Port,
 	}
 	return result
 }
 
-func (h Handler) writeResult(uuid string, kind spec.SubtestKind, result *data.NDT7Result) {
-	fp, err := results.NewFile(uuid, h.DataDir, kind)
+func (h Handler) writeResult(logger log.Interface, uuid string, kind spec.SubtestKind, result *data.NDT7Result) {
+	results := h.Results
+	if results == nil {
+		results = sink.NewFile(h.DataDir, sink.NDT5Legacy)
+	}
+	err := results.Write(&sink.Result{
+		Protocol:  "ndt7",
+		Kind:      string(kind),
+		UUID:      uuid,
+		StartTime: result.StartTime,
+		Data:      result,
+	})
 	if err != nil {
-		logging.Logger.WithError(err).Warn("results.NewFile failed")
-		return
+		logger.WithError(err).Warn("failed to write result")
 	}
-	if err := fp.WriteResult(result); err != nil {
-		logging.Logger.WithError(err).Warn("failed to write result")
+}
+
+// grantRetrieval grants access to the result of the subtest with the given
+// UUID, and sends the one-time secret to the client in a ConnectionInfo message
+// before any measurement. The secret is not part of the archival data.
+func (h Handler) grantRetrieval(conn *websocket.Conn, uuid string, req *http.Request) error {
+	if h.Retrieval == nil {
+		return nil
 	}
-	warnonerror.Close(fp, string(kind)+": ignoring fp.Close error")
+	secret, err := h.Retrieval.Grant(uuid, retrieval.VerifiedToken(req))
+	if err != nil {
+		return err
+	}
+	// The subtest sets its own deadline once it starts.
+	if err := conn.SetWriteDeadline(time.Now().Add(spec.DefaultRuntime)); err != nil {
+		return err
+	}
+	return conn.WriteJSON(model.Measurement{
+		ConnectionInfo: &model.ConnectionInfo{
+			Client:       anonymize.Addr(conn.RemoteAddr().String()),
+			Server:       conn.LocalAddr().String(),
+			UUID:         uuid,
+			ResultSecret: secret,
+		},
+	})
+}
+
+// sockID returns the socket ID of conn for connection events, with the client
+// address anonymized like in the archival data.
+func sockID(conn *websocket.Conn) inetdiag.SockID {
+	serverAddr := netx.ToTCPAddr(conn.LocalAddr())
+	clientAddr := netx.ToTCPAddr(conn.RemoteAddr())
+	return events.SockID(serverAddr.IP.String(), serverAddr.Port, anonymize.IP(clientAddr.IP), clientAddr.Port)
 }
 
 func getData(conn *websocket.Conn) (*model.ArchivalData, error) {
@@ -189,6 +329,45 @@ func getData(conn *websocket.Conn) (*model.ArchivalData, error) {
 	return data, nil
 }
 
+// observeSubtest records the duration, the final TCP_INFO metrics and the
+// termination reason of a subtest that ended with err.
+func observeSubtest(proto string, kind spec.SubtestKind, data *model.ArchivalData, err error, interrupted bool) {
+	direction := string(kind)
+	ndt7metrics.SubtestTerminations.WithLabelValues(
+		proto, direction, ndt7metrics.TerminationReason(err, interrupted)).Inc()
+	if !data.StartTime.IsZero() && !data.EndTime.IsZero() {
+		ndt7metrics.SubtestDuration.WithLabelValues(proto, direction).Observe(
+			data.EndTime.Sub(data.StartTime).Seconds())
+	}
+	m := data.ServerMeasurements
+	// NOTE: on non-Linux platforms, TCPInfo will be nil.
+	if len(m) == 0 || m[len(m)-1].TCPInfo == nil {
+		return
+	}
+	ti := m[len(m)-1].TCPInfo
+	ndt7metrics.SubtestMinRTT.WithLabelValues(proto, direction).Observe(float64(ti.MinRTT) / 1000)
+	ndt7metrics.SubtestBytes.WithLabelValues(proto, direction).Observe(float64(subtestBytes(kind, m)))
+	// In uploads the server only sends measurement messages, so only the
+	// retransmissions of downloads say something about the result.
+	if kind == spec.SubtestDownload && ti.BytesSent > 0 {
+		ndt7metrics.SubtestRetransmission.WithLabelValues(proto, direction).Observe(
+			float64(ti.BytesRetrans) / float64(ti.BytesSent))
+	}
+}
+
+// subtestBytes returns the bytes acknowledged by the client in a download, or
+// received by the server in an upload, according to the last measurement.
+func subtestBytes(kind spec.SubtestKind, m []model.Measurement) int64 {
+	// NOTE: on non-Linux platforms, TCPInfo will be nil.
+	if len(m) == 0 || m[len(m)-1].TCPInfo == nil {
+		return 0
+	}
+	if kind == spec.SubtestUpload {
+		return m[len(m)-1].TCPInfo.BytesReceived
+	}
+	return m[len(m)-1].TCPInfo.BytesAcked
+}
+
 func upRate(m []model.Measurement) float64 {
 	var mbps float64
 	// NOTE: on non-Linux platforms, TCPInfo will be nil.
@@ -209,6 +388,17 @@ func downRate(m []model.Measurement) float64 {
 	return mbps
 }
 
+// limitingFactors classifies what limited a download from the last TCPInfo
+// measurement, which summarizes the whole subtest.
+func limitingFactors(m []model.Measurement) *tcpinfox.LimitingFactors {
+	// NOTE: on non-Linux platforms, TCPInfo will be nil.
+	if len(m) == 0 || m[len(m)-1].TCPInfo == nil {
+		return nil
+	}
+	ti := m[len(m)-1].TCPInfo
+	return tcpinfox.Classify(nil, &ti.LinuxTCPInfo, time.Duration(ti.ElapsedTime)*time.Microsecond)
+}
+
 // excludeKeyRe is a regexp for excluding request parameters from client metadata.
 var excludeKeyRe = regexp.MustCompile("^server_")
 
@@ -69,7 +69,9 @@ func serveTLS(server *http.Server, listener net.Listener, certFile, keyFile stri
 // against it.
 //
 // Returns a non-nil error if the listening socket can't be established. Logs a
-// fatal error if the server dies for a reason besides ErrServerClosed.
+// fatal error if the server dies for a reason besides ErrServerClosed. The
+// certFile and keyFile may be empty when server.TLSConfig provides the
+// certificates, e.g. through GetCertificate.
 func ListenAndServeTLSAsync(server *http.Server, certFile, keyFile string) error {
 	// Start listening synchronously.
 	listener, err := net.Listen("tcp", server.Addr)
@@ -4,22 +4,35 @@ package measurer
 
 import (
 	"context"
+	"sync"
 	"time"
 
+	"github.com/apex/log"
 	"github.com/gorilla/websocket"
 
 	"github.com/m-lab/go/memoryless"
+	"github.com/m-lab/ndt-server/anonymize"
 	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/ndt7/model"
 	"github.com/m-lab/ndt-server/ndt7/spec"
 	"github.com/m-lab/ndt-server/netx"
 )
 
+// Sampling configures the random intervals between measurements. It defaults
+// to the intervals suggested by the ndt7 specification and should only be
+// changed at startup, before any test runs.
+var Sampling = memoryless.Config{
+	Min:      spec.MinPoissonSamplingInterval,
+	Expected: spec.AveragePoissonSamplingInterval,
+	Max:      spec.MaxPoissonSamplingInterval,
+}
+
 // Measurer performs measurements
 type Measurer struct {
-	conn   *websocket.Conn
-	uuid   string
-	ticker *memoryless.Ticker
+	conn    *websocket.Conn
+	uuid    string
+	ticker  *memoryless.Ticker
+	samples *model.Samples
 }
 
 // New creates a new measurer instance
@@ -30,11 +43,11 @@ func New(conn *websocket.Conn, UUID string) *Measurer {
 	}
 }
 
-func (m *Measurer) getSocketAndPossiblyEnableBBR() (netx.ConnInfo, error) {
+func (m *Measurer) getSocketAndPossiblyEnableBBR(logger log.Interface) (netx.ConnInfo, error) {
 	ci := netx.ToConnInfo(m.conn.UnderlyingConn())
 	err := ci.EnableBBR()
 	if err != nil {
-		logging.Logger.WithError(err).Warn("Cannot enable BBR")
+		logger.WithError(err).Warn("Cannot enable BBR")
 		// FALLTHROUGH
 	}
 	return ci, nil
@@ -44,11 +57,19 @@ func measure(measurement *model.Measurement, ci netx.ConnInfo, elapsed time.Dura
 	// Implementation note: we always want to sample BBR before TCPInfo so we
 	// will know from TCPInfo if the connection has been closed.
 	t := int64(elapsed / time.Microsecond)
-	bbrinfo, tcpInfo, err := ci.ReadInfo()
+	ccinfo, tcpInfo, err := ci.ReadCCInfo()
 	if err == nil {
-		measurement.BBRInfo = &model.BBRInfo{
-			BBRInfo:     bbrinfo,
-			ElapsedTime: t,
+		// BBRInfo is empty, as it always was, unless the congestion control
+		// is BBR.
+		measurement.BBRInfo = &model.BBRInfo{ElapsedTime: t}
+		if ccinfo.BBR != nil {
+			measurement.BBRInfo.BBRInfo = ccinfo.BBR.BBRInfo
+		}
+		if ccinfo.Algorithm != "" {
+			measurement.CCInfo = &model.CCInfo{
+				CCInfo:      ccinfo,
+				ElapsedTime: t,
+			}
 		}
 		measurement.TCPInfo = &model.TCPInfo{
 			LinuxTCPInfo: tcpInfo,
@@ -58,40 +79,49 @@ func measure(measurement *model.Measurement, ci netx.ConnInfo, elapsed time.Dura
 }
 
 func (m *Measurer) loop(ctx context.Context, timeout time.Duration, dst chan<- model.Measurement) {
-	logging.Logger.Debug("measurer: start")
-	defer logging.Logger.Debug("measurer: stop")
+	logger := logging.FromContext(ctx)
+	logger.Debug("measurer: start")
+	defer logger.Debug("measurer: stop")
 	defer close(dst)
 	measurerctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	ci, err := m.getSocketAndPossiblyEnableBBR()
+	ci, err := m.getSocketAndPossiblyEnableBBR(logger)
 	if err != nil {
-		logging.Logger.WithError(err).Warn("getSocketAndPossiblyEnableBBR failed")
+		logger.WithError(err).Warn("getSocketAndPossiblyEnableBBR failed")
 		return
 	}
 	start := time.Now()
 	connectionInfo := &model.ConnectionInfo{
-		Client: m.conn.RemoteAddr().String(),
+		Client: anonymize.Addr(m.conn.RemoteAddr().String()),
 		Server: m.conn.LocalAddr().String(),
 		UUID:   m.uuid,
 	}
 	// Implementation note: the ticker will close its output channel
 	// after the controlling context is expired.
-	ticker, err := memoryless.NewTicker(measurerctx, memoryless.Config{
-		Min:      spec.MinPoissonSamplingInterval,
-		Expected: spec.AveragePoissonSamplingInterval,
-		Max:      spec.MaxPoissonSamplingInterval,
-	})
+	ticker, err := memoryless.NewTicker(measurerctx, Sampling)
 	if err != nil {
-		logging.Logger.WithError(err).Warn("memoryless.NewTicker failed")
+		logger.WithError(err).Warn("memoryless.NewTicker failed")
 		return
 	}
 	m.ticker = ticker
+	var wg sync.WaitGroup
+	if c := HighResolution; c != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.samples = c.run(measurerctx, ci, start)
+		}()
+	}
 	for now := range ticker.C {
 		var measurement model.Measurement
 		measure(&measurement, ci, now.Sub(start))
 		measurement.ConnectionInfo = connectionInfo
 		dst <- measurement // Liveness: this is blocking
 	}
+	// The ticker may have been stopped early by Stop. Stop the sampler too,
+	// and wait for it before closing dst.
+	cancel()
+	wg.Wait()
 }
 
 // Start runs the measurement loop in a background goroutine and emits
@@ -103,6 +133,7 @@ func (m *Measurer) loop(ctx context.Context, timeout time.Duration, dst chan<- m
 // calling Stop.
 func (m *Measurer) Start(ctx context.Context, timeout time.Duration) <-chan model.Measurement {
 	dst := make(chan model.Measurement)
+	netx.ToTimeline(m.conn.LocalAddr()).Mark("measurer-start")
 	go m.loop(ctx, timeout, dst)
 	return dst
 }
@@ -118,3 +149,9 @@ func (m *Measurer) Stop(src <-chan model.Measurement) {
 		// make sure we drain the channel, so the measurement loop can exit.
 	}
 }
+
+// Samples returns the samples of the high resolution sampler, or nil when it
+// is disabled. It must only be called after Stop.
+func (m *Measurer) Samples() *model.Samples {
+	return m.samples
+}
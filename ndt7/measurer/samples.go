@@ -0,0 +1,76 @@
+package measurer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/ndt7/samplefields"
+	"github.com/m-lab/ndt-server/netx"
+)
+
+// HighResolution configures the optional high resolution sampler, which
+// samples TCP_INFO and BBR_INFO at a fixed interval, independently from the
+// measurements sent to the client, and archives the samples in the
+// ServerSamples of the subtest. The sampler is disabled when nil. Like
+// Sampling, it should only be changed at startup, before any test runs.
+var HighResolution *SampleConfig
+
+// SampleConfig configures the high resolution sampler. Use NewSampleConfig to
+// create one.
+type SampleConfig struct {
+	interval time.Duration
+	fields   []string
+	getters  []samplefields.Getter
+}
+
+// NewSampleConfig returns a SampleConfig for sampling the named variables
+// every interval. See samplefields.NewGetter for the names of the variables.
+func NewSampleConfig(interval time.Duration, fields []string) (*SampleConfig, error) {
+	if interval < time.Millisecond {
+		return nil, fmt.Errorf("sampling interval %s is shorter than 1ms", interval)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields to sample")
+	}
+	c := &SampleConfig{interval: interval, fields: fields}
+	for _, name := range fields {
+		g, err := samplefields.NewGetter(name)
+		if err != nil {
+			return nil, err
+		}
+		c.getters = append(c.getters, g)
+	}
+	return c, nil
+}
+
+// run samples ci every interval until ctx is done. Elapsed times are measured
+// from start.
+func (c *SampleConfig) run(ctx context.Context, ci netx.ConnInfo, start time.Time) *model.Samples {
+	samples := &model.Samples{
+		Interval: int64(c.interval / time.Microsecond),
+		Fields:   c.fields,
+	}
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return samples
+		case now := <-t.C:
+			bbrinfo, tcpInfo, err := ci.ReadInfo()
+			if err != nil {
+				continue
+			}
+			values := make([]int64, len(c.getters))
+			for i, get := range c.getters {
+				values[i] = get(&bbrinfo, &tcpInfo)
+			}
+			samples.Samples = append(samples.Samples, model.Sample{
+				ElapsedTime: int64(now.Sub(start) / time.Microsecond),
+				Values:      values,
+			})
+		}
+	}
+}
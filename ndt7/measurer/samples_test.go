@@ -0,0 +1,70 @@
+package measurer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server/bbr"
+	"github.com/m-lab/ndt-server/ndt7/samplefields"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+type fakeConnInfo struct{}
+
+func (fakeConnInfo) GetUUID() (string, error) { return "uuid", nil }
+func (fakeConnInfo) EnableBBR() error         { return nil }
+func (fakeConnInfo) ReadInfo() (inetdiag.BBRInfo, tcp.LinuxTCPInfo, error) {
+	return inetdiag.BBRInfo{BW: 1000}, tcp.LinuxTCPInfo{RTT: 20000, CAState: 1, BytesAcked: 1 << 40}, nil
+}
+func (fakeConnInfo) ReadCCInfo() (bbr.CCInfo, tcp.LinuxTCPInfo, error) {
+	return bbr.CCInfo{Algorithm: "cubic"}, tcp.LinuxTCPInfo{}, nil
+}
+
+func TestNewSampleConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		fields   []string
+		wantErr  bool
+	}{
+		{"defaults", 10 * time.Millisecond, samplefields.Default, false},
+		{"short-interval", 100 * time.Microsecond, samplefields.Default, true},
+		{"no-fields", 10 * time.Millisecond, nil, true},
+		{"unknown-struct", 10 * time.Millisecond, []string{"AppInfo.NumBytes"}, true},
+		{"unknown-field", 10 * time.Millisecond, []string{"TCPInfo.Nope"}, true},
+		{"no-struct", 10 * time.Millisecond, []string{"RTT"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSampleConfig(tt.interval, tt.fields)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewSampleConfig() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSampleConfig_run(t *testing.T) {
+	fields := []string{"TCPInfo.RTT", "TCPInfo.CAState", "TCPInfo.BytesAcked", "BBRInfo.BW"}
+	c, err := NewSampleConfig(time.Millisecond, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	samples := c.run(ctx, fakeConnInfo{}, time.Now())
+	if samples.Interval != 1000 || len(samples.Fields) != len(fields) {
+		t.Errorf("run() = %+v, want the interval and fields", samples)
+	}
+	if len(samples.Samples) == 0 {
+		t.Fatal("run() returned no samples")
+	}
+	want := []int64{20000, 1, 1 << 40, 1000}
+	for i, v := range samples.Samples[0].Values {
+		if v != want[i] {
+			t.Errorf("Values[%d] = %d, want %d", i, v, want[i])
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"io"
+	"net"
 	"strings"
 
 	"github.com/gorilla/websocket"
@@ -38,8 +40,71 @@ var (
 		},
 		[]string{"protocol", "direction", "error"},
 	)
+	SubtestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ndt7_subtest_duration_seconds",
+			Help:    "How long ndt7 subtests run.",
+			Buckets: prometheus.LinearBuckets(1, 1, 15),
+		},
+		[]string{"protocol", "direction"},
+	)
+	SubtestMinRTT = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ndt7_subtest_min_rtt_milliseconds",
+			Help:    "The minimum RTT of ndt7 subtests, from the last TCP_INFO sample.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		},
+		[]string{"protocol", "direction"},
+	)
+	SubtestRetransmission = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ndt7_subtest_retransmission_ratio",
+			Help:    "The ratio of retransmitted to sent bytes of ndt7 downloads.",
+			Buckets: []float64{0, 0.001, 0.005, 0.01, 0.02, 0.05, 0.1, 0.2, 0.5},
+		},
+		[]string{"protocol", "direction"},
+	)
+	SubtestBytes = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ndt7_subtest_bytes",
+			Help:    "The bytes transferred by ndt7 subtests: acked by the client for downloads, received from it for uploads.",
+			Buckets: prometheus.ExponentialBuckets(1e5, 4, 10),
+		},
+		[]string{"protocol", "direction"},
+	)
+	SubtestTerminations = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt7_subtest_terminations_total",
+			Help: "Number of ndt7 subtests by the reason they ended.",
+		},
+		[]string{"protocol", "direction", "reason"},
+	)
 )
 
+// TerminationReason returns the reason why a subtest ended with err, which is
+// nil when the subtest ran for its whole runtime. The interrupted argument
+// reports whether the server interrupted the subtest, e.g. on shutdown.
+func TerminationReason(err error, interrupted bool) string {
+	switch {
+	case interrupted:
+		return "interrupted"
+	case err == nil:
+		return "runtime-elapsed"
+	}
+	if _, ok := err.(*websocket.CloseError); ok || err == websocket.ErrCloseSent || err == io.EOF {
+		return "client-close"
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "broken pipe") || strings.Contains(msg, "connection reset by peer") {
+		return "client-close"
+	}
+	// The senders only write to the connection.
+	return "write-error"
+}
+
 // ConnLabel infers an appropriate label for the websocket protocol.
 func ConnLabel(conn *websocket.Conn) string {
 	// NOTE: this isn't perfect, but it is simple and a) works for production deployments,
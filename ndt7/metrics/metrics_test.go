@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTerminationReason(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		interrupted bool
+		want        string
+	}{
+		{"elapsed", nil, false, "runtime-elapsed"},
+		{"interrupted", errors.New("write: broken pipe"), true, "interrupted"},
+		{"close-frame", &websocket.CloseError{Code: websocket.CloseNormalClosure}, false, "client-close"},
+		{"close-sent", websocket.ErrCloseSent, false, "client-close"},
+		{"eof", io.EOF, false, "client-close"},
+		{"reset", os.NewSyscallError("write", syscall.ECONNRESET), false, "client-close"},
+		{"timeout", timeoutError{}, false, "timeout"},
+		{"other", errors.New("something else"), false, "write-error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TerminationReason(tt.err, tt.interrupted); got != tt.want {
+				t.Errorf("TerminationReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
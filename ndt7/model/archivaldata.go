@@ -3,7 +3,9 @@ package model
 import (
 	"time"
 
+	"github.com/m-lab/ndt-server/bbr"
 	"github.com/m-lab/ndt-server/metadata"
+	"github.com/m-lab/ndt-server/tcpinfox"
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/tcp"
 )
@@ -17,6 +19,35 @@ type ArchivalData struct {
 	ClientMeasurements []Measurement
 	ClientMetadata     []metadata.NameValue `json:",omitempty"`
 	ServerMetadata     []metadata.NameValue `json:",omitempty"`
+	Error              string               `json:",omitempty"`
+	// ClientCertificateSubject is the subject of the verified client
+	// certificate, when client certificates are required.
+	ClientCertificateSubject string `json:",omitempty"`
+	// ServerSamples are the samples of the optional high resolution sampler.
+	// Unlike ServerMeasurements, they are never sent to the client.
+	ServerSamples *Samples `json:",omitempty"`
+	// LimitingFactors tells what limited the transfer of a download subtest,
+	// in which the server is the sender.
+	LimitingFactors *tcpinfox.LimitingFactors `json:",omitempty"`
+}
+
+// Samples is a compact time series of TCP_INFO and BBR_INFO variables sampled
+// by the server at a fixed interval.
+type Samples struct {
+	// Interval is the sampling interval in microseconds.
+	Interval int64
+	// Fields names the sampled variables, e.g. "TCPInfo.RTT".
+	Fields  []string
+	Samples []Sample
+}
+
+// Sample is a sample of the variables named by Samples.Fields. Variables have
+// the same measurement unit that is used by the Linux kernel.
+type Sample struct {
+	// ElapsedTime is the time since the start of the subtest in microseconds.
+	ElapsedTime int64
+	// Values are the values of the variables, in the order of Samples.Fields.
+	Values []int64
 }
 
 // The Measurement struct contains measurement results. This structure is
@@ -27,6 +58,7 @@ type Measurement struct {
 	ConnectionInfo *ConnectionInfo `json:",omitempty" bigquery:"-"`
 	BBRInfo        *BBRInfo        `json:",omitempty"`
 	TCPInfo        *TCPInfo        `json:",omitempty"`
+	CCInfo         *CCInfo         `json:",omitempty"`
 }
 
 // AppInfo contains an application level measurement. This structure is
@@ -42,6 +74,10 @@ type ConnectionInfo struct {
 	Client string
 	Server string
 	UUID   string `json:",omitempty"`
+	// ResultSecret is the one-time secret that retrieves the result of the
+	// subtest from spec.ResultURLPath. It is only sent to the client, in a
+	// message before the first measurement, and is never archived.
+	ResultSecret string `json:",omitempty" bigquery:"-"`
 }
 
 // The BBRInfo struct contains information measured using BBR. This structure is
@@ -52,6 +88,16 @@ type BBRInfo struct {
 	ElapsedTime int64
 }
 
+// The CCInfo struct contains information measured using TCP_CC_INFO, whatever
+// the congestion control. This structure is an extension to the ndt7
+// specification. When the congestion control is BBR, BBRInfo contains the
+// same variables, for the clients that do not know about CCInfo. Variables
+// here have the same measurement unit that is used by the Linux kernel.
+type CCInfo struct {
+	bbr.CCInfo
+	ElapsedTime int64
+}
+
 // The TCPInfo struct contains information measured using TCP_INFO. This
 // structure is described in the ndt7 specification.
 type TCPInfo struct {
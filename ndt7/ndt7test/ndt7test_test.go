@@ -6,11 +6,14 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/m-lab/go/testingx"
+	"github.com/m-lab/ndt-server/events"
+	"github.com/m-lab/ndt-server/events/eventstest"
 	"github.com/m-lab/ndt-server/ndt7/spec"
 )
 
@@ -18,6 +21,10 @@ func TestNewNDT7Server(t *testing.T) {
 	// Create the ndt7test server.
 	h, srv := NewNDT7Server(t)
 	defer os.RemoveAll(h.DataDir)
+	ev, client, cleanup := eventstest.NewEventServer(t)
+	defer cleanup()
+	events.SetDefault(ev)
+	defer events.SetDefault(nil)
 
 	// Prepare to run a simplified download with ndt7test server.
 	URL, _ := url.Parse(srv.URL)
@@ -43,6 +50,12 @@ func TestNewNDT7Server(t *testing.T) {
 	if len(m) == 0 {
 		t.Errorf("no files found")
 	}
+
+	// Verify the connection events carry the UUID of the result.
+	uuid, _ := client.Expect(t, 10*time.Second)
+	if len(m) > 0 && !strings.Contains(m[0], uuid) {
+		t.Errorf("event UUID %q does not match the result file %s", uuid, m[0])
+	}
 }
 
 func simpleDownload(ctx context.Context, t *testing.T, conn *websocket.Conn) error {
@@ -15,6 +15,7 @@ import (
 	"github.com/m-lab/ndt-server/ndt7/model"
 	"github.com/m-lab/ndt-server/ndt7/ping"
 	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/netx"
 )
 
 type receiverKind int
@@ -28,15 +29,16 @@ func start(
 	ctx context.Context, conn *websocket.Conn, kind receiverKind,
 	data *model.ArchivalData,
 ) {
-	logging.Logger.Debug("receiver: start")
+	logger := logging.FromContext(ctx)
+	logger.Debug("receiver: start")
 	proto := ndt7metrics.ConnLabel(conn)
-	defer logging.Logger.Debug("receiver: stop")
+	defer logger.Debug("receiver: stop")
 	conn.SetReadLimit(spec.MaxMessageSize)
 	receiverctx, cancel := context.WithTimeout(ctx, spec.MaxRuntime)
 	defer cancel()
 	err := conn.SetReadDeadline(time.Now().Add(spec.MaxRuntime)) // Liveness!
 	if err != nil {
-		logging.Logger.WithError(err).Warn("receiver: conn.SetReadDeadline failed")
+		logger.WithError(err).Warn("receiver: conn.SetReadDeadline failed")
 		ndt7metrics.ClientReceiverErrors.WithLabelValues(
 			proto, fmt.Sprint(kind), "set-read-deadline").Inc()
 		return
@@ -45,18 +47,22 @@ func start(
 		rtt, err := ping.ParseTicks(s)
 		if err == nil {
 			rtt /= int64(time.Millisecond)
-			logging.Logger.Debugf("receiver: ApplicationLevel RTT: %d ms", rtt)
+			logger.Debugf("receiver: ApplicationLevel RTT: %d ms", rtt)
 		} else {
 			ndt7metrics.ClientReceiverErrors.WithLabelValues(
 				proto, fmt.Sprint(kind), "ping-parse-ticks").Inc()
 		}
 		return err
 	})
+	rec := netx.ToTimeline(conn.LocalAddr())
 	for receiverctx.Err() == nil { // Liveness!
 		// By getting a Reader here we avoid allocating memory for the message
 		// when the message type is not websocket.TextMessage.
 		mtype, r, err := conn.NextReader()
 		if err != nil {
+			if _, ok := err.(*websocket.CloseError); ok {
+				rec.Mark("close-received")
+			}
 			ndt7metrics.ClientReceiverErrors.WithLabelValues(
 				proto, fmt.Sprint(kind), "read-message-type").Inc()
 			return
@@ -64,12 +70,13 @@ func start(
 		if mtype != websocket.TextMessage {
 			switch kind {
 			case downloadReceiver:
-				logging.Logger.Warn("receiver: got non-Text message")
+				logger.Warn("receiver: got non-Text message")
 				ndt7metrics.ClientReceiverErrors.WithLabelValues(
 					proto, fmt.Sprint(kind), "wrong-message-type").Inc()
 				return // Unexpected message type
 			default:
 				// NOTE: this is the bulk upload path. In this case, the mdata is not used.
+				rec.Mark("first-bulk-byte")
 				continue // No further processing required
 			}
 		}
@@ -83,7 +90,7 @@ func start(
 		var measurement model.Measurement
 		err = json.Unmarshal(mdata, &measurement)
 		if err != nil {
-			logging.Logger.WithError(err).Warn("receiver: json.Unmarshal failed")
+			logger.WithError(err).Warn("receiver: json.Unmarshal failed")
 			ndt7metrics.ClientReceiverErrors.WithLabelValues(
 				proto, fmt.Sprint(kind), "unmarshal-client-message").Inc()
 			return
@@ -0,0 +1,239 @@
+// Package retrieval lets clients fetch the result of an ndt7 subtest from the
+// server after the test, so that they can see exactly what the server
+// recorded. A Store keeps the results of recent subtests in memory. Access to
+// a result is granted when the subtest starts, either to the holder of a
+// one-time secret that the server sends to the client in a ConnectionInfo
+// message, or to the holder of the access token used for the subtest.
+package retrieval
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/access/controller"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/sink"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ErrNotFound is returned by Get when there is no result for a UUID, or
+	// when the credentials do not grant access to it. Both cases are reported
+	// the same way, so that clients cannot probe for the UUIDs of other tests.
+	ErrNotFound = errors.New("result not found")
+
+	// ErrPending is returned by Get when the subtest has not finished yet.
+	ErrPending = errors.New("result not available yet")
+
+	retrievals = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt7_result_retrievals_total",
+			Help: "Number of requests for the result of an ndt7 subtest, by how access was granted and outcome.",
+		},
+		[]string{"auth", "result"},
+	)
+	storedResults = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ndt7_result_retrieval_stored",
+			Help: "Number of ndt7 subtests whose results may be retrieved.",
+		},
+	)
+)
+
+// Store keeps the results of the most recent ndt7 subtests for a limited time.
+// Store implements sink.ResultSink, and keeps only the results of subtests
+// that were granted access with Grant.
+type Store struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	// order contains the UUIDs in entries, oldest first.
+	order []string
+}
+
+type entry struct {
+	created time.Time
+	// secret is the hash of the one-time secret, and is cleared once the
+	// secret has been used.
+	secret []byte
+	// token is the hash of the access token, if any.
+	token  []byte
+	result interface{}
+}
+
+// New creates a Store that keeps at most size results, each for at most ttl.
+func New(size int, ttl time.Duration) *Store {
+	return &Store{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Grant allows access to the result of the subtest with the given UUID, and
+// returns the one-time secret that grants it. When token is not empty, the
+// result may also be retrieved with the same access token for as long as it
+// is kept. It is safe to call Grant on a nil Store, which returns an empty
+// secret.
+func (s *Store) Grant(uuid, token string) (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(b)
+	e := &entry{created: time.Now(), secret: hash(secret)}
+	if token != "" {
+		e.token = hash(token)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.entries[uuid]; !found {
+		s.order = append(s.order, uuid)
+	}
+	s.entries[uuid] = e
+	s.expire(e.created)
+	return secret, nil
+}
+
+// expire removes the entries that are too old, and the oldest entries beyond
+// the size of the Store. It must be called with s.mu held.
+func (s *Store) expire(now time.Time) {
+	for len(s.order) > 0 {
+		e := s.entries[s.order[0]]
+		if len(s.order) <= s.size && now.Sub(e.created) < s.ttl {
+			break
+		}
+		delete(s.entries, s.order[0])
+		s.order = s.order[1:]
+	}
+	storedResults.Set(float64(len(s.order)))
+}
+
+// Write keeps the result of an ndt7 subtest that was granted access.
+func (s *Store) Write(r *sink.Result) error {
+	if r.Protocol != "ndt7" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, found := s.entries[r.UUID]; found {
+		e.result = r.Data
+	}
+	return nil
+}
+
+// Close does nothing, because the results are only kept in memory.
+func (s *Store) Close() error {
+	return nil
+}
+
+// Get returns the result of the subtest with the given UUID, when secret or
+// token grants access to it. The secret can only be used once. The returned
+// string describes how access was granted.
+func (s *Store) Get(uuid, secret, token string) (interface{}, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+	e, found := s.entries[uuid]
+	if !found {
+		return nil, "none", ErrNotFound
+	}
+	auth := "none"
+	switch {
+	case secret != "" && e.secret != nil && equal(e.secret, hash(secret)):
+		auth = "secret"
+	case token != "" && e.token != nil && equal(e.token, hash(token)):
+		auth = "token"
+	default:
+		return nil, auth, ErrNotFound
+	}
+	if e.result == nil {
+		// The secret is not used up, so the client may try again later.
+		return nil, auth, ErrPending
+	}
+	if auth == "secret" {
+		e.secret = nil
+	}
+	return e.result, auth, nil
+}
+
+// ServeHTTP serves GET requests for spec.ResultURLPath followed by a UUID. The
+// secret is read from the "Authorization: Bearer" header, or from the "secret"
+// query parameter. An access token is only considered when it was verified by
+// the access token controller, which stores the verified claims in the request
+// context.
+func (s *Store) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		// 405 - https://tools.ietf.org/html/rfc7231#section-6.5.5
+		rw.Header().Set("Allow", http.MethodGet)
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	uuid := strings.TrimPrefix(req.URL.Path, spec.ResultURLPath)
+	if uuid == "" || strings.Contains(uuid, "/") {
+		// 404 - https://tools.ietf.org/html/rfc7231#section-6.5.4
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	secret := req.URL.Query().Get("secret")
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		secret = strings.TrimPrefix(h, "Bearer ")
+	}
+	result, auth, err := s.Get(uuid, secret, VerifiedToken(req))
+	switch err {
+	case nil:
+	case ErrPending:
+		retrievals.WithLabelValues(auth, "pending").Inc()
+		// 409 - https://tools.ietf.org/html/rfc7231#section-6.5.8
+		rw.WriteHeader(http.StatusConflict)
+		return
+	default:
+		retrievals.WithLabelValues(auth, "not-found").Inc()
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		logging.Logger.WithError(err).Warn("retrieval: could not marshal result")
+		retrievals.WithLabelValues(auth, "error").Inc()
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	retrievals.WithLabelValues(auth, "ok").Inc()
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Write(body)
+}
+
+// VerifiedToken returns the access token of req when the access token
+// controller has verified it, and an empty string otherwise.
+func VerifiedToken(req *http.Request) string {
+	if controller.GetClaim(req.Context()) == nil {
+		return ""
+	}
+	return req.Form.Get("access_token")
+}
+
+func hash(s string) []byte {
+	h := sha256.Sum256([]byte(s))
+	return h[:]
+}
+
+func equal(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
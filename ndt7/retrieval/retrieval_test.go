@@ -0,0 +1,116 @@
+package retrieval
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/m-lab/access/controller"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/ndt7/spec"
+	"github.com/m-lab/ndt-server/sink"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func get(s *Store, uuid, secret, token string, verified bool) *httptest.ResponseRecorder {
+	v := url.Values{}
+	if token != "" {
+		v.Set("access_token", token)
+	}
+	req := httptest.NewRequest(http.MethodGet, spec.ResultURLPath+uuid+"?"+v.Encode(), nil)
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	req.ParseForm()
+	if verified {
+		req = req.WithContext(controller.SetClaim(context.Background(), &jwt.Claims{Subject: "client"}))
+	}
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestStore(t *testing.T) {
+	s := New(10, time.Minute)
+	secret, err := s.Grant("abc", "token")
+	rtx.Must(err, "Grant failed")
+	if secret == "" {
+		t.Fatal("Grant() returned an empty secret")
+	}
+
+	// The result is not written yet.
+	if rw := get(s, "abc", secret, "", false); rw.Code != http.StatusConflict {
+		t.Errorf("get() before Write = %d, want %d", rw.Code, http.StatusConflict)
+	}
+	rtx.Must(s.Write(&sink.Result{Protocol: "ndt7", UUID: "abc", Data: map[string]int{"x": 1}}), "Write failed")
+	// Results of other protocols, and of tests without a grant, are ignored.
+	rtx.Must(s.Write(&sink.Result{Protocol: "ndt5", UUID: "def", Data: 1}), "Write failed")
+	rtx.Must(s.Write(&sink.Result{Protocol: "ndt7", UUID: "def", Data: 1}), "Write failed")
+
+	tests := []struct {
+		name     string
+		uuid     string
+		secret   string
+		token    string
+		verified bool
+		want     int
+	}{
+		{name: "no-credentials", uuid: "abc", want: http.StatusNotFound},
+		{name: "wrong-secret", uuid: "abc", secret: "wrong", want: http.StatusNotFound},
+		{name: "unknown-uuid", uuid: "def", secret: secret, want: http.StatusNotFound},
+		{name: "secret", uuid: "abc", secret: secret, want: http.StatusOK},
+		{name: "secret-used", uuid: "abc", secret: secret, want: http.StatusNotFound},
+		{name: "unverified-token", uuid: "abc", token: "token", want: http.StatusNotFound},
+		{name: "wrong-token", uuid: "abc", token: "other", verified: true, want: http.StatusNotFound},
+		{name: "token", uuid: "abc", token: "token", verified: true, want: http.StatusOK},
+		{name: "token-again", uuid: "abc", token: "token", verified: true, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := get(s, tt.uuid, tt.secret, tt.token, tt.verified)
+			if rw.Code != tt.want {
+				t.Fatalf("get() = %d, want %d", rw.Code, tt.want)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			body, err := ioutil.ReadAll(rw.Body)
+			rtx.Must(err, "could not read body")
+			if string(body) != `{"x":1}` {
+				t.Errorf("get() body = %s, want the result", body)
+			}
+		})
+	}
+}
+
+func TestStoreExpire(t *testing.T) {
+	s := New(2, time.Minute)
+	for _, uuid := range []string{"a", "b", "c"} {
+		_, err := s.Grant(uuid, "")
+		rtx.Must(err, "Grant failed")
+	}
+	if _, found := s.entries["a"]; found || len(s.entries) != 2 {
+		t.Errorf("Store kept %d entries, want the 2 newest", len(s.entries))
+	}
+
+	s = New(10, time.Millisecond)
+	secret, err := s.Grant("a", "")
+	rtx.Must(err, "Grant failed")
+	rtx.Must(s.Write(&sink.Result{Protocol: "ndt7", UUID: "a", Data: 1}), "Write failed")
+	time.Sleep(10 * time.Millisecond)
+	if _, _, err := s.Get("a", secret, ""); err != ErrNotFound {
+		t.Errorf("Get() after ttl = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestGrantNil(t *testing.T) {
+	var s *Store
+	secret, err := s.Grant("a", "token")
+	if secret != "" || err != nil {
+		t.Errorf("Grant() on nil Store = %q, %v, want no secret", secret, err)
+	}
+}
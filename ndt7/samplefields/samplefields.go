@@ -0,0 +1,75 @@
+// Package samplefields names the variables that the high resolution sampler
+// of ndt7 may keep. It only depends on the TCPInfo and BBRInfo structs, so
+// that the config package can check the names without the measurer.
+package samplefields
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// Default are the variables kept by the high resolution sampler unless
+// configured otherwise.
+var Default = []string{
+	"TCPInfo.RTT", "TCPInfo.RTTVar", "TCPInfo.SndCwnd", "TCPInfo.SndSsThresh",
+	"TCPInfo.BytesAcked", "TCPInfo.BytesRetrans", "TCPInfo.Lost",
+	"TCPInfo.DeliveryRate", "BBRInfo.BW", "BBRInfo.MinRTT",
+}
+
+// Getter returns the value of a variable from a sample.
+type Getter func(bbr *inetdiag.BBRInfo, ti *tcp.LinuxTCPInfo) int64
+
+// Check returns an error for the first of names that cannot be sampled.
+func Check(names []string) error {
+	for _, name := range names {
+		if _, err := NewGetter(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewGetter returns the Getter of the named variable. The names are the names
+// of the integer fields of tcp.LinuxTCPInfo and inetdiag.BBRInfo, prefixed
+// with "TCPInfo." and "BBRInfo." respectively.
+func NewGetter(name string) (Getter, error) {
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("unknown field %q", name)
+	}
+	var t reflect.Type
+	switch parts[0] {
+	case "TCPInfo":
+		t = reflect.TypeOf(tcp.LinuxTCPInfo{})
+	case "BBRInfo":
+		t = reflect.TypeOf(inetdiag.BBRInfo{})
+	default:
+		return nil, fmt.Errorf("unknown field %q", name)
+	}
+	f, ok := t.FieldByName(parts[1])
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", name)
+	}
+	var value func(v reflect.Value) int64
+	switch f.Type.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		value = func(v reflect.Value) int64 { return v.Int() }
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		value = func(v reflect.Value) int64 { return int64(v.Uint()) }
+	default:
+		return nil, fmt.Errorf("field %q is not an integer", name)
+	}
+	index := f.Index
+	if parts[0] == "TCPInfo" {
+		return func(_ *inetdiag.BBRInfo, ti *tcp.LinuxTCPInfo) int64 {
+			return value(reflect.ValueOf(ti).Elem().FieldByIndex(index))
+		}, nil
+	}
+	return func(bbr *inetdiag.BBRInfo, _ *tcp.LinuxTCPInfo) int64 {
+		return value(reflect.ValueOf(bbr).Elem().FieldByIndex(index))
+	}, nil
+}
@@ -0,0 +1,42 @@
+package samplefields
+
+import (
+	"testing"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		wantErr bool
+	}{
+		{"defaults", Default, false},
+		{"unknown-struct", []string{"AppInfo.NumBytes"}, true},
+		{"unknown-field", []string{"TCPInfo.RTT", "TCPInfo.Nope"}, true},
+		{"no-struct", []string{"RTT"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Check(tt.names); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewGetter(t *testing.T) {
+	bbr := &inetdiag.BBRInfo{BW: 1000}
+	ti := &tcp.LinuxTCPInfo{RTT: 20000, CAState: 1}
+	for name, want := range map[string]int64{"TCPInfo.RTT": 20000, "TCPInfo.CAState": 1, "BBRInfo.BW": 1000} {
+		get, err := NewGetter(name)
+		if err != nil {
+			t.Fatalf("NewGetter(%q) error = %v", name, err)
+		}
+		if got := get(bbr, ti); got != want {
+			t.Errorf("NewGetter(%q)() = %d, want %d", name, got, want)
+		}
+	}
+}
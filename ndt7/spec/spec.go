@@ -9,6 +9,9 @@ const DownloadURLPath = "/ndt/v7/download"
 // UploadURLPath selects the upload subtest.
 const UploadURLPath = "/ndt/v7/upload"
 
+// ResultURLPath, followed by the UUID of a subtest, retrieves its result.
+const ResultURLPath = "/ndt/v7/result/"
+
 // SecWebSocketProtocol is the WebSocket subprotocol used by ndt7.
 const SecWebSocketProtocol = "net.measurementlab.ndt.v7"
 
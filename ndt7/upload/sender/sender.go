@@ -22,20 +22,24 @@ import (
 // MaxRuntime of the subtest. This is enforced by setting the write deadline to
 // Time.Now() + MaxRuntime.
 func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData) error {
-	logging.Logger.Debug("sender: start")
+	logger := logging.FromContext(ctx)
+	logger.Debug("sender: start")
 	proto := ndt7metrics.ConnLabel(conn)
 
 	// Start collecting connection measurements. Measurements will be sent to
 	// src until DefaultRuntime, when the src channel is closed.
 	mr := measurer.New(conn, data.UUID)
 	src := mr.Start(ctx, spec.DefaultRuntime)
-	defer logging.Logger.Debug("sender: stop")
-	defer mr.Stop(src)
+	defer logger.Debug("sender: stop")
+	defer func() {
+		mr.Stop(src)
+		data.ServerSamples = mr.Samples()
+	}()
 
 	deadline := time.Now().Add(spec.MaxRuntime)
 	err := conn.SetWriteDeadline(deadline) // Liveness!
 	if err != nil {
-		logging.Logger.WithError(err).Warn("sender: conn.SetWriteDeadline failed")
+		logger.WithError(err).Warn("sender: conn.SetWriteDeadline failed")
 		ndt7metrics.ClientSenderErrors.WithLabelValues(
 			proto, string(spec.SubtestUpload), "set-write-deadline").Inc()
 		return err
@@ -49,13 +53,13 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 	for {
 		m, ok := <-src
 		if !ok { // This means that the previous step has terminated
-			closer.StartClosing(conn)
+			closer.StartClosing(ctx, conn)
 			ndt7metrics.ClientSenderErrors.WithLabelValues(
 				proto, string(spec.SubtestUpload), "measurer-closed").Inc()
 			return nil
 		}
 		if err := conn.WriteJSON(m); err != nil {
-			logging.Logger.WithError(err).Warn("sender: conn.WriteJSON failed")
+			logger.WithError(err).Warn("sender: conn.WriteJSON failed")
 			ndt7metrics.ClientSenderErrors.WithLabelValues(
 				proto, string(spec.SubtestUpload), "write-json").Inc()
 			return err
@@ -63,7 +67,7 @@ func Start(ctx context.Context, conn *websocket.Conn, data *model.ArchivalData)
 		// Only save measurements sent to the client.
 		data.ServerMeasurements = append(data.ServerMeasurements, m)
 		if err := ping.SendTicks(conn, deadline); err != nil {
-			logging.Logger.WithError(err).Warn("sender: ping.SendTicks failed")
+			logger.WithError(err).Warn("sender: ping.SendTicks failed")
 			ndt7metrics.ClientSenderErrors.WithLabelValues(
 				proto, string(spec.SubtestUpload), "ping-send-ticks").Inc()
 			return err
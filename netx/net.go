@@ -2,7 +2,7 @@ package netx
 
 import (
 	"crypto/tls"
-	"log"
+	"fmt"
 	"net"
 	"os"
 	"sync"
@@ -14,7 +14,9 @@ import (
 
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/ndt-server/bbr"
+	"github.com/m-lab/ndt-server/logging"
 	"github.com/m-lab/ndt-server/netx/iface"
+	"github.com/m-lab/ndt-server/timeline"
 	"github.com/m-lab/tcp-info/inetdiag"
 	"github.com/m-lab/tcp-info/tcp"
 )
@@ -50,9 +52,10 @@ func NewListener(l *net.TCPListener) *Listener {
 // additional operations on the Conn file descriptor.
 type Conn struct {
 	net.Conn
-	fp      *os.File
-	netinfo iface.NetInfo
-	once    sync.Once
+	fp       *os.File
+	netinfo  iface.NetInfo
+	once     sync.Once
+	timeline *timeline.Recorder
 }
 
 // Addr supports the net.Addr interface and allows mediated access to operations
@@ -83,6 +86,7 @@ type ConnInfo interface {
 	GetUUID() (string, error)
 	EnableBBR() error
 	ReadInfo() (inetdiag.BBRInfo, tcp.LinuxTCPInfo, error)
+	ReadCCInfo() (bbr.CCInfo, tcp.LinuxTCPInfo, error)
 }
 
 // Accept a connection, set 3min keepalive, and return a Conn that enables
@@ -101,9 +105,15 @@ func (ln *Listener) Accept() (net.Conn, error) {
 	}
 	CurrentOpenConns.Inc()
 	mc := &Conn{
-		Conn:    tc,
-		fp:      fp,
-		netinfo: &iface.RealConnInfo{},
+		Conn:     tc,
+		fp:       fp,
+		netinfo:  &iface.RealConnInfo{},
+		timeline: timeline.NewRecorder(time.Now()),
+	}
+	mc.timeline.Mark("accept")
+	// The first sample approximates the RTT of the TCP handshake.
+	if _, info, err := mc.ReadInfo(); err == nil {
+		mc.timeline.SetFirstRTT(info.RTT)
 	}
 	return mc, nil
 }
@@ -126,15 +136,26 @@ func (mc *Conn) EnableBBR() error {
 // the underlying connection, then ReadInfo will return an empty BBRInfo struct.
 // If TCP info metrics cannot be read, an error is returned.
 func (mc *Conn) ReadInfo() (inetdiag.BBRInfo, tcp.LinuxTCPInfo, error) {
-	bbrinfo, err := mc.netinfo.GetBBRInfo(mc.fp)
+	ccinfo, tcpInfo, err := mc.ReadCCInfo()
+	if err != nil || ccinfo.BBR == nil {
+		return inetdiag.BBRInfo{}, tcpInfo, err
+	}
+	return ccinfo.BBR.BBRInfo, tcpInfo, nil
+}
+
+// ReadCCInfo is like ReadInfo, but it reads the congestion control info of
+// any congestion control, not only BBR. If it cannot be read, then ReadCCInfo
+// returns an empty CCInfo struct.
+func (mc *Conn) ReadCCInfo() (bbr.CCInfo, tcp.LinuxTCPInfo, error) {
+	ccinfo, err := mc.netinfo.GetCCInfo(mc.fp)
 	if err != nil {
-		bbrinfo = inetdiag.BBRInfo{}
+		ccinfo = bbr.CCInfo{}
 	}
 	tcpInfo, err := mc.netinfo.GetTCPInfo(mc.fp)
 	if err != nil {
-		return inetdiag.BBRInfo{}, tcp.LinuxTCPInfo{}, err
+		return bbr.CCInfo{}, tcp.LinuxTCPInfo{}, err
 	}
-	return bbrinfo, *tcpInfo, nil
+	return ccinfo, *tcpInfo, nil
 }
 
 // GetUUID returns the connection's UUID.
@@ -170,6 +191,47 @@ func (mc *Conn) RemoteAddr() net.Addr {
 	}
 }
 
+// Timeline returns the Recorder of the steps of the tests on the connection.
+func (mc *Conn) Timeline() *timeline.Recorder {
+	return mc.timeline
+}
+
+// ToTimeline is a helper function for extracting the timeline Recorder of the
+// Conn that the local or remote address addr belongs to. ToTimeline returns nil
+// if addr does not belong to a Conn.
+func ToTimeline(addr net.Addr) *timeline.Recorder {
+	if a, ok := addr.(*Addr); ok && a.parentConn != nil {
+		return a.parentConn.timeline
+	}
+	return nil
+}
+
+// RecordTLSHandshake configures config to mark the step "tls-handshake-done"
+// on the timeline of every Conn once the server has verified the handshake of
+// the client. It must be called after the rest of config is set up.
+func RecordTLSHandshake(config *tls.Config) {
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		rec := ToTimeline(hello.Conn.LocalAddr())
+		if rec == nil {
+			return nil, nil
+		}
+		// Session ticket keys are still taken from the original config.
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		verify := config.VerifyConnection
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			rec.Mark("tls-handshake-done")
+			return nil
+		}
+		return c, nil
+	}
+}
+
 // ToTCPAddr is a helper function for extracting the net.TCPAddr type from a
 // net.Addr of various origins. ToTCPAddr returns nil if addr does not contain a
 // *net.TCPAddr.
@@ -180,7 +242,7 @@ func ToTCPAddr(addr net.Addr) *net.TCPAddr {
 	case *net.TCPAddr:
 		return a
 	default:
-		log.Printf("unsupported conn type: %T", a)
+		logging.Logger.WithField("type", fmt.Sprintf("%T", a)).Warn("netx: unsupported addr type")
 		return nil
 	}
 }
@@ -195,7 +257,7 @@ func ToConnInfo(conn net.Conn) ConnInfo {
 	case *tls.Conn:
 		return c.LocalAddr().(*Addr).parentConn
 	default:
-		log.Printf("unsupported conn type: %T", c)
+		logging.Logger.WithField("type", fmt.Sprintf("%T", c)).Warn("netx: unsupported conn type")
 		return nil
 	}
 }
@@ -11,7 +11,7 @@ import (
 	"testing"
 
 	"github.com/m-lab/go/rtx"
-	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/ndt-server/bbr"
 	"github.com/m-lab/tcp-info/tcp"
 )
 
@@ -98,8 +98,8 @@ type errorNetInfo struct{}
 func (e *errorNetInfo) GetUUID(fp *os.File) (string, error) {
 	return "", fmt.Errorf("fake get uuid error")
 }
-func (e *errorNetInfo) GetBBRInfo(fp *os.File) (inetdiag.BBRInfo, error) {
-	return inetdiag.BBRInfo{}, nil
+func (e *errorNetInfo) GetCCInfo(fp *os.File) (bbr.CCInfo, error) {
+	return bbr.CCInfo{}, nil
 }
 func (e *errorNetInfo) GetTCPInfo(fp *os.File) (*tcp.LinuxTCPInfo, error) {
 	return nil, fmt.Errorf("fake get tcpinfo error")
@@ -130,6 +130,17 @@ func TestConn(t *testing.T) {
 		t.Errorf("ToTCPAddr(conn.RemoteAddr()) returned nil addr")
 	}
 
+	rec := ToTimeline(conn.RemoteAddr())
+	if rec == nil || rec != ToTimeline(conn.LocalAddr()) {
+		t.Fatalf("ToTimeline() = %v, want the timeline of the Conn", rec)
+	}
+	if tl := rec.Timeline(); len(tl.Events) != 1 || tl.Events[0].Name != "accept" {
+		t.Errorf("Timeline() = %+v, want the accept step", tl)
+	}
+	if ToTimeline(&net.TCPAddr{}) != nil {
+		t.Errorf("ToTimeline() of a TCPAddr should be nil")
+	}
+
 	ci := ToConnInfo(conn)
 	ci.EnableBBR()
 	id, err := ci.GetUUID()
@@ -141,6 +152,11 @@ func TestConn(t *testing.T) {
 		// TODO: make testing work on non-linux platforms.
 		t.Errorf("ConnInfo.ReadInfo error: %#v, %#v %#v", err, bi, ti)
 	}
+	cci, _, err := ci.ReadCCInfo()
+	if err != nil || cci.Algorithm == "" {
+		// TODO: make testing work on non-linux platforms.
+		t.Errorf("ConnInfo.ReadCCInfo error: %#v, %#v", err, cci)
+	}
 
 	// Reset the netinfo value to always fail.
 	c := conn.(*Conn)
@@ -0,0 +1,97 @@
+// Package results writes the gzip compressed result files shared by all
+// protocols. Every file is named after the protocol, the kind of test, the
+// time it was written and the UUID of the test, so that a single ingestion
+// pipeline can handle the results of all protocols.
+package results
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"path"
+	"time"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/safefile"
+)
+
+// File is the file where we save measurements.
+type File struct {
+	// Writer is the gzip writer instance
+	Writer *gzip.Writer
+
+	// Fp is the underlying file, which appears under its final name only
+	// once it has been closed.
+	Fp *safefile.File
+
+	// UUID is the UUID of this subtest
+	UUID string
+}
+
+// Name returns the path of the file for a result written at timestamp,
+// relative to the data directory.
+func Name(protocol, kind, uuid string, timestamp time.Time) string {
+	timestamp = timestamp.UTC()
+	return path.Join(protocol, timestamp.Format("2006/01/02"),
+		protocol+"-"+kind+"-"+timestamp.Format("20060102T150405.000000000Z")+"."+uuid+".json.gz")
+}
+
+// newFile creates a measurements file in datadir on success and returns an
+// error on failure.
+func newFile(datadir, protocol, kind, uuid string) (*File, error) {
+	// My assumption here is that we have nanosecond precision and hence it's
+	// unlikely to have conflicts. If I'm wrong, safefile.Create will let us know.
+	fp, err := safefile.Create(datadir, Name(protocol, kind, uuid, time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	writer, err := gzip.NewWriterLevel(fp, gzip.BestSpeed)
+	if err != nil {
+		fp.Abort()
+		return nil, err
+	}
+	return &File{
+		Writer: writer,
+		Fp:     fp,
+		UUID:   uuid,
+	}, nil
+}
+
+// NewFile creates a file for saving results in datadir named after the
+// protocol, kind and uuid. Returns the results file on success. Returns an
+// error in case of failure. The "datadir" argument specifies the directory on
+// disk to write the data into. The protocol is "ndt5" or "ndt7", and the kind
+// argument names the test, e.g. spec.SubtestDownload or spec.SubtestUpload for
+// ndt7 measurements.
+func NewFile(datadir, protocol, kind, uuid string) (*File, error) {
+	fp, err := newFile(datadir, protocol, kind, uuid)
+	if err != nil {
+		logging.Logger.WithError(err).Warn("newFile failed")
+		return nil, err
+	}
+	return fp, nil
+}
+
+// Close closes the measurement file and stores it under its final name.
+func (fp *File) Close() error {
+	err := fp.Writer.Close()
+	if err != nil {
+		fp.Fp.Abort()
+		return err
+	}
+	return fp.Fp.Close()
+}
+
+// Abort discards the measurement file.
+func (fp *File) Abort() error {
+	return fp.Fp.Abort()
+}
+
+// WriteResult serializes |result| as JSON.
+func (fp *File) WriteResult(result interface{}) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = fp.Writer.Write(data)
+	return err
+}
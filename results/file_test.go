@@ -0,0 +1,48 @@
+package results
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+)
+
+func TestName(t *testing.T) {
+	ts := time.Date(2020, 3, 4, 5, 6, 7, 8, time.FixedZone("x", 3600))
+	want := "ndt5/2020/03/04/ndt5-result-20200304T040607.000000008Z.uuid.json.gz"
+	if got := Name("ndt5", "result", "uuid", ts); got != want {
+		t.Errorf("Name() = %q, want %q", got, want)
+	}
+}
+
+func TestNewFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNewFile")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	fp, err := NewFile(dir, "ndt7", "upload", "uuid")
+	rtx.Must(err, "Could not create file")
+	rtx.Must(fp.WriteResult(map[string]string{"UUID": "uuid"}), "Could not write result")
+	rtx.Must(fp.Close(), "Could not close file")
+
+	m, err := filepath.Glob(filepath.Join(dir, "ndt7/*/*/*/ndt7-upload-*.uuid.json.gz"))
+	rtx.Must(err, "Could not glob")
+	if len(m) != 1 {
+		t.Fatalf("found %v, want exactly one file", m)
+	}
+	f, err := os.Open(m[0])
+	rtx.Must(err, "Could not open file")
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	rtx.Must(err, "Could not read gzip header")
+	var got map[string]string
+	rtx.Must(json.NewDecoder(r).Decode(&got), "Could not decode result")
+	if got["UUID"] != "uuid" {
+		t.Errorf("result = %v, want the written result", got)
+	}
+}
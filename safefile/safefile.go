@@ -0,0 +1,239 @@
+// Package safefile writes result files so that they appear in the data
+// directory only once they are complete. Uploaders such as pusher may pick up
+// any file in the data directory, and a crash in the middle of a write would
+// otherwise leave a truncated file behind. A File is written to a temporary
+// name outside of the data type directories, synced to disk and then renamed
+// to its final name.
+//
+// Temporary files left behind by a crash are handled by Recover when the
+// server starts: complete files are moved to their final names, and all others
+// are moved aside for inspection.
+package safefile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// TempDir is the directory, relative to the data directory, that holds
+	// files that are being written.
+	TempDir = ".tmp"
+	// QuarantineDir is the directory, relative to the data directory, where
+	// Recover moves incomplete files.
+	QuarantineDir = ".quarantine"
+
+	tempSuffix = ".tmp"
+)
+
+var (
+	fileWrites = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_result_file_writes_total",
+			Help: "Number of result files written, by outcome.",
+		},
+		[]string{"result"},
+	)
+	fileWriteDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "ndt_result_file_write_duration_seconds",
+			Help:    "Time from creating a result file until it is safely stored under its final name.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+	)
+	fileRecoveries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_result_file_recoveries_total",
+			Help: "Number of temporary result files found at startup, by what was done with them.",
+		},
+		[]string{"result"},
+	)
+)
+
+// File is a result file that is being written. Its content becomes visible
+// under its final name when Close succeeds.
+type File struct {
+	tmp   *os.File
+	name  string
+	start time.Time
+	done  bool
+}
+
+// Create creates a File that will be stored as name, a slash separated path
+// relative to root. Create fails if a file with that name already exists.
+func Create(root, name string) (*File, error) {
+	final := filepath.Join(root, filepath.FromSlash(name))
+	if _, err := os.Lstat(final); err == nil {
+		return nil, &os.PathError{Op: "create", Path: final, Err: os.ErrExist}
+	}
+	if err := os.MkdirAll(filepath.Dir(final), 0755); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(root, TempDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// The temporary name encodes the final name, so that Recover knows where
+	// the file belongs. QueryEscape also escapes the slashes, which keeps the
+	// temporary directory flat.
+	tmp := filepath.Join(dir, url.QueryEscape(name)+tempSuffix)
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &File{tmp: fp, name: final, start: time.Now()}, nil
+}
+
+// Name returns the final name of the file.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Write writes p to the temporary file.
+func (f *File) Write(p []byte) (int, error) {
+	return f.tmp.Write(p)
+}
+
+// Close syncs the file to disk and renames it to its final name. When Close
+// fails, the temporary file is removed.
+func (f *File) Close() error {
+	if f.done {
+		return os.ErrClosed
+	}
+	f.done = true
+	if err := f.commit(); err != nil {
+		os.Remove(f.tmp.Name())
+		fileWrites.WithLabelValues("error").Inc()
+		return err
+	}
+	fileWrites.WithLabelValues("ok").Inc()
+	fileWriteDuration.Observe(time.Since(f.start).Seconds())
+	return nil
+}
+
+func (f *File) commit() error {
+	if err := f.tmp.Sync(); err != nil {
+		f.tmp.Close()
+		return err
+	}
+	if err := f.tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.tmp.Name(), f.name); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(f.name))
+}
+
+// Abort discards the file without storing it under its final name.
+func (f *File) Abort() error {
+	if f.done {
+		return os.ErrClosed
+	}
+	f.done = true
+	f.tmp.Close()
+	fileWrites.WithLabelValues("error").Inc()
+	return os.Remove(f.tmp.Name())
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	d.Close()
+	return err
+}
+
+// Recover handles the temporary files left in root by a previous run. Files
+// that contain complete JSON, and gzip compressed JSON for names ending in
+// ".gz", are moved to their final names. All other files are moved to the
+// quarantine directory. Recover must be called before any File is created in
+// root.
+func Recover(root string) (recovered, quarantined int, err error) {
+	dir := filepath.Join(root, TempDir)
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		tmp := filepath.Join(dir, info.Name())
+		name, err := url.QueryUnescape(strings.TrimSuffix(info.Name(), tempSuffix))
+		if err == nil && strings.HasSuffix(info.Name(), tempSuffix) && complete(tmp, name) {
+			final := filepath.Join(root, filepath.FromSlash(filepath.Clean("/"+name)))
+			if _, err := os.Lstat(final); os.IsNotExist(err) {
+				if err := os.MkdirAll(filepath.Dir(final), 0755); err != nil {
+					return recovered, quarantined, err
+				}
+				if err := os.Rename(tmp, final); err != nil {
+					return recovered, quarantined, err
+				}
+				if err := syncDir(filepath.Dir(final)); err != nil {
+					return recovered, quarantined, err
+				}
+				recovered++
+				fileRecoveries.WithLabelValues("recovered").Inc()
+				continue
+			}
+		}
+		if err := quarantine(root, tmp); err != nil {
+			return recovered, quarantined, err
+		}
+		quarantined++
+		fileRecoveries.WithLabelValues("quarantined").Inc()
+	}
+	return recovered, quarantined, nil
+}
+
+// complete returns whether the file at path contains a complete result.
+func complete(path, name string) bool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(name, ".gz") {
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return false
+		}
+		// Reading to the end verifies the checksum and length in the gzip
+		// trailer, which are missing from a truncated file.
+		data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return false
+		}
+	}
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && json.Valid(data)
+}
+
+func quarantine(root, tmp string) error {
+	dir := filepath.Join(root, QuarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, filepath.Base(tmp))
+	if _, err := os.Lstat(dst); err == nil {
+		dst = fmt.Sprintf("%s.%d", dst, time.Now().UnixNano())
+	}
+	return os.Rename(tmp, dst)
+}
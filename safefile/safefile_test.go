@@ -0,0 +1,96 @@
+package safefile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+)
+
+func TestCreate(t *testing.T) {
+	root, err := ioutil.TempDir("", "TestCreate")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(root)
+	final := filepath.Join(root, "ndt5/2020/03/04/uuid.json")
+
+	f, err := Create(root, "ndt5/2020/03/04/uuid.json")
+	rtx.Must(err, "Could not create file")
+	if f.Name() != final {
+		t.Errorf("Name() = %q, want %q", f.Name(), final)
+	}
+	_, err = f.Write([]byte(`{"UUID":"uuid"}`))
+	rtx.Must(err, "Could not write")
+	if _, err := os.Stat(final); !os.IsNotExist(err) {
+		t.Errorf("file is visible before Close, Stat() = %v", err)
+	}
+	rtx.Must(f.Close(), "Could not close")
+	if data, err := ioutil.ReadFile(final); err != nil || string(data) != `{"UUID":"uuid"}` {
+		t.Errorf("ReadFile() = %q, %v, want the written content", data, err)
+	}
+	if f.Close() == nil {
+		t.Error("second Close() should fail")
+	}
+	if _, err := Create(root, "ndt5/2020/03/04/uuid.json"); err == nil {
+		t.Error("Create() of an existing file should fail")
+	}
+
+	f, err = Create(root, "ndt5/2020/03/04/aborted.json")
+	rtx.Must(err, "Could not create file")
+	rtx.Must(f.Abort(), "Could not abort")
+	if m, _ := filepath.Glob(filepath.Join(root, "*/*/*/*/aborted.json")); len(m) != 0 {
+		t.Errorf("aborted file was stored: %v", m)
+	}
+	if m, _ := filepath.Glob(filepath.Join(root, TempDir, "*")); len(m) != 0 {
+		t.Errorf("temporary files were left behind: %v", m)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	root, err := ioutil.TempDir("", "TestRecover")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(root)
+
+	if r, q, err := Recover(root); r != 0 || q != 0 || err != nil {
+		t.Errorf("Recover() without a temporary directory = %d, %d, %v", r, q, err)
+	}
+
+	var complete, truncated bytes.Buffer
+	w := gzip.NewWriter(&complete)
+	w.Write([]byte(`{"UUID":"gz"}`))
+	w.Close()
+	truncated.Write(complete.Bytes()[:complete.Len()-4])
+
+	tmp := map[string][]byte{
+		"ndt5/2020/03/04/ok.json":         []byte("{\"UUID\":\"ok\"}\n"),
+		"ndt5/2020/03/04/partial.json":    []byte(`{"UUID":"par`),
+		"ndt5/2020/03/04/empty.json":      nil,
+		"ndt7/2020/03/04/ok.json.gz":      complete.Bytes(),
+		"ndt7/2020/03/04/partial.json.gz": truncated.Bytes(),
+	}
+	rtx.Must(os.MkdirAll(filepath.Join(root, TempDir), 0755), "Could not create temporary directory")
+	for name, data := range tmp {
+		rtx.Must(ioutil.WriteFile(filepath.Join(root, TempDir, url.QueryEscape(name)+tempSuffix), data, 0644), "Could not write")
+	}
+
+	recovered, quarantined, err := Recover(root)
+	rtx.Must(err, "Could not recover")
+	if recovered != 2 || quarantined != 3 {
+		t.Errorf("Recover() = %d, %d, want 2 recovered and 3 quarantined", recovered, quarantined)
+	}
+	for _, name := range []string{"ndt5/2020/03/04/ok.json", "ndt7/2020/03/04/ok.json.gz"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Errorf("%s was not recovered: %v", name, err)
+		}
+	}
+	if m, _ := filepath.Glob(filepath.Join(root, QuarantineDir, "*")); len(m) != 3 {
+		t.Errorf("quarantined files = %v, want 3", m)
+	}
+	if m, _ := filepath.Glob(filepath.Join(root, TempDir, "*")); len(m) != 0 {
+		t.Errorf("temporary files were left behind: %v", m)
+	}
+}
@@ -0,0 +1,97 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/m-lab/ndt-server/ndt5/protocol"
+	"github.com/m-lab/ndt-server/results"
+)
+
+// NDT5Layout selects how File names the ndt5 result files.
+type NDT5Layout string
+
+const (
+	// NDT5Legacy writes uncompressed files named after the test UUID.
+	NDT5Legacy NDT5Layout = "legacy"
+	// NDT5Unified writes gzip compressed files named like ndt7 results.
+	NDT5Unified NDT5Layout = "unified"
+
+	// ndt5Kind is the kind of test in the name of unified ndt5 files. An ndt5
+	// result covers all subtests of a session.
+	ndt5Kind = "result"
+)
+
+// File writes results to the data directory. Files appear under their final
+// names only once they are complete. The ndt7 results, and the ndt5 results
+// with the unified layout, are gzip compressed and written to
+//
+//	<datadir>/<protocol>/YYYY/MM/DD/<protocol>-<kind>-<timestamp>.<uuid>.json.gz
+//
+// The ndt5 results with the legacy layout are written to
+//
+//	<datadir>/ndt5/YYYY/MM/DD/<uuid>.json
+type File struct {
+	datadir string
+	ndt5    NDT5Layout
+}
+
+// NewFile creates a File sink that writes to datadir, with the given layout
+// for ndt5 results.
+func NewFile(datadir string, ndt5 NDT5Layout) *File {
+	return &File{datadir: datadir, ndt5: ndt5}
+}
+
+// Write saves r to a new file.
+func (f *File) Write(r *Result) error {
+	switch {
+	case r.Protocol == "ndt5" && f.ndt5 != NDT5Unified:
+		return f.writeLegacyNDT5(r)
+	case r.Protocol == "ndt5":
+		return f.writeGzip(r, ndt5Kind)
+	case r.Protocol == "ndt7":
+		return f.writeGzip(r, r.Kind)
+	}
+	return fmt.Errorf("unknown protocol %q", r.Protocol)
+}
+
+func (f *File) writeLegacyNDT5(r *Result) error {
+	dir := path.Join("ndt5", r.StartTime.Format("2006/01/02"))
+	fp, err := protocol.UUIDToFile(f.datadir, dir, r.UUID)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(fp).Encode(r.Data); err != nil {
+		fp.Abort()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	r.Path = fp.Name()
+	logging.Logger.WithField("file", fp.Name()).Debug("sink: wrote result")
+	return nil
+}
+
+func (f *File) writeGzip(r *Result, kind string) error {
+	fp, err := results.NewFile(f.datadir, r.Protocol, kind, r.UUID)
+	if err != nil {
+		return err
+	}
+	if err := fp.WriteResult(r.Data); err != nil {
+		fp.Abort()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	r.Path = fp.Fp.Name()
+	return nil
+}
+
+// Close does nothing, because every result is written to its own file.
+func (f *File) Close() error {
+	return nil
+}
@@ -0,0 +1,75 @@
+package sink
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ndjsonTimeout bounds how long a write to a unix socket may block a test.
+const ndjsonTimeout = 5 * time.Second
+
+// NDJSON writes each result as one line of JSON, either to a writer such as
+// os.Stdout or to a unix socket of a log pipeline.
+type NDJSON struct {
+	mu     sync.Mutex
+	w      io.Writer
+	socket string
+	conn   net.Conn
+}
+
+// NewNDJSON creates an NDJSON sink that writes to w.
+func NewNDJSON(w io.Writer) *NDJSON {
+	return &NDJSON{w: w}
+}
+
+// NewUnixNDJSON creates an NDJSON sink that writes to the unix stream socket
+// at path. The socket is connected on the first write, and reconnected after
+// a failed write, so the listener does not need to exist at startup.
+func NewUnixNDJSON(path string) *NDJSON {
+	return &NDJSON{socket: path}
+}
+
+// Write writes r as a single line.
+func (n *NDJSON) Write(r *Result) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.socket == "" {
+		_, err = n.w.Write(line)
+		return err
+	}
+	if n.conn == nil {
+		n.conn, err = net.DialTimeout("unix", n.socket, ndjsonTimeout)
+		if err != nil {
+			n.conn = nil
+			return err
+		}
+	}
+	n.conn.SetWriteDeadline(time.Now().Add(ndjsonTimeout))
+	if _, err = n.conn.Write(line); err != nil {
+		// A partial line may have been written, so start over on a new
+		// connection.
+		n.conn.Close()
+		n.conn = nil
+	}
+	return err
+}
+
+// Close closes the unix socket, if any.
+func (n *NDJSON) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn = nil
+	return err
+}
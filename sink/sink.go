@@ -0,0 +1,121 @@
+// Package sink delivers the archival results of ndt5 and ndt7 tests. Every
+// protocol hands its results to a ResultSink, which may write them to the data
+// directory, stream them to a log pipeline or post them to a webhook. Several
+// sinks can be combined with Multi, so that downstream systems receive results
+// in real time without scanning the data directory.
+package sink
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	sinkWrites = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_result_sink_writes_total",
+			Help: "Number of results written to each result sink, by outcome.",
+		},
+		[]string{"sink", "result"},
+	)
+	sinkWriteDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ndt_result_sink_write_duration_seconds",
+			Help:    "How long it takes each result sink to accept a result.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+		[]string{"sink"},
+	)
+)
+
+// Result is the archival record of a single test, along with the properties
+// sinks use to name and route it.
+type Result struct {
+	// Protocol is "ndt5" or "ndt7".
+	Protocol string
+	// Kind is the ndt7 subtest, i.e. "download" or "upload". It is empty for
+	// ndt5, whose record covers all subtests.
+	Kind string `json:",omitempty"`
+	// UUID is the UUID of the test connection.
+	UUID      string
+	StartTime time.Time
+	// Data is the record itself, a *data.NDT5Result or a *data.NDT7Result.
+	Data interface{}
+	// Path is the file that the File sink wrote the result to. It is empty
+	// until then, so only the sinks added to a Multi after the File sink
+	// see it.
+	Path string `json:"-"`
+}
+
+// ResultSink is implemented by every destination for test results. Write is
+// called once per result, possibly from several goroutines at once.
+type ResultSink interface {
+	Write(r *Result) error
+	Close() error
+}
+
+type namedSink struct {
+	name string
+	sink ResultSink
+}
+
+// Multi writes every result to all of its sinks, and records the outcome of
+// each write in metrics labeled by the name of the sink.
+type Multi struct {
+	sinks []namedSink
+}
+
+// NewMulti creates a Multi without sinks.
+func NewMulti() *Multi {
+	return &Multi{}
+}
+
+// Add adds s to the sinks of m. Add must not be called once results are being
+// written.
+func (m *Multi) Add(name string, s ResultSink) {
+	m.sinks = append(m.sinks, namedSink{name: name, sink: s})
+}
+
+// Len returns the number of sinks in m.
+func (m *Multi) Len() int {
+	return len(m.sinks)
+}
+
+// Write writes r to all sinks. A failing sink does not prevent the others from
+// receiving the result. The returned error describes all failures.
+func (m *Multi) Write(r *Result) error {
+	var errs []string
+	for _, s := range m.sinks {
+		start := time.Now()
+		err := s.sink.Write(r)
+		sinkWriteDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+		if err != nil {
+			sinkWrites.WithLabelValues(s.name, "error").Inc()
+			errs = append(errs, s.name+": "+err.Error())
+			continue
+		}
+		sinkWrites.WithLabelValues(s.name, "ok").Inc()
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Close closes all sinks and returns the errors of those that fail.
+func (m *Multi) Close() error {
+	var errs []string
+	for _, s := range m.sinks {
+		if err := s.sink.Close(); err != nil {
+			errs = append(errs, s.name+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+)
+
+type fakeSink struct {
+	results []*Result
+	err     error
+	closed  bool
+}
+
+func (f *fakeSink) Write(r *Result) error {
+	f.results = append(f.results, r)
+	return f.err
+}
+
+func (f *fakeSink) Close() error {
+	f.closed = true
+	return f.err
+}
+
+func TestMulti(t *testing.T) {
+	good := &fakeSink{}
+	bad := &fakeSink{err: errors.New("broken")}
+	m := NewMulti()
+	m.Add("good", good)
+	m.Add("bad", bad)
+
+	err := m.Write(&Result{Protocol: "ndt7", UUID: "abc"})
+	if err == nil || !strings.Contains(err.Error(), "bad: broken") {
+		t.Errorf("Write() error = %v, want the error of the failing sink", err)
+	}
+	if len(good.results) != 1 || len(bad.results) != 1 {
+		t.Errorf("Write() delivered %d and %d results, want 1 to each sink", len(good.results), len(bad.results))
+	}
+	if err := m.Close(); err == nil || !good.closed || !bad.closed {
+		t.Errorf("Close() = %v, want all sinks closed and an error", err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	start := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		name   string
+		layout NDT5Layout
+		want   []string
+	}{
+		{
+			name:   "legacy",
+			layout: NDT5Legacy,
+			want: []string{
+				"ndt5/2020/03/04/ndt5-uuid.json",
+				"ndt7/*/*/*/ndt7-download-*.ndt7-uuid.json.gz",
+			},
+		},
+		{
+			name:   "unified",
+			layout: NDT5Unified,
+			want: []string{
+				"ndt5/*/*/*/ndt5-result-*.ndt5-uuid.json.gz",
+				"ndt7/*/*/*/ndt7-download-*.ndt7-uuid.json.gz",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "TestFile")
+			rtx.Must(err, "Could not create tempdir")
+			defer os.RemoveAll(dir)
+
+			f := NewFile(dir, tt.layout)
+			r5 := &Result{Protocol: "ndt5", UUID: "ndt5-uuid", StartTime: start, Data: map[string]string{"a": "b"}}
+			r7 := &Result{Protocol: "ndt7", Kind: "download", UUID: "ndt7-uuid", StartTime: start, Data: map[string]string{"a": "b"}}
+			rtx.Must(f.Write(r5), "Could not write ndt5 result")
+			rtx.Must(f.Write(r7), "Could not write ndt7 result")
+			for _, r := range []*Result{r5, r7} {
+				if _, err := os.Stat(r.Path); err != nil || !strings.HasPrefix(r.Path, dir) {
+					t.Errorf("Path = %q, want the file in %s: %v", r.Path, dir, err)
+				}
+			}
+			if err := f.Write(&Result{Protocol: "ndt9"}); err == nil {
+				t.Error("Write() with unknown protocol should fail")
+			}
+			for _, pattern := range tt.want {
+				m, err := filepath.Glob(filepath.Join(dir, pattern))
+				rtx.Must(err, "Could not glob")
+				if len(m) != 1 {
+					t.Errorf("found %v for %s, want exactly one file", m, pattern)
+				}
+			}
+		})
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	var buf bytes.Buffer
+	n := NewNDJSON(&buf)
+	rtx.Must(n.Write(&Result{Protocol: "ndt5", UUID: "one"}), "Could not write")
+	rtx.Must(n.Write(&Result{Protocol: "ndt7", Kind: "upload", UUID: "two"}), "Could not write")
+	rtx.Must(n.Close(), "Could not close")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), buf.String())
+	}
+	var r Result
+	rtx.Must(json.Unmarshal([]byte(lines[1]), &r), "Could not parse line")
+	if r.UUID != "two" || r.Kind != "upload" {
+		t.Errorf("second line = %+v, want the second result", r)
+	}
+}
+
+func TestNDJSON_unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestNDJSON_unix")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "results.sock")
+
+	n := NewUnixNDJSON(socket)
+	defer n.Close()
+	// The listener does not exist yet.
+	if err := n.Write(&Result{UUID: "lost"}); err == nil {
+		t.Error("Write() without a listener should fail")
+	}
+
+	l, err := net.Listen("unix", socket)
+	rtx.Must(err, "Could not listen")
+	defer l.Close()
+	lines := make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := bufio.NewScanner(conn)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+	}()
+	rtx.Must(n.Write(&Result{UUID: "delivered"}), "Could not write")
+	select {
+	case line := <-lines:
+		if !strings.Contains(line, `"UUID":"delivered"`) {
+			t.Errorf("got line %q, want the delivered result", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for the result")
+	}
+}
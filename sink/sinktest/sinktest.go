@@ -0,0 +1,72 @@
+// Package sinktest builds the results of ndt5 and ndt7 tests, as written to a
+// sink, for the unittests of the packages that consume them.
+package sinktest
+
+import (
+	"time"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/metadata"
+	"github.com/m-lab/ndt-server/ndt5/c2s"
+	"github.com/m-lab/ndt-server/ndt5/control"
+	"github.com/m-lab/ndt-server/ndt5/s2c"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/ndt-server/sink"
+	"github.com/m-lab/ndt-server/tcpinfox"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// Start is a convenient start time for results.
+var Start = time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+
+// NDT7 returns the result of a one second ndt7 download by a libndt7 client,
+// in which bytesAcked bytes were acknowledged, 1% of the bytes sent were
+// retransmitted, the minimum RTT was 20ms and congestion limited the transfer.
+func NDT7(uuid, clientIP string, start time.Time, bytesAcked int64) *sink.Result {
+	ti := &model.TCPInfo{ElapsedTime: 1000000}
+	ti.BytesAcked = bytesAcked
+	ti.BytesSent = bytesAcked
+	ti.BytesRetrans = bytesAcked / 100
+	ti.MinRTT = 20000
+	return &sink.Result{
+		Protocol:  "ndt7",
+		Kind:      "download",
+		UUID:      uuid,
+		StartTime: start,
+		Data: &data.NDT7Result{
+			ClientIP:  clientIP,
+			StartTime: start,
+			Download: &model.ArchivalData{
+				UUID:               uuid,
+				ServerMeasurements: []model.Measurement{{TCPInfo: ti}},
+				ClientMetadata:     []metadata.NameValue{{Name: "client_library_name", Value: "libndt7"}},
+				LimitingFactors:    &tcpinfox.LimitingFactors{Congestion: 1, Dominant: tcpinfox.LimitCongestion},
+			},
+		},
+	}
+}
+
+// NDT5 returns the result of an ndt5 test with a 5 Mbps upload and a 20 Mbps
+// download that timed out after two seconds, in which the minimum RTT was
+// 30ms. The client was told that the download ran at 19.5 Mbps.
+func NDT5(uuid, clientIP string, start time.Time) *sink.Result {
+	return &sink.Result{
+		Protocol:  "ndt5",
+		UUID:      uuid,
+		StartTime: start,
+		Data: &data.NDT5Result{
+			ClientIP:  clientIP,
+			StartTime: start,
+			Control:   &control.ArchivalData{UUID: uuid},
+			C2S:       &c2s.ArchivalData{MeanThroughputMbps: 5},
+			S2C: &s2c.ArchivalData{
+				StartTime:          start,
+				EndTime:            start.Add(2 * time.Second),
+				MinRTT:             30 * time.Millisecond,
+				MeanThroughputMbps: 19.5,
+				TCPInfo:            &tcp.LinuxTCPInfo{BytesAcked: 5000000},
+				Error:              "i/o timeout",
+			},
+		},
+	}
+}
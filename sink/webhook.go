@@ -0,0 +1,224 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/m-lab/ndt-server/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	webhookDeliveries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ndt_result_sink_webhook_deliveries_total",
+			Help: "Number of attempts to deliver a spooled result to the webhook, by outcome.",
+		},
+		[]string{"result"},
+	)
+	webhookSpooled = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "ndt_result_sink_webhook_spooled_results",
+			Help: "Number of results waiting in the spool for delivery to the webhook.",
+		},
+	)
+)
+
+// WebhookSpoolDir is the default spool directory of a Webhook, relative to the
+// data directory. It is hidden, so that uploaders and the janitor ignore it.
+const WebhookSpoolDir = ".webhook-spool"
+
+// Webhook posts each result as JSON to an HTTP endpoint. Results are first
+// written to a spool directory, and a background goroutine delivers them in
+// order, retrying with exponential backoff while the endpoint is unavailable.
+// Results that are still spooled when the server stops are delivered after
+// the next start. Results that the endpoint rejects with a client error are
+// renamed with a ".rejected" suffix and left in the spool for inspection.
+type Webhook struct {
+	url    string
+	spool  string
+	client *http.Client
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewWebhook creates a Webhook that posts to url, spools results in the
+// directory spool and gives up on a delivery attempt after timeout.
+func NewWebhook(url, spool string, timeout time.Duration) (*Webhook, error) {
+	w, err := newWebhook(url, spool, timeout)
+	if err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// newWebhook creates a Webhook without starting its delivery goroutine.
+func newWebhook(url, spool string, timeout time.Duration) (*Webhook, error) {
+	if err := os.MkdirAll(spool, 0755); err != nil {
+		return nil, err
+	}
+	w := &Webhook{
+		url:        url,
+		spool:      spool,
+		client:     &http.Client{Timeout: timeout},
+		minBackoff: time.Second,
+		maxBackoff: 5 * time.Minute,
+		notify:     make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	pending, err := w.pending()
+	if err != nil {
+		return nil, err
+	}
+	webhookSpooled.Set(float64(len(pending)))
+	return w, nil
+}
+
+// Write adds r to the spool and wakes up the delivery goroutine.
+func (w *Webhook) Write(r *Result) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	// Spooled results are named so that they sort in the order they were
+	// written. The temporary name keeps partial files out of the delivery
+	// goroutine's sight.
+	what := r.Protocol
+	if r.Kind != "" {
+		what += "-" + r.Kind
+	}
+	name := fmt.Sprintf("%s.%s.%s.json", time.Now().UTC().Format("20060102T150405.000000000Z"), what, r.UUID)
+	tmp, err := ioutil.TempFile(w.spool, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(w.spool, name)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	webhookSpooled.Inc()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close stops the delivery goroutine after one last attempt to deliver the
+// spooled results.
+func (w *Webhook) Close() error {
+	close(w.stop)
+	<-w.done
+	return nil
+}
+
+func (w *Webhook) run() {
+	defer close(w.done)
+	backoff := w.minBackoff
+	for {
+		err := w.deliver()
+		var retry <-chan time.Time
+		notify := w.notify
+		if err != nil {
+			logging.Logger.WithError(err).Warn("sink: webhook delivery failed")
+			// While the endpoint fails, new results wait for the backoff.
+			notify = nil
+			retry = time.After(backoff)
+			backoff *= 2
+			if backoff > w.maxBackoff {
+				backoff = w.maxBackoff
+			}
+		} else {
+			backoff = w.minBackoff
+		}
+		select {
+		case <-notify:
+		case <-retry:
+		case <-w.stop:
+			if err == nil {
+				w.deliver()
+			}
+			return
+		}
+	}
+}
+
+// deliver posts all spooled results in order, and stops at the first failure.
+func (w *Webhook) deliver() error {
+	pending, err := w.pending()
+	if err != nil {
+		return err
+	}
+	for _, name := range pending {
+		if err := w.post(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pending returns the paths of the spooled results, oldest first.
+func (w *Webhook) pending() ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(w.spool, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (w *Webhook) post(name string) error {
+	body, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		webhookDeliveries.WithLabelValues("error").Inc()
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		webhookDeliveries.WithLabelValues("ok").Inc()
+		webhookSpooled.Dec()
+		return os.Remove(name)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		// Retrying will not help, so set the result aside and move on.
+		webhookDeliveries.WithLabelValues("rejected").Inc()
+		webhookSpooled.Dec()
+		logging.Logger.WithFields(log.Fields{"file": filepath.Base(name), "status": resp.Status}).Warn("sink: webhook rejected result")
+		return os.Rename(name, strings.TrimSuffix(name, ".json")+".rejected")
+	}
+	webhookDeliveries.WithLabelValues("error").Inc()
+	return fmt.Errorf("webhook returned %s", resp.Status)
+}
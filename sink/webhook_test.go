@@ -0,0 +1,76 @@
+package sink
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+)
+
+func TestWebhook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWebhook")
+	rtx.Must(err, "Could not create tempdir")
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var received []string
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var r Result
+		rtx.Must(json.NewDecoder(req.Body).Decode(&r), "Could not decode result")
+		switch {
+		case r.UUID == "invalid":
+			rw.WriteHeader(http.StatusBadRequest)
+		case failures > 0:
+			failures--
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			received = append(received, r.UUID)
+		}
+	}))
+	defer srv.Close()
+
+	// A result spooled before the start is delivered first.
+	rtx.Must(ioutil.WriteFile(filepath.Join(dir, "00000000T000000.000000000Z.ndt5.old.json"),
+		[]byte(`{"Protocol":"ndt5","UUID":"old"}`), 0644), "Could not write spooled result")
+
+	w, err := newWebhook(srv.URL, dir, time.Second)
+	rtx.Must(err, "Could not create webhook")
+	w.minBackoff = 10 * time.Millisecond
+	go w.run()
+	rtx.Must(w.Write(&Result{Protocol: "ndt7", Kind: "download", UUID: "invalid"}), "Could not write")
+	rtx.Must(w.Write(&Result{Protocol: "ndt7", Kind: "upload", UUID: "new"}), "Could not write")
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		n := len(received)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rtx.Must(w.Close(), "Could not close")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0] != "old" || received[1] != "new" {
+		t.Errorf("received %v, want [old new]", received)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(m) != 0 {
+		t.Errorf("spool still contains %v", m)
+	}
+	if m, _ := filepath.Glob(filepath.Join(dir, "*.invalid.rejected")); len(m) != 1 {
+		t.Errorf("found rejected results %v, want one", m)
+	}
+}
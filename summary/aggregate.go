@@ -0,0 +1,149 @@
+package summary
+
+import (
+	"math"
+	"sort"
+)
+
+// Group identifies the tests that are aggregated together.
+type Group struct {
+	Day       string
+	Protocol  string
+	Direction string
+	// Key is the client metadata key the tests are grouped by, if any, and
+	// Value its value. Tests without the key have an empty Value.
+	Key   string `json:",omitempty"`
+	Value string `json:",omitempty"`
+}
+
+// Distribution describes the values of a metric in a Group.
+type Distribution struct {
+	Mean float64
+	P10  float64
+	P25  float64
+	P50  float64
+	P75  float64
+	P90  float64
+}
+
+// Aggregate is the distribution of the metrics of the tests in a Group.
+type Aggregate struct {
+	Group
+	Tests  int
+	Errors int
+	// LimitingFactors counts the downloads by what mostly limited them. The
+	// keys are the tcpinfox.Limits.
+	LimitingFactors map[string]int `json:",omitempty"`
+	ThroughputMbps  Distribution
+	MinRTTMillis    Distribution
+	// RetransRate is the distribution for downloads only, and is zero for
+	// uploads.
+	RetransRate Distribution
+}
+
+// Aggregator collects tests and computes their Aggregates.
+type Aggregator struct {
+	key    string
+	groups map[Group]*samples
+}
+
+type samples struct {
+	errors     int
+	limits     map[string]int
+	throughput []float64
+	minRTT     []float64
+	retrans    []float64
+}
+
+// NewAggregator creates an Aggregator that groups tests by day, protocol,
+// direction and, when key is not empty, the value of the client metadata key.
+func NewAggregator(key string) *Aggregator {
+	return &Aggregator{key: key, groups: make(map[Group]*samples)}
+}
+
+// Add adds t to its group.
+func (a *Aggregator) Add(t *Test) {
+	g := Group{Day: t.Day(), Protocol: t.Protocol, Direction: t.Direction}
+	if a.key != "" {
+		g.Key = a.key
+		g.Value = t.Metadata[a.key]
+	}
+	s := a.groups[g]
+	if s == nil {
+		s = &samples{}
+		a.groups[g] = s
+	}
+	s.throughput = append(s.throughput, t.ThroughputMbps)
+	if t.MinRTTMillis > 0 {
+		s.minRTT = append(s.minRTT, t.MinRTTMillis)
+	}
+	if t.Direction == "download" {
+		s.retrans = append(s.retrans, t.RetransRate)
+	}
+	if t.Error != "" {
+		s.errors++
+	}
+	if t.LimitingFactor != "" {
+		if s.limits == nil {
+			s.limits = make(map[string]int)
+		}
+		s.limits[t.LimitingFactor]++
+	}
+}
+
+// Aggregates returns the aggregates of all groups, sorted by group.
+func (a *Aggregator) Aggregates() []Aggregate {
+	aggs := make([]Aggregate, 0, len(a.groups))
+	for g, s := range a.groups {
+		aggs = append(aggs, Aggregate{
+			Group:           g,
+			Tests:           len(s.throughput),
+			Errors:          s.errors,
+			LimitingFactors: s.limits,
+			ThroughputMbps:  distribution(s.throughput),
+			MinRTTMillis:    distribution(s.minRTT),
+			RetransRate:     distribution(s.retrans),
+		})
+	}
+	sort.Slice(aggs, func(i, k int) bool {
+		gi, gk := aggs[i].Group, aggs[k].Group
+		switch {
+		case gi.Day != gk.Day:
+			return gi.Day < gk.Day
+		case gi.Protocol != gk.Protocol:
+			return gi.Protocol < gk.Protocol
+		case gi.Direction != gk.Direction:
+			return gi.Direction < gk.Direction
+		}
+		return gi.Value < gk.Value
+	})
+	return aggs
+}
+
+func distribution(values []float64) Distribution {
+	if len(values) == 0 {
+		return Distribution{}
+	}
+	sort.Float64s(values)
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return Distribution{
+		Mean: sum / float64(len(values)),
+		P10:  percentile(values, 0.10),
+		P25:  percentile(values, 0.25),
+		P50:  percentile(values, 0.50),
+		P75:  percentile(values, 0.75),
+		P90:  percentile(values, 0.90),
+	}
+}
+
+// percentile returns the p-th percentile of the sorted values, interpolating
+// linearly between the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
@@ -0,0 +1,109 @@
+package summary
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/m-lab/ndt-server/tcpinfox"
+)
+
+// Writer writes tests or aggregates in an output format.
+type Writer interface {
+	WriteTest(t *Test) error
+	WriteAggregate(a *Aggregate) error
+	Flush() error
+}
+
+// NewWriter returns a Writer for format, which is "csv" or "ndjson". The CSV
+// columns for tests include one column per client metadata key in keys.
+func NewWriter(w io.Writer, format string, keys []string) Writer {
+	if format == "ndjson" {
+		return &ndjsonWriter{enc: json.NewEncoder(w)}
+	}
+	keys = append([]string(nil), keys...)
+	sort.Strings(keys)
+	return &csvWriter{w: csv.NewWriter(w), keys: keys}
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func (w *ndjsonWriter) WriteTest(t *Test) error {
+	return w.enc.Encode(t)
+}
+
+func (w *ndjsonWriter) WriteAggregate(a *Aggregate) error {
+	return w.enc.Encode(a)
+}
+
+func (w *ndjsonWriter) Flush() error {
+	return nil
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	keys   []string
+	header bool
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (w *csvWriter) WriteTest(t *Test) error {
+	if !w.header {
+		w.header = true
+		header := []string{"UUID", "Protocol", "Direction", "StartTime", "ClientIP",
+			"ThroughputMbps", "MinRTTMillis", "RetransRate", "Error", "LimitingFactor"}
+		for _, key := range w.keys {
+			header = append(header, "Metadata."+key)
+		}
+		if err := w.w.Write(header); err != nil {
+			return err
+		}
+	}
+	row := []string{t.UUID, t.Protocol, t.Direction, t.StartTime.UTC().Format(time.RFC3339Nano), t.ClientIP,
+		formatFloat(t.ThroughputMbps), formatFloat(t.MinRTTMillis), formatFloat(t.RetransRate), t.Error, t.LimitingFactor}
+	for _, key := range w.keys {
+		row = append(row, t.Metadata[key])
+	}
+	return w.w.Write(row)
+}
+
+func (w *csvWriter) WriteAggregate(a *Aggregate) error {
+	if !w.header {
+		w.header = true
+		header := []string{"Day", "Protocol", "Direction", "Key", "Value", "Tests", "Errors"}
+		for _, limit := range tcpinfox.Limits {
+			header = append(header, "LimitingFactors."+limit)
+		}
+		for _, metric := range []string{"ThroughputMbps", "MinRTTMillis", "RetransRate"} {
+			for _, stat := range []string{"Mean", "P10", "P25", "P50", "P75", "P90"} {
+				header = append(header, metric+"."+stat)
+			}
+		}
+		if err := w.w.Write(header); err != nil {
+			return err
+		}
+	}
+	row := []string{a.Day, a.Protocol, a.Direction, a.Key, a.Value, strconv.Itoa(a.Tests), strconv.Itoa(a.Errors)}
+	for _, limit := range tcpinfox.Limits {
+		row = append(row, strconv.Itoa(a.LimitingFactors[limit]))
+	}
+	for _, d := range []Distribution{a.ThroughputMbps, a.MinRTTMillis, a.RetransRate} {
+		for _, v := range []float64{d.Mean, d.P10, d.P25, d.P50, d.P75, d.P90} {
+			row = append(row, formatFloat(v))
+		}
+	}
+	return w.w.Write(row)
+}
+
+func (w *csvWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
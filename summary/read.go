@@ -0,0 +1,113 @@
+package summary
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isResult returns whether name is the name of an ndt5 or ndt7 result file.
+func isResult(name string) bool {
+	return strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".json.gz")
+}
+
+// isTarball returns whether name is the name of a tar archive.
+func isTarball(name string) bool {
+	for _, suffix := range []string{".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Walk calls fn with the name and the uncompressed content of every result
+// file in path, which is either a data directory or a tar archive of one. The
+// hidden directories of a data directory, which hold temporary files and the
+// results index, are skipped. Walk stops at the first error returned by fn.
+func Walk(path string, fn func(name string, b []byte) error) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() && isTarball(path) {
+		return walkTar(path, fn)
+	}
+	return filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && name != path && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || !isResult(name) {
+			return nil
+		}
+		fp, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		b, err := readAll(name, fp)
+		if err != nil {
+			return &os.PathError{Op: "read", Path: name, Err: err}
+		}
+		return fn(name, b)
+	})
+}
+
+func walkTar(path string, fn func(name string, b []byte) error) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	var r io.Reader = fp
+	if !strings.HasSuffix(path, ".tar") {
+		gz, err := gzip.NewReader(fp)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg || !isResult(h.Name) {
+			continue
+		}
+		b, err := readAll(h.Name, tr)
+		if err != nil {
+			return &os.PathError{Op: "read", Path: h.Name, Err: err}
+		}
+		if err := fn(h.Name, b); err != nil {
+			return err
+		}
+	}
+}
+
+// readAll reads the result file name from r, and uncompresses it if needed.
+func readAll(name string, r io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil || !strings.HasSuffix(name, ".gz") {
+		return b, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
@@ -0,0 +1,194 @@
+// Package summary computes summaries of archived ndt5 and ndt7 results, for
+// offline analysis of the results in a data directory. Results are decoded
+// with the same types the server uses to write them, so the summaries keep up
+// with changes to the archival format. The results index and the hooks of the
+// server summarize results with the same functions.
+package summary
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/metadata"
+	"github.com/m-lab/ndt-server/ndt7/model"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// ErrUnknownFormat is returned by Decode for JSON documents that are neither
+// an ndt5 nor an ndt7 result.
+var ErrUnknownFormat = errors.New("not an ndt5 or ndt7 result")
+
+// Test summarizes one direction of a test.
+type Test struct {
+	UUID     string
+	Protocol string
+	// Direction is "download" or "upload". It is empty for ndt5 tests that
+	// did not run any subtest.
+	Direction string
+	StartTime time.Time
+	ClientIP  string
+	// ThroughputMbps is the goodput measured by the server from TCP_INFO, or
+	// the mean throughput reported to the client for ndt5 uploads, which do
+	// not archive TCP_INFO.
+	ThroughputMbps float64
+	// MinRTTMillis is zero when unknown.
+	MinRTTMillis float64
+	// RetransRate is the fraction of the bytes sent by the server that were
+	// retransmitted. It is zero for uploads, in which the server sends little.
+	RetransRate float64
+	Error       string `json:",omitempty"`
+	// LimitingFactor is what mostly limited a download, one of the
+	// tcpinfox.Limit constants. It is empty for uploads.
+	LimitingFactor string            `json:",omitempty"`
+	Metadata       map[string]string `json:",omitempty"`
+}
+
+// Day returns the UTC day of the start of the test, e.g. "2020-03-04".
+func (t *Test) Day() string {
+	return t.StartTime.UTC().Format("2006-01-02")
+}
+
+// Decode returns the summaries of the tests in the ndt5 or ndt7 result b.
+func Decode(b []byte) ([]Test, error) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	switch {
+	case keys["Download"] != nil || keys["Upload"] != nil:
+		var r data.NDT7Result
+		if err := dec.Decode(&r); err != nil {
+			return nil, err
+		}
+		return NDT7(&r), nil
+	case keys["Control"] != nil || keys["C2S"] != nil || keys["S2C"] != nil:
+		var r data.NDT5Result
+		if err := dec.Decode(&r); err != nil {
+			return nil, err
+		}
+		return NDT5(&r), nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+// NDT7 returns the summaries of the subtests of an ndt7 result.
+func NDT7(r *data.NDT7Result) []Test {
+	var tests []Test
+	add := func(direction string, d *model.ArchivalData) {
+		if d == nil {
+			return
+		}
+		t := Test{
+			UUID:      d.UUID,
+			Protocol:  "ndt7",
+			Direction: direction,
+			StartTime: r.StartTime,
+			ClientIP:  r.ClientIP,
+			Error:     d.Error,
+			Metadata:  toMap(d.ClientMetadata),
+		}
+		if d.LimitingFactors != nil {
+			t.LimitingFactor = d.LimitingFactors.Dominant
+		}
+		// The last measurement summarizes the whole subtest.
+		if m := d.ServerMeasurements; len(m) > 0 && m[len(m)-1].TCPInfo != nil {
+			ti := m[len(m)-1].TCPInfo
+			elapsed := time.Duration(ti.ElapsedTime) * time.Microsecond
+			if direction == "download" {
+				t.ThroughputMbps = mbps(ti.BytesAcked, elapsed)
+			} else {
+				t.ThroughputMbps = mbps(ti.BytesReceived, elapsed)
+			}
+			setTCPInfo(&t, &ti.LinuxTCPInfo)
+		}
+		tests = append(tests, t)
+	}
+	add("download", r.Download)
+	add("upload", r.Upload)
+	return tests
+}
+
+// NDT5 returns the summaries of the subtests of an ndt5 result.
+func NDT5(r *data.NDT5Result) []Test {
+	base := Test{
+		Protocol:  "ndt5",
+		StartTime: r.StartTime,
+		ClientIP:  r.ClientIP,
+	}
+	var controlErr string
+	if r.Control != nil {
+		base.UUID = r.Control.UUID
+		base.Metadata = toMap(r.Control.ClientMetadata)
+		controlErr = r.Control.Error
+	}
+	var tests []Test
+	if s2c := r.S2C; s2c != nil {
+		t := base
+		t.Direction = "download"
+		t.Error = firstError(s2c.Error, controlErr)
+		t.ThroughputMbps = s2c.MeanThroughputMbps
+		if s2c.TCPInfo != nil {
+			t.ThroughputMbps = mbps(s2c.TCPInfo.BytesAcked, s2c.EndTime.Sub(s2c.StartTime))
+			setTCPInfo(&t, s2c.TCPInfo)
+		}
+		if s2c.LimitingFactors != nil {
+			t.LimitingFactor = s2c.LimitingFactors.Dominant
+		}
+		if t.MinRTTMillis == 0 && s2c.MinRTT > 0 {
+			t.MinRTTMillis = float64(s2c.MinRTT) / float64(time.Millisecond)
+		}
+		tests = append(tests, t)
+	}
+	if c2s := r.C2S; c2s != nil {
+		t := base
+		t.Direction = "upload"
+		t.Error = firstError(c2s.Error, controlErr)
+		t.ThroughputMbps = c2s.MeanThroughputMbps
+		tests = append(tests, t)
+	}
+	if len(tests) == 0 {
+		base.Error = controlErr
+		tests = append(tests, base)
+	}
+	return tests
+}
+
+func setTCPInfo(t *Test, ti *tcp.LinuxTCPInfo) {
+	// MinRTT is in microseconds.
+	t.MinRTTMillis = float64(ti.MinRTT) / 1000
+	if t.Direction == "download" && ti.BytesSent > 0 {
+		t.RetransRate = float64(ti.BytesRetrans) / float64(ti.BytesSent)
+	}
+}
+
+func mbps(bytes int64, elapsed time.Duration) float64 {
+	us := elapsed / time.Microsecond
+	if us <= 0 {
+		return 0
+	}
+	return 8 * float64(bytes) / float64(us)
+}
+
+func toMap(nvs []metadata.NameValue) map[string]string {
+	if len(nvs) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(nvs))
+	for _, nv := range nvs {
+		m[nv.Name] = nv.Value
+	}
+	return m
+}
+
+func firstError(errs ...string) string {
+	for _, err := range errs {
+		if err != "" {
+			return err
+		}
+	}
+	return ""
+}
@@ -0,0 +1,176 @@
+package summary
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/ndt-server/data"
+	"github.com/m-lab/ndt-server/metadata"
+	"github.com/m-lab/ndt-server/ndt5/control"
+	"github.com/m-lab/ndt-server/sink"
+	"github.com/m-lab/ndt-server/sink/sinktest"
+)
+
+// writeDatadir writes results to a new data directory.
+func writeDatadir(t *testing.T, results ...*sink.Result) string {
+	dir, err := ioutil.TempDir("", "TestSummary")
+	rtx.Must(err, "could not create tempdir")
+	files := sink.NewFile(dir, sink.NDT5Legacy)
+	for _, r := range results {
+		rtx.Must(files.Write(r), "could not write result")
+	}
+	return dir
+}
+
+func summarize(t *testing.T, path string) []Test {
+	var tests []Test
+	err := Walk(path, func(name string, b []byte) error {
+		s, err := Decode(b)
+		if err != nil {
+			return err
+		}
+		tests = append(tests, s...)
+		return nil
+	})
+	rtx.Must(err, "Walk failed")
+	sort.Slice(tests, func(i, k int) bool {
+		return tests[i].UUID+tests[i].Direction < tests[k].UUID+tests[k].Direction
+	})
+	return tests
+}
+
+func TestWalkDatadir(t *testing.T) {
+	dir := writeDatadir(t, sinktest.NDT7("a", "192.0.2.1", sinktest.Start, 1250000), sinktest.NDT5("b", "192.0.2.2", sinktest.Start))
+	defer os.RemoveAll(dir)
+	// Hidden directories are skipped.
+	rtx.Must(os.MkdirAll(filepath.Join(dir, ".tmp"), 0755), "could not create dir")
+	rtx.Must(ioutil.WriteFile(filepath.Join(dir, ".tmp", "x.json"), []byte("{"), 0644), "could not write file")
+
+	tests := summarize(t, dir)
+	if len(tests) != 3 {
+		t.Fatalf("summarize() = %d tests, want 3", len(tests))
+	}
+	ndt7 := tests[0]
+	if ndt7.ThroughputMbps != 10 || ndt7.MinRTTMillis != 20 || ndt7.RetransRate != 0.01 ||
+		ndt7.Metadata["client_library_name"] != "libndt7" {
+		t.Errorf("ndt7 summary = %+v", ndt7)
+	}
+	download, upload := tests[1], tests[2]
+	if download.Direction != "download" || download.ThroughputMbps != 20 || download.MinRTTMillis != 30 ||
+		download.Error != "i/o timeout" {
+		t.Errorf("ndt5 download summary = %+v", download)
+	}
+	if upload.Direction != "upload" || upload.ThroughputMbps != 5 || upload.Error != "" {
+		t.Errorf("ndt5 upload summary = %+v", upload)
+	}
+}
+
+func TestWalkTarball(t *testing.T) {
+	dir := writeDatadir(t, sinktest.NDT7("a", "192.0.2.1", sinktest.Start, 1250000), sinktest.NDT5("b", "192.0.2.2", sinktest.Start))
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		rtx.Must(err, "could not read file")
+		rel, _ := filepath.Rel(dir, path)
+		rtx.Must(tw.WriteHeader(&tar.Header{Name: rel, Mode: 0644, Size: int64(len(b)), Typeflag: tar.TypeReg}), "could not write header")
+		_, err = tw.Write(b)
+		return err
+	})
+	rtx.Must(err, "could not create tarball")
+	rtx.Must(tw.Close(), "could not close tarball")
+	rtx.Must(gz.Close(), "could not close tarball")
+	tarball := dir + ".tar.gz"
+	rtx.Must(ioutil.WriteFile(tarball, buf.Bytes(), 0644), "could not write tarball")
+	defer os.Remove(tarball)
+
+	if tests := summarize(t, tarball); len(tests) != 3 || tests[0].UUID != "a" {
+		t.Errorf("summarize() = %+v, want 3 tests", tests)
+	}
+}
+
+func TestNDT5_controlOnly(t *testing.T) {
+	r := &data.NDT5Result{
+		ClientIP:  "192.0.2.2",
+		StartTime: sinktest.Start,
+		Control:   &control.ArchivalData{UUID: "b", Error: "login failed"},
+	}
+	tests := NDT5(r)
+	if len(tests) != 1 || tests[0].Direction != "" || tests[0].UUID != "b" || tests[0].Error != "login failed" {
+		t.Errorf("NDT5() = %+v, want one test without a direction", tests)
+	}
+}
+
+func TestNDT7_upload(t *testing.T) {
+	r := sinktest.NDT7("a", "192.0.2.1", sinktest.Start, 1250000).Data.(*data.NDT7Result)
+	r.Upload, r.Download = r.Download, nil
+	ti := r.Upload.ServerMeasurements[0].TCPInfo
+	ti.BytesReceived, ti.BytesAcked = ti.BytesAcked, 0
+	tests := NDT7(r)
+	// The server retransmits little in uploads, so the ratio is meaningless.
+	if len(tests) != 1 || tests[0].ThroughputMbps != 10 || tests[0].RetransRate != 0 {
+		t.Errorf("NDT7() = %+v, want an upload without a retransmission rate", tests)
+	}
+}
+
+func TestDecodeUnknown(t *testing.T) {
+	if _, err := Decode([]byte(`{"foo": 1}`)); err != ErrUnknownFormat {
+		t.Errorf("Decode() = %v, want %v", err, ErrUnknownFormat)
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	a := NewAggregator("client_library_name")
+	for i, library := range []string{"x", "x", "x", "x", "x", "y"} {
+		r := sinktest.NDT7("a", "192.0.2.1", sinktest.Start, int64(i+1)*125000).Data.(*data.NDT7Result)
+		r.Download.ClientMetadata = []metadata.NameValue{{Name: "client_library_name", Value: library}}
+		s := NDT7(r)
+		a.Add(&s[0])
+	}
+	aggs := a.Aggregates()
+	if len(aggs) != 2 {
+		t.Fatalf("Aggregates() = %d groups, want 2", len(aggs))
+	}
+	x := aggs[0]
+	if x.Value != "x" || x.Tests != 5 || x.LimitingFactors["congestion"] != 5 || x.ThroughputMbps.Mean != 3 || x.ThroughputMbps.P50 != 3 ||
+		x.ThroughputMbps.P25 != 2 || x.ThroughputMbps.P90 != 4.6 || x.Day != "2020-03-04" {
+		t.Errorf("Aggregates()[0] = %+v", x)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	tests := NDT7(sinktest.NDT7("a", "192.0.2.1", sinktest.Start, 1250000).Data.(*data.NDT7Result))
+	var buf bytes.Buffer
+	w := NewWriter(&buf, "csv", []string{"client_library_name"})
+	rtx.Must(w.WriteTest(&tests[0]), "WriteTest failed")
+	rtx.Must(w.Flush(), "Flush failed")
+	want := "UUID,Protocol,Direction,StartTime,ClientIP,ThroughputMbps,MinRTTMillis,RetransRate,Error,LimitingFactor,Metadata.client_library_name\n" +
+		"a,ndt7,download,2020-03-04T05:06:07Z,192.0.2.1,10,20,0.01,,congestion,libndt7\n"
+	if buf.String() != want {
+		t.Errorf("csv = %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	w = NewWriter(&buf, "ndjson", nil)
+	a := NewAggregator("")
+	a.Add(&tests[0])
+	aggs := a.Aggregates()
+	rtx.Must(w.WriteAggregate(&aggs[0]), "WriteAggregate failed")
+	if !strings.HasPrefix(buf.String(), `{"Day":"2020-03-04","Protocol":"ndt7","Direction":"download","Tests":1,`) {
+		t.Errorf("ndjson = %s", buf.String())
+	}
+}
@@ -0,0 +1,90 @@
+package tcpinfox
+
+import (
+	"time"
+
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+// The factors that can limit a transfer.
+const (
+	LimitApplication    = "application"
+	LimitReceiverWindow = "receiver-window"
+	LimitSendBuffer     = "send-buffer"
+	LimitCongestion     = "congestion"
+)
+
+// Limits are the factors that can limit a transfer, in the order of the
+// fields of LimitingFactors.
+var Limits = []string{LimitApplication, LimitReceiverWindow, LimitSendBuffer, LimitCongestion}
+
+// LimitingFactors are the fractions of the time of a transfer during which the
+// sender was limited by each factor. The fractions add up to one.
+type LimitingFactors struct {
+	// Application is the fraction of time the sender had no data to send,
+	// i.e. it was limited by the application rather than the network.
+	Application float64
+	// ReceiverWindow is the fraction of time the sender was stalled by the
+	// window advertised by the receiver.
+	ReceiverWindow float64
+	// SendBuffer is the fraction of time the sender was stalled by its send
+	// buffer.
+	SendBuffer float64
+	// Congestion is the fraction of the remaining time the sender was busy,
+	// i.e. limited by the congestion window or the path.
+	Congestion float64
+	// Dominant is the factor with the largest fraction, one of the Limit
+	// constants.
+	Dominant string
+}
+
+// Classify computes the limiting factors of a transfer of the given duration
+// from the BusyTime, RWndLimited and SndBufLimited counters of the sender.
+// start is the TCP_INFO at the start of the transfer, or nil when the
+// connection was idle before the transfer. It returns nil when the duration is
+// not positive or when the kernel does not report the counters.
+func Classify(start, end *tcp.LinuxTCPInfo, elapsed time.Duration) *LimitingFactors {
+	if end == nil || elapsed <= 0 || end.BusyTime == 0 {
+		return nil
+	}
+	busy, rwnd, sndbuf := end.BusyTime, end.RWndLimited, end.SndBufLimited
+	if start != nil {
+		busy -= start.BusyTime
+		rwnd -= start.RWndLimited
+		sndbuf -= start.SndBufLimited
+	}
+	// The counters are in microseconds. The busy time includes the time
+	// limited by the receiver window and the send buffer.
+	total := float64(elapsed / time.Microsecond)
+	if float64(busy) > total {
+		total = float64(busy)
+	}
+	if total <= 0 {
+		return nil
+	}
+	congestion := busy - rwnd - sndbuf
+	if congestion < 0 {
+		congestion = 0
+	}
+	lf := &LimitingFactors{
+		Application:    (total - float64(busy)) / total,
+		ReceiverWindow: float64(rwnd) / total,
+		SendBuffer:     float64(sndbuf) / total,
+		Congestion:     float64(congestion) / total,
+	}
+	dominant, max := LimitApplication, lf.Application
+	for _, f := range []struct {
+		name     string
+		fraction float64
+	}{
+		{LimitReceiverWindow, lf.ReceiverWindow},
+		{LimitSendBuffer, lf.SendBuffer},
+		{LimitCongestion, lf.Congestion},
+	} {
+		if f.fraction > max {
+			dominant, max = f.name, f.fraction
+		}
+	}
+	lf.Dominant = dominant
+	return lf
+}
@@ -0,0 +1,75 @@
+package tcpinfox
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name    string
+		start   *tcp.LinuxTCPInfo
+		end     *tcp.LinuxTCPInfo
+		elapsed time.Duration
+		want    *LimitingFactors
+	}{
+		{
+			name:    "congestion",
+			end:     &tcp.LinuxTCPInfo{BusyTime: 9000000, RWndLimited: 1000000},
+			elapsed: 10 * time.Second,
+			want:    &LimitingFactors{Application: 0.1, ReceiverWindow: 0.1, Congestion: 0.8, Dominant: LimitCongestion},
+		},
+		{
+			name:    "receiver-window",
+			start:   &tcp.LinuxTCPInfo{BusyTime: 1000000, RWndLimited: 1000000},
+			end:     &tcp.LinuxTCPInfo{BusyTime: 11000000, RWndLimited: 7000000, SndBufLimited: 1000000},
+			elapsed: 10 * time.Second,
+			want:    &LimitingFactors{ReceiverWindow: 0.6, SendBuffer: 0.1, Congestion: 0.3, Dominant: LimitReceiverWindow},
+		},
+		{
+			name:    "application",
+			end:     &tcp.LinuxTCPInfo{BusyTime: 2000000},
+			elapsed: 10 * time.Second,
+			want:    &LimitingFactors{Application: 0.8, Congestion: 0.2, Dominant: LimitApplication},
+		},
+		{
+			name:    "busy-longer-than-elapsed",
+			end:     &tcp.LinuxTCPInfo{BusyTime: 10500000, SndBufLimited: 10500000},
+			elapsed: 10 * time.Second,
+			want:    &LimitingFactors{SendBuffer: 1, Dominant: LimitSendBuffer},
+		},
+		{
+			name:    "no-counters",
+			end:     &tcp.LinuxTCPInfo{},
+			elapsed: 10 * time.Second,
+		},
+		{
+			name: "no-elapsed",
+			end:  &tcp.LinuxTCPInfo{BusyTime: 1},
+		},
+		{
+			name:    "nil",
+			elapsed: 10 * time.Second,
+		},
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Classify(tt.start, tt.end, tt.elapsed)
+			if got == nil || tt.want == nil {
+				if got != tt.want {
+					t.Errorf("Classify() = %+v, want %+v", got, tt.want)
+				}
+				return
+			}
+			if !near(got.Application, tt.want.Application) || !near(got.ReceiverWindow, tt.want.ReceiverWindow) ||
+				!near(got.SendBuffer, tt.want.SendBuffer) || !near(got.Congestion, tt.want.Congestion) ||
+				got.Dominant != tt.want.Dominant {
+				t.Errorf("Classify() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Package timeline records when the steps of a test happen, e.g. the TLS
+// handshake, the WebSocket upgrade and the first bulk message, so that the
+// archival data shows where a test stalled. Offsets are measured with the
+// monotonic clock from the time the connection was accepted.
+package timeline
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Event is a step of a test.
+type Event struct {
+	Name string
+	// Offset is the time of the step since AcceptTime, in nanoseconds.
+	Offset int64
+}
+
+// Timeline is the archival record of the steps of a test.
+type Timeline struct {
+	// AcceptTime is when the server accepted the connection.
+	AcceptTime time.Time
+	Events     []Event
+	// FirstRTT is the smoothed RTT of the first TCP_INFO sample after
+	// accept, in microseconds. It approximates the RTT of the TCP handshake.
+	FirstRTT uint32 `json:",omitempty"`
+}
+
+// Recorder records the steps of a test. A Recorder is safe for concurrent use,
+// and all its methods may be called on a nil Recorder, which does nothing.
+type Recorder struct {
+	start time.Time
+
+	mu       sync.Mutex
+	events   []Event
+	seen     map[string]bool
+	firstRTT uint32
+}
+
+// NewRecorder creates a Recorder for a connection accepted at start, which
+// must be a time returned by time.Now.
+func NewRecorder(start time.Time) *Recorder {
+	return &Recorder{start: start, seen: make(map[string]bool)}
+}
+
+// Mark records that the named step happened now. Only the first occurrence of
+// each step is recorded.
+func (r *Recorder) Mark(name string) {
+	if r == nil {
+		return
+	}
+	offset := time.Since(r.start)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen[name] {
+		return
+	}
+	r.seen[name] = true
+	r.events = append(r.events, Event{Name: name, Offset: int64(offset)})
+}
+
+// SetFirstRTT records the RTT of the first TCP_INFO sample, in microseconds.
+func (r *Recorder) SetFirstRTT(rtt uint32) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.firstRTT == 0 {
+		r.firstRTT = rtt
+	}
+}
+
+// Timeline returns the steps recorded so far, in the order they happened. It
+// returns nil for a nil Recorder.
+func (r *Recorder) Timeline() *Timeline {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := make([]Event, len(r.events))
+	copy(events, r.events)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Offset < events[j].Offset })
+	return &Timeline{
+		AcceptTime: r.start.UTC(),
+		Events:     events,
+		FirstRTT:   r.firstRTT,
+	}
+}
+
+type recorderKey struct{}
+
+// NewContext returns a copy of ctx that carries r.
+func NewContext(ctx context.Context, r *Recorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, r)
+}
+
+// FromContext returns the Recorder carried by ctx, or nil.
+func FromContext(ctx context.Context) *Recorder {
+	r, _ := ctx.Value(recorderKey{}).(*Recorder)
+	return r
+}
@@ -0,0 +1,51 @@
+package timeline
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	start := time.Now()
+	r := NewRecorder(start)
+	r.Mark("accept")
+	r.SetFirstRTT(412)
+	r.Mark("upgrade-done")
+	// Only the first occurrence of a step and of the RTT is recorded.
+	r.Mark("accept")
+	r.SetFirstRTT(1000)
+
+	tl := r.Timeline()
+	if !tl.AcceptTime.Equal(start) {
+		t.Errorf("AcceptTime = %v, want %v", tl.AcceptTime, start)
+	}
+	if tl.FirstRTT != 412 {
+		t.Errorf("FirstRTT = %d, want 412", tl.FirstRTT)
+	}
+	if len(tl.Events) != 2 || tl.Events[0].Name != "accept" || tl.Events[1].Name != "upgrade-done" {
+		t.Fatalf("Events = %+v, want accept and upgrade-done", tl.Events)
+	}
+	if tl.Events[0].Offset < 0 || tl.Events[1].Offset < tl.Events[0].Offset {
+		t.Errorf("Events = %+v, want increasing offsets", tl.Events)
+	}
+}
+
+func TestRecorder_nil(t *testing.T) {
+	var r *Recorder
+	r.Mark("accept")
+	r.SetFirstRTT(412)
+	if tl := r.Timeline(); tl != nil {
+		t.Errorf("Timeline() = %+v, want nil", tl)
+	}
+}
+
+func TestContext(t *testing.T) {
+	if r := FromContext(context.Background()); r != nil {
+		t.Errorf("FromContext() = %v, want nil", r)
+	}
+	r := NewRecorder(time.Now())
+	if got := FromContext(NewContext(context.Background(), r)); got != r {
+		t.Errorf("FromContext() = %v, want %v", got, r)
+	}
+}